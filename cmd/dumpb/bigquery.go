@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -17,48 +18,189 @@ var (
 	bigqueryProjectID       string
 	bigqueryLocation        string
 	bigqueryFilterDuration  time.Duration
+	bigqueryConcurrency     int
+	bigqueryMaxRetries      int
+	bigqueryRetryBackoff    time.Duration
+	bigqueryFormat          string
+	bigqueryFormatRules     []string
+
+	bigqueryIncludePatterns        []string
+	bigqueryDatasetFilterDurations []string
+	bigqueryLabels                 []string
+	bigqueryChangedOnly            bool
+	bigqueryPartitioned            bool
+	bigqueryStatePath              string
+	bigqueryStagingBucketName      string
+	bigqueryStagingPrefix          string
+
+	bigquerySnapshot           bool
+	bigquerySnapshotDataset    string
+	bigquerySnapshotExpiration time.Duration
+	bigquerySnapshotRetention  int
+
+	bigqueryRestoreProjectID   string
+	bigqueryRestoreDatasets    []string
+	bigqueryRestoreRenames     []string
+	bigqueryRestoreOverwrite   bool
+	bigqueryRestoreDefinitions bool
 )
 
 var bigQueryCmd = &cobra.Command{
 	Use:   "bigquery",
 	Short: "Dumps contents of bigquery via ",
 	RunE: exportWrapper("BigQuery", func(ctx context.Context, l *slog.Logger, sw storageWriter) (string, error) {
-		storage, err := configuredStorage(ctx)
+		if !bigquerySnapshot && storageBucketVendor != "gcs" && bigqueryStagingBucketName == "" {
+			return "", fmt.Errorf("bigquery exports to %q storage require a staging bucket", storageBucketVendor)
+		}
+		formatRules, err := export.ParseBigQueryFormatRules(bigqueryFormatRules)
+		if err != nil {
+			return "", err
+		}
+		datasetFilterAfter, err := parseDatasetFilterDurations(bigqueryDatasetFilterDurations)
 		if err != nil {
 			return "", err
 		}
+		stagingBucketName := bigqueryStagingBucketName
+		if stagingBucketName == "" && len(replicas) > 0 {
+			// extract jobs write to the bucket directly, staged files are copied through the storage
+			// and reach the replicas
+			stagingBucketName = storageBucketName
+		}
 		config := export.BigQueryDatasetExportConfig{
 			BucketName:      storageBucketName,
 			ProjectID:       bigqueryProjectID,
 			GCSLocation:     bigqueryLocation,
 			FilterAfter:     time.Now().Add(-bigqueryFilterDuration),
 			ExcludePatterns: bigqueryExcludePatterns,
-			Storage:         storage,
+			Storage:         sw,
+			Prefix:          bigqueryExportPrefix(runStart),
+			Concurrency:     bigqueryConcurrency,
+			MaxRetries:      bigqueryMaxRetries,
+			RetryBackoff:    bigqueryRetryBackoff,
+			Format:          export.BigQueryExportFormat(bigqueryFormat),
+			FormatRules:     formatRules,
+
+			IncludePatterns:    bigqueryIncludePatterns,
+			DatasetFilterAfter: datasetFilterAfter,
+			Labels:             export.ParseBigQueryLabels(bigqueryLabels),
+			ChangedOnly:        bigqueryChangedOnly,
+			Partitioned:        bigqueryPartitioned,
+			StatePath:          bigqueryStatePath,
+
+			StagingBucketName: stagingBucketName,
+			StagingPrefix:     bigqueryStagingPrefix,
+			StorageGCS:        storageBucketVendor == "gcs",
+
+			SnapshotDataset:    bigquerySnapshotDataset,
+			SnapshotExpiration: bigquerySnapshotExpiration,
+			SnapshotRetention:  bigquerySnapshotRetention,
 		}
 		export, err := export.NewBigQueryExport(ctx, config)
 		if err != nil {
 			return "", err
 		}
 
+		if bigquerySnapshot {
+			return export.Snapshot(ctx, l)
+		}
 		return export.Export(ctx, l)
 	}),
 }
 
+var bigQueryRestoreCmd = &cobra.Command{
+	Use:   "restore <timestamp>",
+	Short: "Recreates the datasets and tables of an export and loads the exported data",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		storage, err := configuredStorage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed in configuring storage: %w", err)
+		}
+		renames, err := export.ParseBigQueryRenames(bigqueryRestoreRenames)
+		if err != nil {
+			return err
+		}
+		projectID := bigqueryRestoreProjectID
+		if projectID == "" {
+			projectID = bigqueryProjectID
+		}
+		restore, err := export.NewBigQueryRestore(ctx, export.BigQueryRestoreConfig{
+			BucketName:   storageBucketName,
+			StorageGCS:   storageBucketVendor == "gcs",
+			ProjectID:    projectID,
+			GCSLocation:  bigqueryLocation,
+			Storage:      storage,
+			Datasets:     bigqueryRestoreDatasets,
+			Renames:      renames,
+			Overwrite:    bigqueryRestoreOverwrite,
+			Definitions:  bigqueryRestoreDefinitions,
+			Concurrency:  bigqueryConcurrency,
+			MaxRetries:   bigqueryMaxRetries,
+			RetryBackoff: bigqueryRetryBackoff,
+		})
+		if err != nil {
+			return err
+		}
+		ts, err := time.ParseInLocation(export.TimestampFormat, args[0], time.Local)
+		if err != nil {
+			return fmt.Errorf("failed to parse timestamp %q: %w", args[0], err)
+		}
+		// dumps written before the name template prefix are stored below the bare timestamp
+		return restore.Restore(ctx, slog.Default(), bigqueryExportPrefix(ts), ts.Format(export.TimestampFormat))
+	},
+}
+
 func init() {
 	rootCmd.AddCommand(bigQueryCmd)
-	bigQueryCmd.Flags().StringVar(&bigqueryProjectID, "bigquery-project-id", os.Getenv("BIGQUERY_PROJECT_ID"), "specifies the bigquery project ID")
-	bigQueryCmd.Flags().StringVar(&bigqueryLocation, "bigquery-location", os.Getenv("BIGQUERY_LOCATION"), "specifies the bigquery location")
+	bigQueryCmd.AddCommand(bigQueryRestoreCmd)
+	bigQueryCmd.PersistentFlags().StringVar(&bigqueryProjectID, "bigquery-project-id", os.Getenv("BIGQUERY_PROJECT_ID"), "specifies the bigquery project ID")
+	bigQueryCmd.PersistentFlags().StringVar(&bigqueryLocation, "bigquery-location", os.Getenv("BIGQUERY_LOCATION"), "specifies the bigquery location")
 	bigQueryCmd.Flags().DurationVar(&bigqueryFilterDuration, "bigquery-filter-duration", mustParseDuration(os.Getenv("BIGQUERY_FILTER_DURATION")), "specifies the bigquery filter after duration")
 	bigQueryCmd.Flags().StringSliceVar(&bigqueryExcludePatterns, "bigquery-exclude-patterns", strings.Split(os.Getenv("BIGQUERY_EXCLUDE_PATTERNS"), ","), "specifies the bigquery exclude patterns")
+	bigQueryCmd.PersistentFlags().IntVar(&bigqueryConcurrency, "bigquery-concurrency", mustParseInt(os.Getenv("BIGQUERY_CONCURRENCY")), "specifies how many extract or load jobs run in parallel per dataset")
+	bigQueryCmd.PersistentFlags().IntVar(&bigqueryMaxRetries, "bigquery-max-retries", mustParseInt(os.Getenv("BIGQUERY_MAX_RETRIES")), "specifies how often jobs failing with retryable errors are retried, negative to disable")
+	bigQueryCmd.PersistentFlags().DurationVar(&bigqueryRetryBackoff, "bigquery-retry-backoff", mustParseDuration(os.Getenv("BIGQUERY_RETRY_BACKOFF")), "specifies the initial backoff between retries, doubled on each retry")
+	bigQueryCmd.Flags().StringVar(&bigqueryFormat, "bigquery-format", os.Getenv("BIGQUERY_FORMAT"), "specifies the export format (parquet-gzip, parquet-snappy, parquet-zstd, avro, avro-snappy, avro-deflate, json, json-gzip)")
+	bigQueryCmd.Flags().StringSliceVar(&bigqueryFormatRules, "bigquery-format-rules", splitNonEmpty(os.Getenv("BIGQUERY_FORMAT_RULES")), "specifies export formats per table or dataset as pattern=format, e.g. analytics.*=avro")
+	bigQueryCmd.Flags().StringSliceVar(&bigqueryIncludePatterns, "bigquery-include-patterns", splitNonEmpty(os.Getenv("BIGQUERY_INCLUDE_PATTERNS")), "specifies the bigquery include patterns, all tables if empty")
+	bigQueryCmd.Flags().StringSliceVar(&bigqueryDatasetFilterDurations, "bigquery-dataset-filter-durations", splitNonEmpty(os.Getenv("BIGQUERY_DATASET_FILTER_DURATIONS")), "specifies the filter after duration per dataset as dataset=duration")
+	bigQueryCmd.Flags().StringSliceVar(&bigqueryLabels, "bigquery-labels", splitNonEmpty(os.Getenv("BIGQUERY_LABELS")), "specifies table labels as key=value or key, only tables having all labels are exported")
+	bigQueryCmd.Flags().BoolVar(&bigqueryChangedOnly, "bigquery-changed-only", os.Getenv("BIGQUERY_CHANGED_ONLY") == "true", "specifies that only tables modified since their last export are exported")
+	bigQueryCmd.Flags().BoolVar(&bigqueryPartitioned, "bigquery-partitioned", os.Getenv("BIGQUERY_PARTITIONED") == "true", "specifies that partitioned tables are exported per partition, only partitions modified since their last export")
+	bigQueryCmd.Flags().StringVar(&bigqueryStatePath, "bigquery-state-path", os.Getenv("BIGQUERY_STATE_PATH"), "specifies the storage path of the export state, defaults to bigquery-export.state.json")
+	bigQueryCmd.Flags().StringVar(&bigqueryStagingBucketName, "bigquery-staging-bucket-name", os.Getenv("BIGQUERY_STAGING_BUCKET_NAME"), "specifies a gcs bucket to extract into before copying to the storage, required for storage vendors other than gcs")
+	bigQueryCmd.Flags().StringVar(&bigqueryStagingPrefix, "bigquery-staging-prefix", os.Getenv("BIGQUERY_STAGING_PREFIX"), "specifies the temporary prefix within the staging bucket, defaults to staging")
+	bigQueryCmd.Flags().BoolVar(&bigquerySnapshot, "bigquery-snapshot", os.Getenv("BIGQUERY_SNAPSHOT") == "true", "specifies that table snapshots are created instead of extracting the tables")
+	bigQueryCmd.Flags().StringVar(&bigquerySnapshotDataset, "bigquery-snapshot-dataset", os.Getenv("BIGQUERY_SNAPSHOT_DATASET"), "specifies the dataset the snapshots are created in")
+	bigQueryCmd.Flags().DurationVar(&bigquerySnapshotExpiration, "bigquery-snapshot-expiration", mustParseDuration(os.Getenv("BIGQUERY_SNAPSHOT_EXPIRATION")), "specifies after which duration snapshots expire, never if zero")
+	bigQueryCmd.Flags().IntVar(&bigquerySnapshotRetention, "bigquery-snapshot-retention", mustParseInt(os.Getenv("BIGQUERY_SNAPSHOT_RETENTION")), "specifies how many snapshots are kept per table, all if zero")
+	bigQueryRestoreCmd.Flags().StringVar(&bigqueryRestoreProjectID, "bigquery-restore-project-id", os.Getenv("BIGQUERY_RESTORE_PROJECT_ID"), "specifies the target project, defaults to the bigquery project ID")
+	bigQueryRestoreCmd.Flags().StringSliceVar(&bigqueryRestoreDatasets, "bigquery-restore-datasets", splitNonEmpty(os.Getenv("BIGQUERY_RESTORE_DATASETS")), "specifies the exported datasets to restore, all if empty")
+	bigQueryRestoreCmd.Flags().StringSliceVar(&bigqueryRestoreRenames, "bigquery-restore-renames", splitNonEmpty(os.Getenv("BIGQUERY_RESTORE_RENAMES")), "specifies renames as dataset=target or dataset.table=target")
+	bigQueryRestoreCmd.Flags().BoolVar(&bigqueryRestoreOverwrite, "bigquery-restore-overwrite", os.Getenv("BIGQUERY_RESTORE_OVERWRITE") == "true", "specifies that existing tables are replaced")
+	bigQueryRestoreCmd.Flags().BoolVar(&bigqueryRestoreDefinitions, "bigquery-restore-definitions", os.Getenv("BIGQUERY_RESTORE_DEFINITIONS") == "true", "specifies that views, materialized views, external tables and routines are recreated")
 }
 
-func mustParseDuration(value string) time.Duration {
-	if value == "" {
-		return 0
-	}
-	duration, err := time.ParseDuration(value)
-	if err != nil {
-		panic(fmt.Errorf("failed to parse duration: %w", err))
+// bigqueryExportPrefix is the storage path the export of the run is written below, named by
+// the name template without extension
+func bigqueryExportPrefix(ts time.Time) string {
+	return filepath.Join(storageBucketPath, exportName("bigquery", "", ts, ""))
+}
+
+// parseDatasetFilterDurations converts dataset=duration pairs into per dataset filter times
+func parseDatasetFilterDurations(values []string) (map[string]time.Time, error) {
+	filterAfter := map[string]time.Time{}
+	for _, value := range values {
+		dataset, duration, ok := strings.Cut(value, "=")
+		if !ok || dataset == "" {
+			return nil, fmt.Errorf("dataset filter duration %q must be given as dataset=duration", value)
+		}
+		d, err := time.ParseDuration(duration)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse duration of dataset %s: %w", dataset, err)
+		}
+		filterAfter[dataset] = time.Now().Add(-d)
 	}
-	return duration
+	return filterAfter, nil
 }
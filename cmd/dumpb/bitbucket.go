@@ -8,36 +8,85 @@ import (
 	"path/filepath"
 	"time"
 
-	"github.com/foomo/dump-buckets/pkg/export"
+	"github.com/foomo/dump-buckets/pkg/compression"
 	"github.com/foomo/dump-buckets/pkg/export/bitbucket"
 	"github.com/spf13/cobra"
 )
 
 var (
-	bitbucketToken   string
-	bitbucketAccount string
+	bitbucketToken       string
+	bitbucketAccount     string
+	bitbucketConcurrency int
+
+	bitbucketServerURL      string
+	bitbucketCloneProtocol  string
+	bitbucketSSHKeyPath     string
+	bitbucketSSHKeyPassword string
+	bitbucketSSHKnownHosts  string
+
+	bitbucketIncludePatterns []string
+	bitbucketExcludePatterns []string
+	bitbucketProjectKeys     []string
+	bitbucketUpdatedDuration time.Duration
+	bitbucketUpdatedSinceRun bool
+	bitbucketStatePath       string
+	bitbucketMaxSize         int
+	bitbucketCollectors      []string
+
+	bitbucketBundles         bool
+	bitbucketBundlePath      string
+	bitbucketFullBundleEvery int
 )
 
 var bitbucketCmd = &cobra.Command{
 	Use:   "bitbucket",
 	Short: "Dumps bitbucket accounts in a destination bucket",
 	RunE: exportWrapper("BitBucket", func(ctx context.Context, l *slog.Logger, sw storageWriter) (string, error) {
+		codec, err := configuredCompression(compression.Gzip)
+		if err != nil {
+			return "", err
+		}
 		config := bitbucket.Config{
 			AccountName: bitbucketAccount,
 			Token:       bitbucketToken,
+			Concurrency: bitbucketConcurrency,
+
+			ServerURL:      bitbucketServerURL,
+			CloneProtocol:  bitbucketCloneProtocol,
+			SSHKeyPath:     bitbucketSSHKeyPath,
+			SSHKeyPassword: bitbucketSSHKeyPassword,
+			SSHKnownHosts:  bitbucketSSHKnownHosts,
+
+			IncludePatterns: bitbucketIncludePatterns,
+			ExcludePatterns: bitbucketExcludePatterns,
+			ProjectKeys:     bitbucketProjectKeys,
+			MaxSize:         bitbucketMaxSize,
+
+			UpdatedSinceLastRun: bitbucketUpdatedSinceRun,
+			StatePath:           getBitbucketStatePath(),
+
+			Collectors: bitbucketCollectors,
+
+			Storage:         sw,
+			BundlePath:      getBitbucketBundlePath(),
+			FullBundleEvery: bitbucketFullBundleEvery,
+
+			Compression: codec,
+		}
+		if bitbucketUpdatedDuration > 0 {
+			config.UpdatedAfter = time.Now().Add(-bitbucketUpdatedDuration)
 		}
 		exporter, err := bitbucket.NewExporter(ctx, config)
 		if err != nil {
 			return "", err
 		}
-
-		exportName := fmt.Sprintf("%s.%s.tar.gz", bitbucketAccount, time.Now().Format(export.TimestampFormat))
-		if backupName != "" {
-			exportName += fmt.Sprintf("%s/%s", backupName, exportName)
+		if bitbucketBundles {
+			return exporter.ExportBundles(ctx, l)
 		}
-		exportPath := filepath.Join(storageBucketPath, exportName)
 
-		writer, err := sw.NewWriter(ctx, exportPath)
+		exportPath := filepath.Join(storageBucketPath, exportName("bitbucket", bitbucketAccount, runStart, ".tar"+codec.Extension()))
+
+		writer, err := sw.NewWriter(ctx, exportPath, codec.WriterOptions()...)
 		if err != nil {
 			return "", fmt.Errorf("failed to initialize writer: %w", err)
 		}
@@ -47,8 +96,61 @@ var bitbucketCmd = &cobra.Command{
 	}),
 }
 
+var bitbucketRestoreCmd = &cobra.Command{
+	Use:   "restore <repository> <destination>",
+	Short: "Restores a repository from its incremental bundle chain into a bare repository",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		sw, err := configuredStorage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed in configuring storage: %w", err)
+		}
+		exporter, err := bitbucket.NewExporter(ctx, bitbucket.Config{
+			Storage:    sw,
+			BundlePath: getBitbucketBundlePath(),
+		})
+		if err != nil {
+			return err
+		}
+		return exporter.Restore(ctx, slog.Default(), args[0], args[1])
+	},
+}
+
+func getBitbucketBundlePath() string {
+	if bitbucketBundlePath != "" {
+		return bitbucketBundlePath
+	}
+	return filepath.Join(storageBucketPath, backupName, "bundles")
+}
+
+func getBitbucketStatePath() string {
+	if bitbucketStatePath != "" {
+		return bitbucketStatePath
+	}
+	return filepath.Join(storageBucketPath, backupName, "bitbucket.state.json")
+}
+
 func init() {
 	rootCmd.AddCommand(bitbucketCmd)
+	bitbucketCmd.AddCommand(bitbucketRestoreCmd)
 	bitbucketCmd.Flags().StringVar(&bitbucketToken, "bitbucket-token", os.Getenv("BITBUCKET_TOKEN"), "specifies the bitbucket token")
 	bitbucketCmd.Flags().StringVar(&bitbucketAccount, "bitbucket-account", os.Getenv("BITBUCKET_ACCOUNT"), "specifies the bitbucket account name ")
+	bitbucketCmd.Flags().IntVar(&bitbucketConcurrency, "bitbucket-concurrency", mustParseInt(os.Getenv("BITBUCKET_CONCURRENCY")), "specifies how many repositories are cloned in parallel")
+	bitbucketCmd.Flags().StringVar(&bitbucketServerURL, "bitbucket-server-url", os.Getenv("BITBUCKET_SERVER_URL"), "specifies the base URL of a bitbucket server / data center instance")
+	bitbucketCmd.Flags().StringVar(&bitbucketCloneProtocol, "bitbucket-clone-protocol", os.Getenv("BITBUCKET_CLONE_PROTOCOL"), "specifies the clone protocol, https or ssh")
+	bitbucketCmd.Flags().StringVar(&bitbucketSSHKeyPath, "bitbucket-ssh-key-path", os.Getenv("BITBUCKET_SSH_KEY_PATH"), "specifies the private key used for ssh cloning")
+	bitbucketCmd.Flags().StringVar(&bitbucketSSHKeyPassword, "bitbucket-ssh-key-password", os.Getenv("BITBUCKET_SSH_KEY_PASSWORD"), "specifies the password of the ssh private key")
+	bitbucketCmd.Flags().StringVar(&bitbucketSSHKnownHosts, "bitbucket-ssh-known-hosts", os.Getenv("BITBUCKET_SSH_KNOWN_HOSTS"), "specifies the known_hosts file verifying the ssh host keys, defaults to $SSH_KNOWN_HOSTS or ~/.ssh/known_hosts")
+	bitbucketCmd.Flags().StringSliceVar(&bitbucketIncludePatterns, "bitbucket-include-patterns", splitNonEmpty(os.Getenv("BITBUCKET_INCLUDE_PATTERNS")), "specifies glob patterns on the repository slug to include")
+	bitbucketCmd.Flags().StringSliceVar(&bitbucketExcludePatterns, "bitbucket-exclude-patterns", splitNonEmpty(os.Getenv("BITBUCKET_EXCLUDE_PATTERNS")), "specifies glob patterns on the repository slug to exclude")
+	bitbucketCmd.Flags().StringSliceVar(&bitbucketProjectKeys, "bitbucket-project-keys", splitNonEmpty(os.Getenv("BITBUCKET_PROJECT_KEYS")), "specifies the project keys to export, all projects if empty")
+	bitbucketCmd.Flags().DurationVar(&bitbucketUpdatedDuration, "bitbucket-updated-duration", mustParseDuration(os.Getenv("BITBUCKET_UPDATED_DURATION")), "specifies to skip repositories not updated within the duration")
+	bitbucketCmd.Flags().BoolVar(&bitbucketUpdatedSinceRun, "bitbucket-updated-since-last-run", os.Getenv("BITBUCKET_UPDATED_SINCE_LAST_RUN") == "true", "specifies to skip repositories not updated since the start of the last successful run")
+	bitbucketCmd.Flags().StringVar(&bitbucketStatePath, "bitbucket-state-path", os.Getenv("BITBUCKET_STATE_PATH"), "specifies the storage path of the last run state, defaults to <storage-path>/<backup-name>/bitbucket.state.json")
+	bitbucketCmd.Flags().IntVar(&bitbucketMaxSize, "bitbucket-max-size", mustParseInt(os.Getenv("BITBUCKET_MAX_SIZE")), "specifies the maximum repository size in bytes")
+	bitbucketCmd.Flags().StringSliceVar(&bitbucketCollectors, "bitbucket-collectors", splitNonEmpty(os.Getenv("BITBUCKET_COLLECTORS")), "specifies the metadata to archive next to each mirror (pullrequests, issues, downloads, hooks, branch-restrictions, pipelines-config)")
+	bitbucketCmd.PersistentFlags().StringVar(&bitbucketBundlePath, "bitbucket-bundle-path", os.Getenv("BITBUCKET_BUNDLE_PATH"), "specifies the storage path of incremental bundles and their state, defaults to <storage-path>/<backup-name>/bundles")
+	bitbucketCmd.Flags().BoolVar(&bitbucketBundles, "bitbucket-bundles", os.Getenv("BITBUCKET_BUNDLES") == "true", "specifies that repositories are backed up as incremental git bundles")
+	bitbucketCmd.Flags().IntVar(&bitbucketFullBundleEvery, "bitbucket-full-bundle-every", mustParseInt(os.Getenv("BITBUCKET_FULL_BUNDLE_EVERY")), "specifies after how many runs a full bundle is created, only on the first run if zero")
 }
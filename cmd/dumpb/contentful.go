@@ -2,59 +2,239 @@ package dumpb
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/foomo/dump-buckets/pkg/compression"
 	"github.com/foomo/dump-buckets/pkg/export"
 	"github.com/foomo/dump-buckets/pkg/storage"
 	"github.com/spf13/cobra"
 )
 
+const contentfulMasterEnvironment = "master"
+
 var (
 	contentfulManagementToken string
 	contentfulSpaceID         string
+
+	contentfulSpaceIDs         []string
+	contentfulAllSpaces        bool
+	contentfulEnvironmentIDs   []string
+	contentfulIncludeAliases   bool
+	contentfulDownloadAssets   bool
+	contentfulAssetConcurrency int
+
+	contentfulSync          bool
+	contentfulDeliveryToken string
+	contentfulSyncBaseURL   string
+	contentfulSyncFullEvery int
 )
 
 var contentfulCmd = &cobra.Command{
 	Use:   "contentful",
 	Short: "Dumps contentful spaces in a specific bucket",
 	RunE: exportWrapper("Contentful", func(ctx context.Context, l *slog.Logger, sw storageWriter) (string, error) {
+		codec, err := configuredCompression(compression.Gzip)
+		if err != nil {
+			return "", err
+		}
 		config := export.ContentfulExportConfig{
 			ManagementToken: contentfulManagementToken,
 			SpaceID:         contentfulSpaceID,
+
+			SpaceIDs:       contentfulSpaceIDs,
+			AllSpaces:      contentfulAllSpaces,
+			EnvironmentIDs: contentfulEnvironmentIDs,
+			IncludeAliases: contentfulIncludeAliases,
+
+			AssetConcurrency: contentfulAssetConcurrency,
+
+			DeliveryToken: contentfulDeliveryToken,
+			SyncBaseURL:   contentfulSyncBaseURL,
+
+			Compression: codec,
 		}
 		exporter, err := export.NewContentfulExport(ctx, config)
 		if err != nil {
 			return "", err
 		}
 
-		exportName := fmt.Sprintf("%s.json.gz", time.Now().Format(export.TimestampFormat))
-		if backupName != "" {
-			exportName = fmt.Sprintf("%s/%s", backupName, exportName)
-		}
-		exportPath := filepath.Join(storageBucketPath, exportName)
-
-		writer, err := sw.NewWriter(
-			ctx,
-			exportPath,
-			storage.WithContentType("application/json"),
-			storage.WithContentEncoding("gzip"),
-			storage.WithMetadata("SpaceID", contentfulSpaceID),
-		)
+		targets, err := exporter.Targets(ctx)
 		if err != nil {
-			return "", fmt.Errorf("failed to initialize writer: %w", err)
+			return "", err
+		}
+		if len(targets) == 0 {
+			return "", errors.New("no contentful spaces selected for export")
 		}
-		defer writer.Close()
 
-		return exportPath, exporter.Export(ctx, writer)
+		return filepath.Join(storageBucketPath, backupName), exportContentfulTargets(ctx, l, sw, exporter, targets, runStart)
 	}),
 }
 
+// exportContentfulTargets exports all targets, the objects of every exported environment are
+// committed right away so a failing environment doesn't discard the others
+func exportContentfulTargets(ctx context.Context, l *slog.Logger, sw storageWriter, exporter *export.ContentfulExport, targets []export.ContentfulTarget, ts time.Time) error {
+	var errs []error
+	for _, target := range targets {
+		l := l.With(slog.String("spaceID", target.SpaceID), slog.String("environmentID", target.EnvironmentID))
+		paths, err := exportContentfulTarget(ctx, l, sw, exporter.ForTarget(target), target, contentfulSource(target, len(targets)), ts)
+		if err == nil {
+			// the environment is kept even if another one fails
+			err = storage.Commit(ctx, sw, paths...)
+		}
+		if err != nil {
+			// Continue exporting other environments
+			l.Error("Failed to export contentful environment, continuing dump...", slog.Any("error", err))
+			errs = append(errs, fmt.Errorf("%s/%s: %w", target.SpaceID, target.EnvironmentID, err))
+			continue
+		}
+		l.Info("Contentful environment export complete", slog.String("path", paths[0]))
+	}
+	return errors.Join(errs...)
+}
+
+// exportContentfulTarget writes the export of a single space environment, and its asset
+// files if enabled, into a dedicated object and returns the paths of all written objects,
+// starting with the export
+func exportContentfulTarget(ctx context.Context, l *slog.Logger, sw storageWriter, exporter *export.ContentfulExport, target export.ContentfulTarget, source string, ts time.Time) ([]string, error) {
+	targetPath := filepath.Join(storageBucketPath, backupName, source)
+	opts := contentfulTargetMetadata(target)
+	if contentfulSync {
+		return syncContentfulTarget(ctx, l, sw, exporter, source, targetPath, ts, opts)
+	}
+
+	codec := exporter.Compression()
+	exportPath := filepath.Join(storageBucketPath, exportName("contentful", source, ts, ".json"+codec.Extension()))
+	writer, err := sw.NewWriter(
+		ctx,
+		exportPath,
+		append(append(opts,
+			storage.WithContentType("application/json")),
+			codec.WriterOptions()...,
+		)...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize writer: %w", err)
+	}
+	if err := exporter.Export(ctx, l, writer); err != nil {
+		writer.Close()
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to store export: %w", err)
+	}
+	if !contentfulDownloadAssets {
+		return []string{exportPath}, nil
+	}
+
+	assetsPath := strings.TrimSuffix(exportPath, ".json"+codec.Extension()) + ".assets.tar" + codec.Extension()
+	manifestPath := filepath.Join(targetPath, "contentful-assets.manifest.json")
+	if err := exportContentfulAssets(ctx, l, sw, exporter, assetsPath, manifestPath, append(opts, codec.WriterOptions()...)); err != nil {
+		return nil, err
+	}
+	return []string{exportPath, assetsPath, manifestPath}, nil
+}
+
+// syncContentfulTarget writes the changes since the previous run of the target as JSON lines,
+// the sync token is kept in the bucket next to the exports
+func syncContentfulTarget(ctx context.Context, l *slog.Logger, sw storageWriter, exporter *export.ContentfulExport, source, targetPath string, ts time.Time, opts []storage.WriterOption) ([]string, error) {
+	statePath := filepath.Join(targetPath, "contentful-sync.state.json")
+	var previous *export.ContentfulSyncState
+	if _, err := export.ReadState(ctx, sw, statePath, &previous); err != nil {
+		return nil, err
+	}
+
+	mode := previous.SyncMode(contentfulSyncFullEvery)
+	codec := exporter.Compression()
+	exportPath := filepath.Join(storageBucketPath, exportName("contentful", source, ts, fmt.Sprintf(".sync.%s.jsonl%s", mode, codec.Extension())))
+	writer, err := sw.NewWriter(
+		ctx,
+		exportPath,
+		append(append(opts,
+			storage.WithContentType("application/jsonl"),
+			storage.WithMetadata("SyncMode", mode)),
+			codec.WriterOptions()...,
+		)...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize writer: %w", err)
+	}
+	next, err := exporter.Sync(ctx, l, writer, previous, contentfulSyncFullEvery)
+	if err != nil {
+		writer.Close()
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to store sync: %w", err)
+	}
+	if err := export.WriteState(ctx, sw, statePath, next); err != nil {
+		return nil, err
+	}
+	return []string{exportPath, statePath}, nil
+}
+
+// contentfulSource is the source of the export names of the target; the master environment
+// of a single space keeps the names of single space exports, `<backup>/<ts>.json.gz`
+func contentfulSource(target export.ContentfulTarget, targets int) string {
+	if targets == 1 && target.EnvironmentID == contentfulMasterEnvironment && target.AliasOf == "" {
+		return ""
+	}
+	return target.SpaceID + "/" + target.EnvironmentID
+}
+
+func contentfulTargetMetadata(target export.ContentfulTarget) []storage.WriterOption {
+	opts := []storage.WriterOption{
+		storage.WithMetadata("SpaceID", target.SpaceID),
+		storage.WithMetadata("EnvironmentID", target.EnvironmentID),
+	}
+	if target.AliasOf != "" {
+		opts = append(opts, storage.WithMetadata("AliasOf", target.AliasOf))
+	}
+	return opts
+}
+
+// exportContentfulAssets archives the asset files next to the JSON export; the manifest
+// of the previous run is kept in the bucket to skip unchanged files
+func exportContentfulAssets(ctx context.Context, l *slog.Logger, sw storageWriter, exporter *export.ContentfulExport, assetsPath, manifestPath string, opts []storage.WriterOption) error {
+	var previous *export.ContentfulAssetManifest
+	if _, err := export.ReadState(ctx, sw, manifestPath, &previous); err != nil {
+		return err
+	}
+
+	writer, err := sw.NewWriter(ctx, assetsPath, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to initialize writer: %w", err)
+	}
+	manifest, err := exporter.ExportAssets(ctx, l, writer, assetsPath, previous)
+	if err != nil {
+		writer.Close()
+		return fmt.Errorf("failed to export assets: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to store assets: %w", err)
+	}
+	l.Info("Asset export complete", slog.String("path", assetsPath), slog.Int("files", len(manifest.Files)))
+
+	return export.WriteState(ctx, sw, manifestPath, manifest)
+}
+
 func init() {
 	rootCmd.AddCommand(contentfulCmd)
 	contentfulCmd.Flags().StringVar(&contentfulManagementToken, "contentful-management-token", os.Getenv("CONTENTFUL_MANAGEMENT_TOKEN"), "specifies the contentful management token")
 	contentfulCmd.Flags().StringVar(&contentfulSpaceID, "contentful-space-id", os.Getenv("CONTENTFUL_SPACE_ID"), "specifies the contentful space ID")
+	contentfulCmd.Flags().StringSliceVar(&contentfulSpaceIDs, "contentful-space-ids", splitNonEmpty(os.Getenv("CONTENTFUL_SPACE_IDS")), "specifies additional contentful space IDs")
+	contentfulCmd.Flags().BoolVar(&contentfulAllSpaces, "contentful-all-spaces", os.Getenv("CONTENTFUL_ALL_SPACES") == "true", "specifies that all spaces visible to the token are exported")
+	contentfulCmd.Flags().StringSliceVar(&contentfulEnvironmentIDs, "contentful-environment-ids", splitNonEmpty(os.Getenv("CONTENTFUL_ENVIRONMENT_IDS")), "specifies the environments to export, * for all, defaults to master")
+	contentfulCmd.Flags().BoolVar(&contentfulIncludeAliases, "contentful-include-aliases", os.Getenv("CONTENTFUL_INCLUDE_ALIASES") == "true", "specifies that environment aliases are exported along with all environments")
+	contentfulCmd.Flags().BoolVar(&contentfulDownloadAssets, "contentful-download-assets", os.Getenv("CONTENTFUL_DOWNLOAD_ASSETS") == "true", "specifies that asset files are archived next to the export")
+	contentfulCmd.Flags().IntVar(&contentfulAssetConcurrency, "contentful-asset-concurrency", mustParseInt(os.Getenv("CONTENTFUL_ASSET_CONCURRENCY")), "specifies how many asset files are downloaded in parallel")
+	contentfulCmd.Flags().BoolVar(&contentfulSync, "contentful-sync", os.Getenv("CONTENTFUL_SYNC") == "true", "specifies that only changes since the previous run are exported using the sync api")
+	contentfulCmd.Flags().StringVar(&contentfulDeliveryToken, "contentful-delivery-token", os.Getenv("CONTENTFUL_DELIVERY_TOKEN"), "specifies the delivery or preview token used by the sync api")
+	contentfulCmd.Flags().StringVar(&contentfulSyncBaseURL, "contentful-sync-base-url", os.Getenv("CONTENTFUL_SYNC_BASE_URL"), "specifies the sync api base url, https://preview.contentful.com includes drafts")
+	contentfulCmd.Flags().IntVar(&contentfulSyncFullEvery, "contentful-sync-full-every", mustParseInt(os.Getenv("CONTENTFUL_SYNC_FULL_EVERY")), "specifies after how many delta runs a full baseline is forced, only on the first run if zero")
 }
@@ -0,0 +1,59 @@
+package dumpb
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foomo/dump-buckets/pkg/export"
+	"github.com/foomo/dump-buckets/pkg/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_exportContentfulTargets(t *testing.T) {
+	ctx := context.Background()
+	backupName = "backup"
+	nameTemplate = ""
+	contentfulSync = false
+	contentfulDownloadAssets = true
+	t.Cleanup(func() { contentfulDownloadAssets = false })
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/spaces/broken/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, `{"total":0,"items":[]}`)
+	}))
+	defer server.Close()
+
+	exporter, err := export.NewContentfulExport(ctx, export.ContentfulExportConfig{ManagementToken: "token", BaseURL: server.URL})
+	require.NoError(t, err)
+	fs, err := storage.NewFSStorage(ctx, t.TempDir())
+	require.NoError(t, err)
+
+	targets := []export.ContentfulTarget{{SpaceID: "space", EnvironmentID: "master"}, {SpaceID: "broken", EnvironmentID: "master"}}
+	ts := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+	err = runAtomic(t, fs, func(sw storageWriter) error {
+		return exportContentfulTargets(ctx, slog.Default(), sw, exporter, targets, ts)
+	})
+	require.ErrorContains(t, err, "broken/master")
+
+	// the environment which succeeded is kept, including its asset manifest
+	objects, err := fs.List(ctx, "")
+	require.NoError(t, err)
+	var paths []string
+	for _, object := range objects {
+		paths = append(paths, object.Path)
+	}
+	require.ElementsMatch(t, []string{
+		"backup/space/master/20240101T000000.json.gz",
+		"backup/space/master/20240101T000000.assets.tar.gz",
+		"backup/space/master/contentful-assets.manifest.json",
+	}, paths)
+}
@@ -2,10 +2,12 @@ package dumpb
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"time"
 
+	"github.com/foomo/dump-buckets/pkg/storage"
 	"github.com/spf13/cobra"
 )
 
@@ -26,13 +28,80 @@ func exportWrapper(exporterName string, handler exporterHandler) func(cmd *cobra
 			return fmt.Errorf("failed in configuring storage: %w", err)
 		}
 
+		targets, err := configuredReplicas(ctx)
+		if err != nil {
+			return err
+		}
+		var backend storage.Backend = vendorStorage
+		var replicated *storage.Replicated
+		if len(targets) > 0 && replicationMode == replicationModeTee {
+			replicated = storage.NewReplicated(vendorStorage, targets...)
+			backend = replicated
+		}
+
+		// Objects are only moved to their final names once the export succeeded
+		atomic, err := storage.NewAtomic(backend)
+		if err != nil {
+			return err
+		}
+
 		l.Info("Starting exporter...")
-		path, err := handler(ctx, l, vendorStorage)
+		path, err := handler(ctx, l, atomic)
 		if err != nil {
+			if abortErr := atomic.Abort(ctx); abortErr != nil {
+				l.Error("Failed to discard pending objects", slog.Any("error", abortErr))
+			}
+			// objects committed by the handler, e.g. of the environments which succeeded, are kept
+			if committed := atomic.Committed(); len(committed) > 0 {
+				l.Info("Kept objects of the failed export", slog.Int("objects", len(committed)))
+				return errors.Join(err, replicationResult(l, replicationStatuses(ctx, vendorStorage, targets, replicated, committed)))
+			}
 			return err
 		}
+		if err := atomic.Commit(ctx); err != nil {
+			return fmt.Errorf("failed to commit export: %w", err)
+		}
+		if path != "" {
+			if err := atomic.WriteMarker(ctx, path); err != nil {
+				return fmt.Errorf("failed to write success marker: %w", err)
+			}
+		}
 
 		l.With(slog.String("path", path)).Info("Export complete", slog.Any("duration", time.Since(start).Seconds()))
-		return nil
+
+		paths := atomic.Committed()
+		if path != "" && len(paths) > 0 {
+			paths = append(paths, path+storage.SuccessMarkerSuffix)
+		}
+		return replicationResult(l, replicationStatuses(ctx, vendorStorage, targets, replicated, paths))
+	}
+}
+
+// replicationStatuses returns the status of the replicas written along with the export, or
+// copies the committed paths to the targets
+func replicationStatuses(ctx context.Context, src storage.Backend, targets []storage.Target, replicated *storage.Replicated, paths []string) []storage.TargetStatus {
+	if replicated != nil {
+		return replicated.Status()
+	}
+	statuses := make([]storage.TargetStatus, 0, len(targets))
+	for _, target := range targets {
+		statuses = append(statuses, storage.CopyPaths(ctx, src, target, paths...))
+	}
+	return statuses
+}
+
+// replicationResult logs the status of every replica, the export is complete on the primary
+// storage even if a replica failed; dumpb replicate backfills the missing objects
+func replicationResult(l *slog.Logger, statuses []storage.TargetStatus) error {
+	var errs []error
+	for _, status := range statuses {
+		rl := l.With(slog.String("replica", status.Name), slog.Int("objects", status.Objects))
+		if err := status.Err(); err != nil {
+			rl.Error("Replication failed", slog.Any("error", err))
+			errs = append(errs, err)
+			continue
+		}
+		rl.Info("Replication complete")
 	}
+	return errors.Join(errs...)
 }
@@ -0,0 +1,106 @@
+package dumpb
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"path/filepath"
+	"testing"
+
+	"github.com/foomo/dump-buckets/pkg/storage"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_exportWrapper_replicas(t *testing.T) {
+	ctx := context.Background()
+	t.Cleanup(func() {
+		storageBucketVendor, storageBucketName, replicas, replicationMode = "", "", nil, ""
+	})
+
+	// writes the files of two datasets like the bigquery exporter, the first one is committed
+	// on its own before the second one fails
+	handler := func(fail bool) exporterHandler {
+		return func(ctx context.Context, l *slog.Logger, sw storageWriter) (string, error) {
+			for _, dataset := range []string{"sales", "crm"} {
+				files := []string{"backup/ts/" + dataset + "/MANIFEST.json", "backup/ts/" + dataset + "/orders/000.parquet"}
+				for _, file := range files {
+					writer, err := sw.NewWriter(ctx, file)
+					if err != nil {
+						return "", err
+					}
+					if err := writer.Close(); err != nil {
+						return "", err
+					}
+				}
+				if fail && dataset == "crm" {
+					return "", errors.New("dataset failed")
+				}
+				if err := storage.Commit(ctx, sw, files...); err != nil {
+					return "", err
+				}
+			}
+			return "backup/ts", nil
+		}
+	}
+
+	tests := []struct {
+		name string
+		mode string
+		fail bool
+		want []string
+	}{
+		{
+			name: "tee",
+			mode: replicationModeTee,
+			want: []string{"backup/ts.SUCCESS", "backup/ts/crm/MANIFEST.json", "backup/ts/crm/orders/000.parquet", "backup/ts/sales/MANIFEST.json", "backup/ts/sales/orders/000.parquet"},
+		},
+		{
+			name: "copy",
+			mode: replicationModeCopy,
+			want: []string{"backup/ts.SUCCESS", "backup/ts/crm/MANIFEST.json", "backup/ts/crm/orders/000.parquet", "backup/ts/sales/MANIFEST.json", "backup/ts/sales/orders/000.parquet"},
+		},
+		{
+			name: "tee failed",
+			mode: replicationModeTee,
+			fail: true,
+			want: []string{"backup/ts/sales/MANIFEST.json", "backup/ts/sales/orders/000.parquet"},
+		},
+		{
+			name: "copy failed",
+			mode: replicationModeCopy,
+			fail: true,
+			want: []string{"backup/ts/sales/MANIFEST.json", "backup/ts/sales/orders/000.parquet"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			storageBucketVendor = "fs"
+			storageBucketName = filepath.Join(root, "primary")
+			replicas = []string{"fs:" + filepath.Join(root, "replica")}
+			replicationMode = tt.mode
+
+			cmd := &cobra.Command{}
+			cmd.SetContext(ctx)
+			err := exportWrapper("BigQuery", handler(tt.fail))(cmd, nil)
+			if tt.fail {
+				require.ErrorContains(t, err, "dataset failed")
+			} else {
+				require.NoError(t, err)
+			}
+
+			for _, bucket := range []string{"primary", "replica"} {
+				fs, err := storage.NewFSStorage(ctx, filepath.Join(root, bucket))
+				require.NoError(t, err)
+				objects, err := fs.List(ctx, "")
+				require.NoError(t, err)
+				var paths []string
+				for _, object := range objects {
+					paths = append(paths, object.Path)
+				}
+				require.ElementsMatch(t, tt.want, paths, bucket)
+			}
+		})
+	}
+}
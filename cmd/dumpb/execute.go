@@ -2,24 +2,46 @@ package dumpb
 
 import (
 	"bufio"
-	"compress/gzip"
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"log/slog"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"strconv"
 	"time"
 
+	"github.com/foomo/dump-buckets/pkg/compression"
 	"github.com/foomo/dump-buckets/pkg/export"
+	"github.com/foomo/dump-buckets/pkg/storage"
 	"github.com/spf13/cobra"
 )
 
 var (
-	outputGzip bool
-	outputExt  string
+	outputGzip    bool
+	outputExt     string
+	outputDirMode string
+	onFailure     string
+)
+
+const (
+	onFailureKeep   = "keep"
+	onFailureDelete = "delete"
+	onFailureRename = "rename"
+
+	// The command writes files into the directory given by executeOutputDirEnv instead of stdout,
+	// which is either stored as a single tar archive or file by file below the export path
+	outputDirModeTar   = "tar"
+	outputDirModeFiles = "files"
+
+	executeOutputDirEnv = "DUMPB_OUTPUT_DIR"
+	executeLogSuffix    = ".log"
+	executeFailedSuffix = ".failed"
 )
 
 var executeCmd = &cobra.Command{
@@ -30,6 +52,23 @@ var executeCmd = &cobra.Command{
 		if dashIndex == -1 {
 			return errors.New("invalid command, requires args after dash")
 		}
+		if onFailure == "" {
+			onFailure = onFailureRename
+		}
+		switch onFailure {
+		case onFailureKeep, onFailureDelete, onFailureRename:
+		default:
+			return fmt.Errorf("invalid on failure mode %q", onFailure)
+		}
+		switch outputDirMode {
+		case "", outputDirModeTar, outputDirModeFiles:
+		default:
+			return fmt.Errorf("invalid output dir mode %q", outputDirMode)
+		}
+		codec, err := executeCompression()
+		if err != nil {
+			return err
+		}
 
 		wrapper := exportWrapper(
 			"execute",
@@ -40,58 +79,272 @@ var executeCmd = &cobra.Command{
 					return "", errors.New("insufficient number of arguments")
 				}
 
-				exportPath := filepath.Join(storageBucketPath, getExportName(time.Now()))
-
-				writer, err := sw.NewWriter(ctx, exportPath)
-				if err != nil {
-					return "", fmt.Errorf("failed to initialize writer: %w", err)
-				}
-				defer writer.Close()
-
-				buf := bufio.NewWriter(writer)
-				defer func(buf *bufio.Writer) {
-					if err := buf.Flush(); err != nil {
-						l.With(slog.Any("error", err)).Error("Failed to flush buffered stream")
-					}
-				}(buf)
-
-				// Execute the command, skip first 2 arguments
-				cmd := exec.CommandContext(ctx, cmdArgs[0], cmdArgs[1:]...)
-				cmd.Stderr = log.Writer()
-
-				if outputGzip {
-					// GZIP Write Output
-					gzipWriter := gzip.NewWriter(buf)
-					defer func() {
-						if err := gzipWriter.Close(); err != nil {
-							l.With(slog.Any("error", err)).Error("Failed to close gzip writer")
-						}
-					}()
-					cmd.Stdout = gzipWriter // only write to bucket since dump will be in stdoud
-				} else {
-					cmd.Stdout = buf
+				exportPath := filepath.Join(storageBucketPath, getExportName(runStart, codec))
+				if outputDirMode != "" {
+					return exportPath, executeDirCommand(ctx, l, sw, exportPath, cmdArgs, codec)
 				}
-
-				return exportPath, cmd.Run()
+				return exportPath, executeCommand(ctx, l, sw, exportPath, cmdArgs, codec)
 			},
 		)
 		return wrapper(cmd, args)
 	},
 }
 
-func getExportName(ts time.Time) string {
-	exportName := fmt.Sprintf("%s/%s", backupName, ts.Format(export.TimestampFormat))
-	if outputExt != "" {
-		exportName += outputExt
+// executeCommand streams the stdout of the command into the export object and its stderr into
+// a companion log object; exit code and duration are added to the metadata of both objects
+func executeCommand(ctx context.Context, l *slog.Logger, sw storageWriter, exportPath string, cmdArgs []string, codec compression.Config) error {
+	start := time.Now()
+	writer, err := sw.NewWriter(ctx, exportPath, codec.WriterOptions()...)
+	if err != nil {
+		return fmt.Errorf("failed to initialize writer: %w", err)
+	}
+	logPath := exportPath + executeLogSuffix
+	logWriter, err := sw.NewWriter(ctx, logPath, storage.WithContentType("text/plain"))
+	if err != nil {
+		writer.Close()
+		return fmt.Errorf("failed to initialize log writer: %w", err)
+	}
+
+	buf := bufio.NewWriter(writer)
+	stdout, err := codec.NewWriter(buf) // only write to bucket since dump will be in stdout
+	if err != nil {
+		writer.Close()
+		logWriter.Close()
+		return err
+	}
+	exitCode, runErr := runCommand(ctx, cmdArgs, "", stdout, io.MultiWriter(log.Writer(), logWriter))
+	if err := stdout.Close(); err != nil && runErr == nil {
+		runErr = fmt.Errorf("failed to close compression writer: %w", err)
+	}
+	if err := buf.Flush(); err != nil && runErr == nil {
+		runErr = fmt.Errorf("failed to flush buffered stream: %w", err)
+	}
+	if err := writer.Close(); err != nil && runErr == nil {
+		runErr = fmt.Errorf("failed to store dump: %w", err)
+	}
+	if err := logWriter.Close(); err != nil {
+		l.With(slog.Any("error", err)).Error("Failed to store command log")
+	}
+
+	updateExecuteMetadata(ctx, l, sw, []string{exportPath, logPath}, exitCode, time.Since(start), runErr)
+	if runErr == nil {
+		return nil
+	}
+
+	// Make sure nobody restores a truncated dump
+	keep := []string{logPath}
+	switch onFailure {
+	case onFailureKeep:
+		keep = append(keep, exportPath)
+	case onFailureDelete:
+		err = sw.Delete(ctx, exportPath)
+	case onFailureRename:
+		err = sw.Rename(ctx, exportPath, exportPath+executeFailedSuffix)
+		keep = append(keep, exportPath+executeFailedSuffix)
+	}
+	if err != nil {
+		l.With(slog.Any("error", err)).Error("Failed to discard partial dump")
+	}
+	commitFailedOutput(ctx, l, sw, keep)
+	return fmt.Errorf("command failed with exit code %d: %w", exitCode, runErr)
+}
+
+// executeDirCommand runs the command with an empty output directory exposed via
+// executeOutputDirEnv and as working directory, and stores the directory afterwards; stdout and
+// stderr both go to the log object
+func executeDirCommand(ctx context.Context, l *slog.Logger, sw storageWriter, exportPath string, cmdArgs []string, codec compression.Config) error {
+	start := time.Now()
+	dir, err := os.MkdirTemp("", "dumpb-execute-")
+	if err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	logPath := exportPath + executeLogSuffix
+	logWriter, err := sw.NewWriter(ctx, logPath, storage.WithContentType("text/plain"))
+	if err != nil {
+		return fmt.Errorf("failed to initialize log writer: %w", err)
+	}
+	output := io.MultiWriter(log.Writer(), logWriter)
+	exitCode, runErr := runCommand(ctx, cmdArgs, dir, output, output)
+	if err := logWriter.Close(); err != nil {
+		l.With(slog.Any("error", err)).Error("Failed to store command log")
+	}
+
+	// Output of failed commands is not stored unless it is marked as failed or explicitly kept
+	targetPath := exportPath
+	if runErr != nil {
+		switch onFailure {
+		case onFailureDelete:
+			targetPath = ""
+		case onFailureRename:
+			targetPath += executeFailedSuffix
+		}
+	}
+	paths := []string{logPath}
+	if targetPath != "" {
+		stored, err := storeOutputDir(ctx, sw, dir, targetPath, codec)
+		if err != nil && runErr == nil {
+			runErr = err
+		}
+		paths = append(paths, stored...)
+	}
+
+	updateExecuteMetadata(ctx, l, sw, paths, exitCode, time.Since(start), runErr)
+	if runErr != nil {
+		commitFailedOutput(ctx, l, sw, paths)
+		return fmt.Errorf("command failed with exit code %d: %w", exitCode, runErr)
+	}
+	return nil
+}
+
+// commitFailedOutput keeps the log and the marked or kept output of a failed command, which
+// would otherwise be discarded with the failed export by atomic storages
+func commitFailedOutput(ctx context.Context, l *slog.Logger, sw storageWriter, paths []string) {
+	if err := storage.Commit(ctx, sw, paths...); err != nil {
+		l.With(slog.Any("error", err)).Error("Failed to keep output of the failed command")
 	}
+}
+
+// storeOutputDir writes the output directory as tar archive to the export path, or each file
+// below the export path, and returns the paths of the written objects
+func storeOutputDir(ctx context.Context, sw storageWriter, dir, exportPath string, codec compression.Config) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			files = append(files, file)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk output directory: %w", err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("command did not write any files to $%s", executeOutputDirEnv)
+	}
+
+	if outputDirMode == outputDirModeTar {
+		writer, err := sw.NewWriter(ctx, exportPath, codec.WriterOptions()...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize writer: %w", err)
+		}
+		if err := export.Tar(ctx, dir, codec, writer); err != nil {
+			writer.Close()
+			return nil, fmt.Errorf("failed to archive output directory: %w", err)
+		}
+		if err := writer.Close(); err != nil {
+			return nil, fmt.Errorf("failed to store archive: %w", err)
+		}
+		return []string{exportPath}, nil
+	}
+
+	paths := make([]string, 0, len(files))
+	for _, file := range files {
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return paths, err
+		}
+		target := path.Join(exportPath, filepath.ToSlash(rel)) + codec.Extension()
+		if err := storeOutputFile(ctx, sw, file, target, codec); err != nil {
+			return paths, fmt.Errorf("failed to store %s: %w", rel, err)
+		}
+		paths = append(paths, target)
+	}
+	return paths, nil
+}
+
+func storeOutputFile(ctx context.Context, sw storageWriter, file, target string, codec compression.Config) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	writer, err := sw.NewWriter(ctx, target, codec.WriterOptions()...)
+	if err != nil {
+		return fmt.Errorf("failed to initialize writer: %w", err)
+	}
+	dst, err := codec.NewWriter(writer)
+	if err != nil {
+		writer.Close()
+		return err
+	}
+	if _, err := io.Copy(dst, f); err != nil {
+		writer.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+// updateExecuteMetadata adds exit code, duration and status of the command to the stored objects
+func updateExecuteMetadata(ctx context.Context, l *slog.Logger, sw storageWriter, paths []string, exitCode int, duration time.Duration, runErr error) {
+	status := "succeeded"
+	if runErr != nil {
+		status = "failed"
+	}
+	metadata := map[string]string{
+		"ExitCode": strconv.Itoa(exitCode),
+		"Duration": duration.String(),
+		"Status":   status,
+	}
+	for _, p := range paths {
+		if err := sw.UpdateMetadata(ctx, p, metadata); err != nil {
+			l.With(slog.Any("error", err), slog.String("path", p)).Error("Failed to update metadata")
+		}
+	}
+}
+
+// runCommand runs the command, with outputDir as working directory and in the environment if set
+func runCommand(ctx context.Context, cmdArgs []string, outputDir string, stdout, stderr io.Writer) (exitCode int, err error) {
+	cmd := exec.CommandContext(ctx, cmdArgs[0], cmdArgs[1:]...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if outputDir != "" {
+		cmd.Dir = outputDir
+		cmd.Env = append(os.Environ(), executeOutputDirEnv+"="+outputDir)
+	}
+
+	err = cmd.Run()
+	exitCode = -1
+	if cmd.ProcessState != nil {
+		exitCode = cmd.ProcessState.ExitCode()
+	}
+	return exitCode, err
+}
+
+// executeCompression returns the selected compression, --output-gzip is kept as an alias
+// of --compression gzip
+func executeCompression() (compression.Config, error) {
+	defaultCodec := compression.None
 	if outputGzip {
-		exportName += ".gz"
+		defaultCodec = compression.Gzip
+	}
+	return configuredCompression(defaultCodec)
+}
+
+func getExportName(ts time.Time, codec compression.Config) string {
+	if outputDirMode == outputDirModeFiles {
+		// Files keep their own names below the export path
+		return exportName("execute", "", ts, "")
+	}
+	ext := outputExt
+	if ext == "" && outputDirMode == outputDirModeTar {
+		ext = ".tar"
 	}
-	return exportName
+	return exportName("execute", "", ts, ext+codec.Extension())
 }
 
 func init() {
 	rootCmd.AddCommand(executeCmd)
-	executeCmd.PersistentFlags().BoolVar(&outputGzip, "output-gzip", os.Getenv("OUTPUT_GZIP") == "true", "specifies that the output should use gzip compression")
+	executeCmd.PersistentFlags().BoolVar(&outputGzip, "output-gzip", os.Getenv("OUTPUT_GZIP") == "true", "specifies that the output should use gzip compression, alias of --compression gzip")
 	executeCmd.PersistentFlags().StringVar(&outputExt, "output-ext", os.Getenv("OUTPUT_EXT"), "specifies the extension of the dump")
+	executeCmd.PersistentFlags().StringVar(&outputDirMode, "output-dir-mode", os.Getenv("OUTPUT_DIR_MODE"), "stores the files the command writes to $"+executeOutputDirEnv+" instead of stdout (tar, files)")
+	executeCmd.PersistentFlags().StringVar(&onFailure, "on-failure", os.Getenv("ON_FAILURE"), "specifies what happens to the partial dump of a failed command (rename, delete, keep), defaults to rename")
 }
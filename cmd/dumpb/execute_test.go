@@ -1,12 +1,39 @@
 package dumpb
 
 import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/foomo/dump-buckets/pkg/compression"
+	"github.com/foomo/dump-buckets/pkg/storage"
 	"github.com/stretchr/testify/require"
 )
 
+func executeCodec(t *testing.T) compression.Config {
+	t.Helper()
+	codec, err := executeCompression()
+	require.NoError(t, err)
+	return codec
+}
+
+// runAtomic commits or aborts the objects written by run like exportWrapper
+func runAtomic(t *testing.T, backend storage.Backend, run func(sw storageWriter) error) error {
+	t.Helper()
+	ctx := context.Background()
+	atomic, err := storage.NewAtomic(backend)
+	require.NoError(t, err)
+	if err := run(atomic); err != nil {
+		require.NoError(t, atomic.Abort(ctx))
+		return err
+	}
+	require.NoError(t, atomic.Commit(ctx))
+	return nil
+}
+
 func Test_getExportName(t *testing.T) {
 	backupName = "backup"
 
@@ -14,21 +41,157 @@ func Test_getExportName(t *testing.T) {
 		outputGzip = false
 		outputExt = ""
 
-		exportName := getExportName(time.Time{})
+		exportName := getExportName(time.Time{}, executeCodec(t))
 		require.Equal(t, "backup/00010101T000000", exportName)
 	})
 	t.Run("ext", func(t *testing.T) {
 		outputGzip = false
 		outputExt = ".data"
 
-		exportName := getExportName(time.Time{})
+		exportName := getExportName(time.Time{}, executeCodec(t))
 		require.Equal(t, "backup/00010101T000000.data", exportName)
 	})
 	t.Run("gz", func(t *testing.T) {
 		outputGzip = true
 		outputExt = ""
 
-		exportName := getExportName(time.Time{})
+		exportName := getExportName(time.Time{}, executeCodec(t))
 		require.Equal(t, "backup/00010101T000000.gz", exportName)
 	})
 }
+
+func Test_executeCommand(t *testing.T) {
+	ctx := context.Background()
+	outputGzip = false
+
+	tests := []struct {
+		name      string
+		script    string
+		onFailure string
+		wantErr   bool
+		wantPaths []string
+		wantLog   string
+	}{
+		{
+			name:      "success",
+			script:    "echo dump; echo progress >&2",
+			onFailure: onFailureRename,
+			wantPaths: []string{"dump", "dump.log"},
+			wantLog:   "progress\n",
+		},
+		{
+			name:      "failure renamed",
+			script:    "echo partial; echo broken >&2; exit 3",
+			onFailure: onFailureRename,
+			wantErr:   true,
+			wantPaths: []string{"dump.failed", "dump.log"},
+			wantLog:   "broken\n",
+		},
+		{
+			name:      "failure deleted",
+			script:    "echo partial; exit 3",
+			onFailure: onFailureDelete,
+			wantErr:   true,
+			wantPaths: []string{"dump.log"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			fs, err := storage.NewFSStorage(ctx, root)
+			require.NoError(t, err)
+			onFailure = tt.onFailure
+
+			err = runAtomic(t, fs, func(sw storageWriter) error {
+				return executeCommand(ctx, slog.Default(), sw, "dump", []string{"sh", "-c", tt.script}, compression.Config{Codec: compression.None})
+			})
+			if tt.wantErr {
+				require.ErrorContains(t, err, "exit code 3")
+			} else {
+				require.NoError(t, err)
+			}
+
+			entries, err := os.ReadDir(root)
+			require.NoError(t, err)
+			var paths []string
+			for _, entry := range entries {
+				paths = append(paths, entry.Name())
+			}
+			require.Equal(t, tt.wantPaths, paths)
+
+			logData, err := os.ReadFile(filepath.Join(root, "dump.log"))
+			require.NoError(t, err)
+			require.Equal(t, tt.wantLog, string(logData))
+		})
+	}
+}
+
+func Test_executeDirCommand(t *testing.T) {
+	ctx := context.Background()
+	outputGzip = false
+	onFailure = onFailureRename
+
+	tests := []struct {
+		name      string
+		mode      string
+		script    string
+		wantErr   string
+		wantPaths []string
+	}{
+		{
+			name:      "files",
+			mode:      outputDirModeFiles,
+			script:    "mkdir -p $DUMPB_OUTPUT_DIR/db && echo a > $DUMPB_OUTPUT_DIR/db/a && echo b > b",
+			wantPaths: []string{"dump.log", "dump/b", "dump/db/a"},
+		},
+		{
+			name:      "tar",
+			mode:      outputDirModeTar,
+			script:    "echo a > $DUMPB_OUTPUT_DIR/a",
+			wantPaths: []string{"dump", "dump.log"},
+		},
+		{
+			name:      "failure renamed",
+			mode:      outputDirModeFiles,
+			script:    "echo a > a; exit 3",
+			wantErr:   "exit code 3",
+			wantPaths: []string{"dump.failed/a", "dump.log"},
+		},
+		{
+			name:      "no files",
+			mode:      outputDirModeTar,
+			script:    "echo nothing",
+			wantErr:   "did not write any files",
+			wantPaths: []string{"dump.log"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			fs, err := storage.NewFSStorage(ctx, root)
+			require.NoError(t, err)
+			outputDirMode = tt.mode
+			t.Cleanup(func() { outputDirMode = "" })
+
+			err = runAtomic(t, fs, func(sw storageWriter) error {
+				return executeDirCommand(ctx, slog.Default(), sw, "dump", []string{"sh", "-c", tt.script}, compression.Config{Codec: compression.None})
+			})
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+
+			var paths []string
+			require.NoError(t, filepath.WalkDir(root, func(file string, d os.DirEntry, err error) error {
+				if err != nil || d.IsDir() {
+					return err
+				}
+				rel, err := filepath.Rel(root, file)
+				paths = append(paths, filepath.ToSlash(rel))
+				return err
+			}))
+			require.ElementsMatch(t, tt.wantPaths, paths)
+		})
+	}
+}
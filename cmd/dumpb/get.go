@@ -0,0 +1,77 @@
+package dumpb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/foomo/dump-buckets/pkg/compression"
+	"github.com/foomo/dump-buckets/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+var getDecompress bool
+
+var getCmd = &cobra.Command{
+	Use:   "get <path> [destination]",
+	Short: "Downloads an export to a file or stdout",
+	Args:  cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		sw, err := configuredStorage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed in configuring storage: %w", err)
+		}
+		reader, err := sw.NewReader(ctx, args[0])
+		if errors.Is(err, storage.ErrNotExist) {
+			// chunked uploads which have not been composed are reassembled from their parts
+			if parts, partsErr := storage.ReadParts(ctx, sw, args[0]); partsErr == nil {
+				reader, err = parts, nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+
+		var src io.Reader = reader
+		if getDecompress {
+			decompressed, err := compression.NewReader(reader, compression.FromPath(args[0]))
+			if err != nil {
+				return fmt.Errorf("failed to decompress %q: %w", args[0], err)
+			}
+			defer decompressed.Close()
+			src = decompressed
+		}
+
+		if len(args) < 2 || args[1] == "-" {
+			_, err = io.Copy(cmd.OutOrStdout(), src)
+			return err
+		}
+		return writeFile(args[1], src)
+	},
+}
+
+// writeFile writes the file only if the reader is consumed completely
+func writeFile(name string, src io.Reader) error {
+	f, err := os.CreateTemp(filepath.Dir(name), ".dumpb-get-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, src); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+func init() {
+	rootCmd.AddCommand(getCmd)
+	getCmd.Flags().BoolVar(&getDecompress, "decompress", os.Getenv("GET_DECOMPRESS") == "true", "specifies that the export is decompressed by the codec of its extension")
+}
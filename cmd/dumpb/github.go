@@ -6,7 +6,6 @@ import (
 	"log/slog"
 	"os"
 	"path/filepath"
-	"time"
 
 	"github.com/foomo/dump-buckets/pkg/export"
 	"github.com/spf13/cobra"
@@ -33,11 +32,8 @@ var githubCmd = &cobra.Command{
 		if err != nil {
 			return "", err
 		}
-		exportName := fmt.Sprintf("%s.%s.%s.tar.gz", githubOrganization, githubRepository, time.Now().Format(export.TimestampFormat))
-		if backupName != "" {
-			exportName += fmt.Sprintf("%s/%s", backupName, exportName)
-		}
-		exportPath := filepath.Join(storageBucketPath, exportName)
+		// the tarball is gzipped by github
+		exportPath := filepath.Join(storageBucketPath, exportName("github", githubOrganization+"/"+githubRepository, runStart, ".tar.gz"))
 
 		writer, err := sw.NewWriter(ctx, exportPath)
 		if err != nil {
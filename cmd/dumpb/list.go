@@ -0,0 +1,190 @@
+package dumpb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/foomo/dump-buckets/pkg/export"
+	"github.com/foomo/dump-buckets/pkg/naming"
+	"github.com/foomo/dump-buckets/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+var (
+	listExporter string
+	listSource   string
+	listAfter    string
+	listBefore   string
+	listJSON     bool
+)
+
+// exportEntry is a stored export with the values parsed from its name
+type exportEntry struct {
+	storage.ObjectInfo
+	Backup    string    `json:"backup,omitempty"`
+	Exporter  string    `json:"exporter,omitempty"`
+	Source    string    `json:"source,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	Ext       string    `json:"ext,omitempty"`
+}
+
+// exportFilter selects exports by the values of their names
+type exportFilter struct {
+	Exporter string
+	Source   string // glob pattern
+	After    time.Time
+	Before   time.Time
+}
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists the exports in the storage path",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		sw, err := configuredStorage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed in configuring storage: %w", err)
+		}
+		filter, err := configuredExportFilter()
+		if err != nil {
+			return err
+		}
+		objects, err := sw.List(ctx, storagePrefix())
+		if err != nil {
+			return err
+		}
+		entries, err := listExports(objects, filter)
+		if err != nil {
+			return err
+		}
+		if listJSON {
+			encoder := json.NewEncoder(cmd.OutOrStdout())
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(entries)
+		}
+		return printExports(cmd.OutOrStdout(), entries)
+	},
+}
+
+func configuredExportFilter() (exportFilter, error) {
+	filter := exportFilter{Exporter: listExporter, Source: listSource}
+	var err error
+	if filter.After, err = parseTimeFilter(listAfter); err != nil {
+		return filter, err
+	}
+	if filter.Before, err = parseTimeFilter(listBefore); err != nil {
+		return filter, err
+	}
+	return filter, nil
+}
+
+// storagePrefix is the prefix of all objects below the storage path
+func storagePrefix() string {
+	if storageBucketPath == "" {
+		return ""
+	}
+	return strings.TrimSuffix(storageBucketPath, "/") + "/"
+}
+
+// listExports returns the objects named by the name template which match the filter, sorted by
+// timestamp; other objects like state files, pending objects, parts and markers are skipped
+func listExports(objects []storage.ObjectInfo, filter exportFilter) ([]exportEntry, error) {
+	template := configuredNameTemplate()
+	known := naming.Values{Backup: backupName, Exporter: filter.Exporter}
+
+	var entries []exportEntry
+	for _, object := range objects {
+		if strings.HasSuffix(object.Path, storage.PendingSuffix) || strings.HasSuffix(object.Path, storage.SuccessMarkerSuffix) ||
+			strings.Contains(object.Path, storage.PartsSuffix+"/") {
+			continue
+		}
+		values, err := template.Parse(strings.TrimPrefix(object.Path, storagePrefix()), known)
+		if err != nil {
+			continue
+		}
+		if filter.Source != "" {
+			matched, err := path.Match(filter.Source, values.Source)
+			if err != nil {
+				return nil, fmt.Errorf("source pattern %s is malformed: %w", filter.Source, err)
+			}
+			if !matched {
+				continue
+			}
+		}
+		if (!filter.After.IsZero() && values.Timestamp.Before(filter.After)) ||
+			(!filter.Before.IsZero() && !values.Timestamp.Before(filter.Before)) {
+			continue
+		}
+		entries = append(entries, exportEntry{
+			ObjectInfo: object,
+			Backup:     values.Backup,
+			Exporter:   values.Exporter,
+			Source:     values.Source,
+			Timestamp:  values.Timestamp,
+			Ext:        values.Ext,
+		})
+	}
+	slices.SortStableFunc(entries, func(a, b exportEntry) int {
+		if c := a.Timestamp.Compare(b.Timestamp); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Path, b.Path)
+	})
+	return entries, nil
+}
+
+func printExports(w io.Writer, entries []exportEntry) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIMESTAMP\tBACKUP\tEXPORTER\tSOURCE\tSIZE\tPATH\tMETADATA")
+	for _, entry := range entries {
+		var metadata []string
+		for key, value := range entry.Metadata {
+			metadata = append(metadata, key+"="+value)
+		}
+		slices.Sort(metadata)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			entry.Timestamp.Format(export.TimestampFormat),
+			entry.Backup,
+			entry.Exporter,
+			entry.Source,
+			entry.Size,
+			entry.Path,
+			strings.Join(metadata, ","),
+		)
+	}
+	return tw.Flush()
+}
+
+// parseTimeFilter parses a timestamp, or a duration relative to now, e.g. 72h
+func parseTimeFilter(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if ts, err := time.ParseInLocation(export.TimestampFormat, value, time.Local); err == nil {
+		return ts, nil
+	}
+	ts, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("time filter %q must be a duration, %s or RFC 3339 timestamp", value, export.TimestampFormat)
+	}
+	return ts, nil
+}
+
+func init() {
+	rootCmd.AddCommand(listCmd)
+	listCmd.Flags().StringVar(&listExporter, "exporter", os.Getenv("LIST_EXPORTER"), "specifies the exporter of the listed exports, if the name template contains {exporter}")
+	listCmd.Flags().StringVar(&listSource, "source", os.Getenv("LIST_SOURCE"), "specifies a glob pattern on the source of the listed exports")
+	listCmd.Flags().StringVar(&listAfter, "after", os.Getenv("LIST_AFTER"), "specifies that only exports since the timestamp or duration ago are listed")
+	listCmd.Flags().StringVar(&listBefore, "before", os.Getenv("LIST_BEFORE"), "specifies that only exports before the timestamp or duration ago are listed")
+	listCmd.Flags().BoolVar(&listJSON, "json", os.Getenv("LIST_JSON") == "true", "specifies that the exports are written as JSON")
+}
@@ -0,0 +1,98 @@
+package dumpb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/foomo/dump-buckets/pkg/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_listExports(t *testing.T) {
+	backupName = "backup"
+	storageBucketPath = "dumps"
+	nameTemplate = ""
+	t.Cleanup(func() { storageBucketPath = "" })
+
+	objects := []storage.ObjectInfo{
+		{Path: "dumps/backup/20240102T000000.archive.gz"},
+		{Path: "dumps/backup/20240101T000000.archive.gz"},
+		{Path: "dumps/backup/20240101T000000.archive.gz.SUCCESS"},
+		{Path: "dumps/backup/20240103T000000.archive.gz.0123456789abcdef.pending"},
+		{Path: "dumps/backup/space/master/20240101T000000.json.gz"},
+		{Path: "dumps/backup/space/master/contentful-sync.state.json"},
+		{Path: "dumps/other/20240101T000000.archive.gz"},
+	}
+
+	tests := []struct {
+		name   string
+		filter exportFilter
+		want   []string
+	}{
+		{
+			name: "all",
+			want: []string{
+				"dumps/backup/20240101T000000.archive.gz",
+				"dumps/backup/space/master/20240101T000000.json.gz",
+				"dumps/backup/20240102T000000.archive.gz",
+			},
+		},
+		{
+			name:   "source",
+			filter: exportFilter{Source: "space/*"},
+			want:   []string{"dumps/backup/space/master/20240101T000000.json.gz"},
+		},
+		{
+			name:   "time range",
+			filter: exportFilter{After: time.Date(2024, 1, 2, 0, 0, 0, 0, time.Local), Before: time.Date(2024, 1, 3, 0, 0, 0, 0, time.Local)},
+			want:   []string{"dumps/backup/20240102T000000.archive.gz"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := listExports(objects, tt.filter)
+			require.NoError(t, err)
+			var paths []string
+			for _, entry := range entries {
+				paths = append(paths, entry.Path)
+			}
+			require.Equal(t, tt.want, paths)
+		})
+	}
+
+	entries, err := listExports(objects, exportFilter{Source: "space/*"})
+	require.NoError(t, err)
+	require.Equal(t, "backup", entries[0].Backup)
+	require.Equal(t, "space/master", entries[0].Source)
+	require.Equal(t, ".json.gz", entries[0].Ext)
+}
+
+func Test_listExports_bigquery(t *testing.T) {
+	backupName = "backup"
+	storageBucketPath = "dumps"
+	nameTemplate = "{backup}/{exporter}/{yyyy}/{ts}{ext}"
+	t.Cleanup(func() { storageBucketPath, nameTemplate = "", "" })
+
+	ts := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+	prefix := bigqueryExportPrefix(ts)
+	require.Equal(t, "dumps/backup/bigquery/2024/20240101T000000", prefix)
+
+	entries, err := listExports([]storage.ObjectInfo{{Path: prefix + "/sales/MANIFEST.json"}}, exportFilter{Exporter: "bigquery"})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "bigquery", entries[0].Exporter)
+	require.True(t, ts.Equal(entries[0].Timestamp))
+}
+
+func Test_parseTimeFilter(t *testing.T) {
+	ts, err := parseTimeFilter("20240101T120000")
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local), ts)
+
+	ts, err = parseTimeFilter("24h")
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now().Add(-24*time.Hour), ts, time.Minute)
+
+	_, err = parseTimeFilter("yesterday")
+	require.Error(t, err)
+}
@@ -1,14 +1,13 @@
 package dumpb
 
 import (
-	"compress/gzip"
 	"context"
 	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
-	"time"
 
+	"github.com/foomo/dump-buckets/pkg/compression"
 	"github.com/foomo/dump-buckets/pkg/export"
 	"github.com/spf13/cobra"
 )
@@ -34,27 +33,31 @@ var mongoCmd = &cobra.Command{
 		if err != nil {
 			return "", fmt.Errorf("failed in initializing mongo exporter: %w", err)
 		}
-
-		exportName := fmt.Sprintf("%s.%s.archive.gz", backupName, time.Now().Format(export.TimestampFormat))
-		if backupName != "" {
-			exportName += fmt.Sprintf("%s.%s", backupName, exportName)
+		codec, err := configuredCompression(compression.Gzip)
+		if err != nil {
+			return "", err
 		}
-		exportPath := filepath.Join(storageBucketPath, exportName)
+
+		exportPath := filepath.Join(storageBucketPath, exportName("mongo", "", runStart, ".archive"+codec.Extension()))
 		l = l.With(slog.String("path", exportPath))
 
-		writer, err := sw.NewWriter(ctx, exportPath)
+		writer, err := sw.NewWriter(ctx, exportPath, codec.WriterOptions()...)
 		if err != nil {
 			return "", fmt.Errorf("failed to initialize writer: %w", err)
 		}
 		defer writer.Close()
 
-		gzipWriter := gzip.NewWriter(writer)
-		defer gzipWriter.Close()
-
-		err = exporter.Export(ctx, gzipWriter)
+		compressedWriter, err := codec.NewWriter(writer)
+		if err != nil {
+			return "", err
+		}
+		err = exporter.Export(ctx, compressedWriter)
 		if err != nil {
 			return "", fmt.Errorf("failed to export mongo data: %w", err)
 		}
+		if err := compressedWriter.Close(); err != nil {
+			return "", fmt.Errorf("failed to compress mongo data: %w", err)
+		}
 		return exportPath, nil
 	}),
 }
@@ -0,0 +1,54 @@
+package dumpb
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/foomo/dump-buckets/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+const pruneDefaultOlderThan = 7 * 24 * time.Hour
+
+var (
+	prunePrefix    string
+	pruneOlderThan time.Duration
+)
+
+var prunePartsCmd = &cobra.Command{
+	Use:   "prune-parts",
+	Short: "Deletes the parts of chunked uploads which were not completed",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		sw, err := configuredStorage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed in configuring storage: %w", err)
+		}
+		prefix := prunePrefix
+		if prefix == "" {
+			prefix = storagePrefix()
+		}
+		olderThan := pruneOlderThan
+		if olderThan <= 0 {
+			olderThan = pruneDefaultOlderThan
+		}
+
+		pruned, err := storage.PruneParts(ctx, sw, prefix, time.Now().Add(-olderThan))
+		for _, path := range pruned {
+			slog.Info("Pruned parts of incomplete upload", slog.String("path", path))
+		}
+		if err != nil {
+			return err
+		}
+		slog.Info("Prune complete", slog.String("prefix", prefix), slog.Int("uploads", len(pruned)))
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(prunePartsCmd)
+	prunePartsCmd.Flags().StringVar(&prunePrefix, "prefix", os.Getenv("PRUNE_PREFIX"), "specifies the prefix of the pruned uploads, defaults to the storage path")
+	prunePartsCmd.Flags().DurationVar(&pruneOlderThan, "older-than", mustParseDuration(os.Getenv("PRUNE_OLDER_THAN")), "specifies how long parts are kept to resume uploads, defaults to 168h")
+}
@@ -0,0 +1,54 @@
+package dumpb
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/foomo/dump-buckets/pkg/storage"
+	"github.com/spf13/cobra"
+)
+
+var replicatePrefix string
+
+var replicateCmd = &cobra.Command{
+	Use:   "replicate",
+	Short: "Copies the exports missing on the replicas from the storage",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		sw, err := configuredStorage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed in configuring storage: %w", err)
+		}
+		targets, err := configuredReplicas(ctx)
+		if err != nil {
+			return err
+		}
+		if len(targets) == 0 {
+			return errors.New("no replica configured")
+		}
+		prefix := replicatePrefix
+		if prefix == "" {
+			prefix = storagePrefix()
+		}
+
+		l := slog.With(slog.String("prefix", prefix))
+		var statuses []storage.TargetStatus
+		for _, target := range targets {
+			l.Info("Replicating...", slog.String("replica", target.Name))
+			status, err := storage.Backfill(ctx, sw, target, prefix)
+			if err != nil {
+				return err
+			}
+			l.Info("Skipped objects present on the replica", slog.String("replica", target.Name), slog.Int("skipped", status.Skipped))
+			statuses = append(statuses, status)
+		}
+		return replicationResult(l, statuses)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(replicateCmd)
+	replicateCmd.Flags().StringVar(&replicatePrefix, "prefix", os.Getenv("REPLICATE_PREFIX"), "specifies the prefix of the replicated objects, defaults to the storage path")
+}
@@ -3,10 +3,15 @@ package dumpb
 import (
 	"context"
 	"fmt"
-	"io"
 	"log/slog"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/foomo/dump-buckets/pkg/compression"
+	"github.com/foomo/dump-buckets/pkg/export"
+	"github.com/foomo/dump-buckets/pkg/naming"
 	"github.com/foomo/dump-buckets/pkg/storage"
 	"github.com/spf13/cobra"
 )
@@ -16,6 +21,26 @@ var (
 	storageBucketName   string
 	storageBucketPath   string
 	backupName          string
+	nameTemplate        string
+
+	compressionCodec   string
+	compressionLevel   int
+	compressionThreads int
+
+	replicas        []string
+	replicationMode string
+
+	chunkSizeMB       int
+	chunkMaxRetries   int
+	chunkRetryBackoff time.Duration
+
+	runTimestamp string
+	runStart     time.Time
+)
+
+const (
+	replicationModeTee  = "tee"
+	replicationModeCopy = "copy"
 )
 
 var rootCmd = &cobra.Command{
@@ -23,7 +48,22 @@ var rootCmd = &cobra.Command{
 	Short: "dumpb - a simple databse dump tool",
 	// Validate Parameters
 	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
-		return nil
+		switch replicationMode {
+		case "":
+			replicationMode = replicationModeTee
+		case replicationModeTee, replicationModeCopy:
+		default:
+			return fmt.Errorf("replication mode %q not supported", replicationMode)
+		}
+		runStart = time.Now()
+		if runTimestamp != "" {
+			ts, err := time.ParseInLocation(export.TimestampFormat, runTimestamp, time.Local)
+			if err != nil {
+				return fmt.Errorf("run timestamp %q must be given as %s", runTimestamp, export.TimestampFormat)
+			}
+			runStart = ts
+		}
+		return configuredNameTemplate().Validate()
 	},
 	Run: func(cmd *cobra.Command, args []string) {
 
@@ -32,9 +72,19 @@ var rootCmd = &cobra.Command{
 
 func init() {
 	rootCmd.PersistentFlags().StringVar(&backupName, "backup-name", os.Getenv("BACKUP_NAME"), "specifies the name of the backup")
-	rootCmd.PersistentFlags().StringVar(&storageBucketVendor, "storage-vendor", os.Getenv("STORAGE_VENDOR"), "specifies the vendor for the buckets")
-	rootCmd.PersistentFlags().StringVar(&storageBucketName, "storage-bucket-name", os.Getenv("STORAGE_BUCKET_NAME"), "specifies the bucket name where to dump to")
+	rootCmd.PersistentFlags().StringVar(&nameTemplate, "name-template", os.Getenv("NAME_TEMPLATE"), "specifies the object names of the exports, defaults to "+string(naming.DefaultTemplate))
+	rootCmd.PersistentFlags().StringVar(&storageBucketVendor, "storage-vendor", os.Getenv("STORAGE_VENDOR"), "specifies the vendor for the buckets (gcs, fs)")
+	rootCmd.PersistentFlags().StringVar(&storageBucketName, "storage-bucket-name", os.Getenv("STORAGE_BUCKET_NAME"), "specifies the bucket name where to dump to, the root directory for fs")
 	rootCmd.PersistentFlags().StringVar(&storageBucketPath, "storage-path", os.Getenv("STORAGE_PATH"), "specifies the path where to store the backups")
+	rootCmd.PersistentFlags().StringVar(&compressionCodec, "compression", os.Getenv("COMPRESSION"), "specifies the compression of the exports (gzip, zstd, xz, none), defaults to the exporter default")
+	rootCmd.PersistentFlags().IntVar(&compressionLevel, "compression-level", mustParseInt(os.Getenv("COMPRESSION_LEVEL")), "specifies the compression level, the codec default if zero")
+	rootCmd.PersistentFlags().StringVar(&runTimestamp, "run-timestamp", os.Getenv("RUN_TIMESTAMP"), "specifies the timestamp the exports are named by, e.g. of an interrupted run to resume its chunked uploads, defaults to now")
+	rootCmd.PersistentFlags().IntVar(&chunkSizeMB, "chunk-size-mb", mustParseInt(os.Getenv("CHUNK_SIZE_MB")), "specifies that exports are uploaded in resumable parts of this size in MiB, disabled if zero")
+	rootCmd.PersistentFlags().IntVar(&chunkMaxRetries, "chunk-max-retries", mustParseInt(os.Getenv("CHUNK_MAX_RETRIES")), "specifies how often failed part uploads are retried, defaults to 3, negative to disable")
+	rootCmd.PersistentFlags().DurationVar(&chunkRetryBackoff, "chunk-retry-backoff", mustParseDuration(os.Getenv("CHUNK_RETRY_BACKOFF")), "specifies the initial backoff between part upload retries, doubled on each retry, defaults to 1s")
+	rootCmd.PersistentFlags().StringSliceVar(&replicas, "replica", splitNonEmpty(os.Getenv("REPLICAS")), "specifies storages as vendor:bucket which every export is replicated to")
+	rootCmd.PersistentFlags().StringVar(&replicationMode, "replication-mode", os.Getenv("REPLICATION_MODE"), "specifies whether exports are written to the replicas simultaneously (tee) or copied after completion (copy), defaults to tee")
+	rootCmd.PersistentFlags().IntVar(&compressionThreads, "compression-threads", mustParseInt(os.Getenv("COMPRESSION_THREADS")), "specifies the number of zstd compression threads, all cpus if zero")
 }
 
 func Execute() {
@@ -45,18 +95,117 @@ func Execute() {
 }
 
 type storageWriter interface {
-	NewWriter(ctx context.Context, path string, opts ...storage.WriterOption) (writer io.WriteCloser, err error)
+	storage.Backend
 }
 
 func configuredStorage(ctx context.Context) (storageWriter, error) {
-	switch storageBucketVendor {
+	backend, err := newStorage(ctx, storageBucketVendor, storageBucketName)
+	if err != nil || chunkSizeMB <= 0 {
+		return backend, err
+	}
+	return storage.NewChunked(backend, storage.ChunkedConfig{
+		PartSize:     int64(chunkSizeMB) << 20,
+		MaxRetries:   chunkMaxRetries,
+		RetryBackoff: chunkRetryBackoff,
+	})
+}
+
+func newStorage(ctx context.Context, vendor, bucketName string) (storageWriter, error) {
+	switch vendor {
 	case "gcs":
-		gcs, err := storage.NewGCSStorage(ctx, storageBucketName)
+		gcs, err := storage.NewGCSStorage(ctx, bucketName)
 		if err != nil {
 			return nil, err
 		}
 		return gcs, nil
+	case "fs":
+		fs, err := storage.NewFSStorage(ctx, bucketName)
+		if err != nil {
+			return nil, err
+		}
+		return fs, nil
 	default:
-		return nil, fmt.Errorf("vendor %q not supported", storageBucketVendor)
+		return nil, fmt.Errorf("vendor %q not supported", vendor)
+	}
+}
+
+// configuredReplicas returns the replica targets given as vendor:bucket, e.g. gcs:backups-dr
+func configuredReplicas(ctx context.Context) ([]storage.Target, error) {
+	var targets []storage.Target
+	for _, replica := range replicas {
+		vendor, bucketName, ok := strings.Cut(replica, ":")
+		if !ok || bucketName == "" {
+			return nil, fmt.Errorf("replica %q must be given as vendor:bucket", replica)
+		}
+		backend, err := newStorage(ctx, vendor, bucketName)
+		if err != nil {
+			return nil, fmt.Errorf("failed in configuring replica %s: %w", replica, err)
+		}
+		targets = append(targets, storage.Target{Name: replica, Backend: backend})
+	}
+	return targets, nil
+}
+
+// configuredCompression returns the compression selected by the flags, defaultCodec is used if
+// no codec is given
+func configuredCompression(defaultCodec compression.Codec) (compression.Config, error) {
+	codec := defaultCodec
+	if compressionCodec != "" {
+		var err error
+		if codec, err = compression.ParseCodec(compressionCodec); err != nil {
+			return compression.Config{}, err
+		}
+	}
+	return compression.Config{Codec: codec, Level: compressionLevel, Threads: compressionThreads}, nil
+}
+
+func configuredNameTemplate() naming.Template {
+	if nameTemplate == "" {
+		return naming.DefaultTemplate
+	}
+	return naming.Template(nameTemplate)
+}
+
+// exportName names an export of the exporter with the configured name template, the storage
+// path is not included
+func exportName(exporter, source string, ts time.Time, ext string) string {
+	return configuredNameTemplate().Format(naming.Values{
+		Backup:    backupName,
+		Exporter:  exporter,
+		Source:    source,
+		Timestamp: ts,
+		Ext:       ext,
+	})
+}
+
+func mustParseDuration(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		panic(fmt.Errorf("failed to parse duration: %w", err))
+	}
+	return duration
+}
+
+func mustParseInt(value string) int {
+	if value == "" {
+		return 0
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		panic(fmt.Errorf("failed to parse int: %w", err))
+	}
+	return i
+}
+
+func splitNonEmpty(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
 	}
+	return values
 }
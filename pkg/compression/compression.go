@@ -0,0 +1,152 @@
+package compression
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/foomo/dump-buckets/pkg/storage"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Codec is the compression applied to exports
+type Codec string
+
+const (
+	None Codec = "none"
+	Gzip Codec = "gzip"
+	Zstd Codec = "zstd"
+	XZ   Codec = "xz"
+)
+
+var extensions = map[Codec]string{
+	Gzip: ".gz",
+	Zstd: ".zst",
+	XZ:   ".xz",
+}
+
+// xzDictCaps are the dictionary sizes of the xz presets 0-9
+var xzDictCaps = []int{256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20, 8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+
+// Config selects the codec of a job, Level and Threads are optional and only applied by codecs
+// supporting them
+type Config struct {
+	Codec   Codec
+	Level   int // gzip 1-9, zstd 1-22, xz 0-9; 0 uses the codec default
+	Threads int // zstd encoder concurrency; 0 uses GOMAXPROCS
+}
+
+// ParseCodec parses a codec name, an empty name is None
+func ParseCodec(value string) (Codec, error) {
+	switch codec := Codec(strings.ToLower(value)); codec {
+	case "":
+		return None, nil
+	case None, Gzip, Zstd, XZ:
+		return codec, nil
+	default:
+		return "", fmt.Errorf("unknown compression codec %q", value)
+	}
+}
+
+// Extension returns the file extension of the codec, e.g. `.gz`
+func (c Config) Extension() string {
+	return extensions[c.Codec]
+}
+
+// ContentEncoding returns the content encoding objects are stored with, GCS only transcodes gzip
+func (c Config) ContentEncoding() string {
+	if c.Codec == None {
+		return ""
+	}
+	return string(c.Codec)
+}
+
+// WriterOptions returns the storage options marking objects as compressed with the codec
+func (c Config) WriterOptions() []storage.WriterOption {
+	if encoding := c.ContentEncoding(); encoding != "" {
+		return []storage.WriterOption{storage.WithContentEncoding(encoding)}
+	}
+	return nil
+}
+
+// NewWriter compresses everything written into w, the returned writer must be closed to flush
+// the compressed stream but does not close w
+func (c Config) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	switch c.Codec {
+	case "", None:
+		return nopCloser{w}, nil
+	case Gzip:
+		level := c.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case Zstd:
+		opts := []zstd.EOption{}
+		if c.Level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(c.Level)))
+		}
+		if c.Threads > 0 {
+			opts = append(opts, zstd.WithEncoderConcurrency(c.Threads))
+		}
+		return zstd.NewWriter(w, opts...)
+	case XZ:
+		config := xz.WriterConfig{}
+		if c.Level != 0 {
+			if c.Level < 0 || c.Level >= len(xzDictCaps) {
+				return nil, fmt.Errorf("xz level %d out of range", c.Level)
+			}
+			config.DictCap = xzDictCaps[c.Level]
+		}
+		return config.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("unknown compression codec %q", c.Codec)
+	}
+}
+
+// NewReader decompresses r with the codec
+func NewReader(r io.Reader, codec Codec) (io.ReadCloser, error) {
+	switch codec {
+	case "", None:
+		return io.NopCloser(r), nil
+	case Gzip:
+		return gzip.NewReader(r)
+	case Zstd:
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case XZ:
+		reader, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(reader), nil
+	default:
+		return nil, fmt.Errorf("unknown compression codec %q", codec)
+	}
+}
+
+// FromPath returns the codec matching the extension of the path, None if there is no match
+func FromPath(path string) Codec {
+	for codec, ext := range extensions {
+		if strings.HasSuffix(path, ext) {
+			return codec
+		}
+	}
+	return None
+}
+
+// TrimExtension removes the codec extension from the path
+func TrimExtension(path string) string {
+	return strings.TrimSuffix(path, extensions[FromPath(path)])
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
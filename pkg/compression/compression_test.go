@@ -0,0 +1,58 @@
+package compression
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoundTrip(t *testing.T) {
+	data := strings.Repeat("dump-buckets ", 1000)
+
+	tests := []Config{
+		{Codec: None},
+		{Codec: Gzip},
+		{Codec: Gzip, Level: 9},
+		{Codec: Zstd},
+		{Codec: Zstd, Level: 19, Threads: 2},
+		{Codec: XZ},
+		{Codec: XZ, Level: 1},
+	}
+	for _, config := range tests {
+		t.Run(string(config.Codec), func(t *testing.T) {
+			var buf bytes.Buffer
+			writer, err := config.NewWriter(&buf)
+			require.NoError(t, err)
+			_, err = io.WriteString(writer, data)
+			require.NoError(t, err)
+			require.NoError(t, writer.Close())
+
+			name := "dump.tar" + config.Extension()
+			require.Equal(t, config.Codec, FromPath(name))
+			require.Equal(t, "dump.tar", TrimExtension(name))
+
+			reader, err := NewReader(&buf, FromPath(name))
+			require.NoError(t, err)
+			decompressed, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			require.NoError(t, reader.Close())
+			require.Equal(t, data, string(decompressed))
+		})
+	}
+}
+
+func TestParseCodec(t *testing.T) {
+	codec, err := ParseCodec("ZSTD")
+	require.NoError(t, err)
+	require.Equal(t, Zstd, codec)
+
+	codec, err = ParseCodec("")
+	require.NoError(t, err)
+	require.Equal(t, None, codec)
+
+	_, err = ParseCodec("brotli")
+	require.Error(t, err)
+}
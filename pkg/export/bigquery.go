@@ -8,14 +8,19 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"net/http"
 	"path"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
 	"time"
 
 	"cloud.google.com/go/bigquery"
+	gcs "cloud.google.com/go/storage"
+	"github.com/foomo/dump-buckets/pkg/storage"
 	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 )
 
@@ -25,6 +30,16 @@ const (
 	bigqueryGCSURIPrefix       = "gs://%s/%s"
 	bigqueryQueryDataSetSchema = "SELECT * FROM region-%s.INFORMATION_SCHEMA.SCHEMATA"
 	bigqueryQueryTableSchema   = "SELECT * FROM %s.%s.INFORMATION_SCHEMA.TABLES"
+	bigqueryQueryViewSchema    = "SELECT * FROM %s.%s.INFORMATION_SCHEMA.VIEWS"
+	bigqueryQueryRoutineSchema = "SELECT * FROM %s.%s.INFORMATION_SCHEMA.ROUTINES"
+	// bigqueryQueryDefinitions lists the DDL of everything but regular tables in creation order, so
+	// it can be replayed after the tables have been restored
+	bigqueryQueryDefinitions = `SELECT object_name, object_type, ddl FROM (
+  SELECT table_name AS object_name, table_type AS object_type, ddl, creation_time FROM %[1]s.%[2]s.INFORMATION_SCHEMA.TABLES WHERE table_type IN ('VIEW', 'MATERIALIZED VIEW', 'EXTERNAL')
+  UNION ALL
+  SELECT routine_name, routine_type, ddl, created FROM %[1]s.%[2]s.INFORMATION_SCHEMA.ROUTINES
+) ORDER BY creation_time`
+	bigqueryDefinitionsName = "DEFINITIONS.json.gz"
 )
 
 var (
@@ -32,6 +47,12 @@ var (
 	bigqueryTableDateFormat      = "20060102"
 )
 
+const (
+	bigqueryDefaultConcurrency  = 4
+	bigqueryDefaultMaxRetries   = 3
+	bigqueryDefaultRetryBackoff = 10 * time.Second
+)
+
 type BigQueryDatasetExportConfig struct {
 	BucketName      string
 	ProjectID       string
@@ -39,30 +60,120 @@ type BigQueryDatasetExportConfig struct {
 	FilterAfter     time.Time
 	ExcludePatterns []string
 	Storage         Storage
+	Prefix          string // Storage path the export is written below, defaults to the timestamp of the run
+
+	IncludePatterns    []string             // Only exports tables matching `dataset.table`, all if empty
+	DatasetFilterAfter map[string]time.Time // Overrides FilterAfter per dataset
+	Labels             map[string]string    // Only exports tables having all labels, an empty value matches any value
+
+	ChangedOnly bool   // Only exports tables modified since their last successful export
+	Partitioned bool   // Only exports partitions modified since their last successful export
+	StatePath   string // Storage path of the state tracking exported tables, defaults to bigquery-export.state.json
+
+	// Staging extracts into a GCS bucket and copies the files through Storage, required for
+	// storage vendors other than GCS
+	StagingBucketName string
+	StagingPrefix     string // Defaults to staging
+	StorageGCS        bool   // Storage is the GCS bucket BucketName, staged files are recorded with their gs:// URI
+
+	// Snapshot mode, see Snapshot
+	SnapshotDataset    string        // Dataset the table snapshots are created in
+	SnapshotExpiration time.Duration // Expiration of the snapshots, never if zero
+	SnapshotRetention  int           // Snapshots kept per table, all if zero
+
+	Concurrency  int           // Extract jobs running in parallel per dataset, defaults to 4
+	MaxRetries   int           // Retries of extract jobs failing with retryable errors, defaults to 3
+	RetryBackoff time.Duration // Initial backoff between retries, doubled on each retry, defaults to 10s
+
+	Format      BigQueryExportFormat // Defaults to parquet-gzip
+	FormatRules []BigQueryFormatRule // Overrides the format per table or dataset, first match wins
+}
+
+// BigQueryTableResult reports the outcome of a single table export
+type BigQueryTableResult struct {
+	DatasetID string
+	TableID   string
+	URI       string
+	Format    BigQueryExportFormat
+	Attempts  int
+	Duration  time.Duration
+	Err       error
+
+	LastModified time.Time
+	Unchanged    bool                        // Not exported again, URI refers to an earlier export
+	Partitions   []BigQueryPartitionManifest // Exported partitions of partitioned tables
+
+	paths []string // Objects copied through Storage, committed along with the dataset
 }
 
 type BigQueryDatasetExport struct {
-	config BigQueryDatasetExportConfig
-	client *bigquery.Client
+	config  BigQueryDatasetExportConfig
+	client  *bigquery.Client
+	staging *gcs.Client
 }
 
 func NewBigQueryExport(ctx context.Context, config BigQueryDatasetExportConfig) (*BigQueryDatasetExport, error) {
+	if config.Concurrency <= 0 {
+		config.Concurrency = bigqueryDefaultConcurrency
+	}
+	if config.MaxRetries < 0 {
+		config.MaxRetries = 0
+	} else if config.MaxRetries == 0 {
+		config.MaxRetries = bigqueryDefaultMaxRetries
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = bigqueryDefaultRetryBackoff
+	}
+	if config.StatePath == "" {
+		config.StatePath = bigqueryDefaultStatePath
+	}
+	if config.Format == "" {
+		config.Format = bigqueryDefaultFormat
+	}
+	if _, err := config.Format.spec(); err != nil {
+		return nil, err
+	}
+	for _, rule := range config.FormatRules {
+		if _, err := rule.Format.spec(); err != nil {
+			return nil, err
+		}
+		if _, err := filepath.Match(rule.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("pattern %s is malformed: %w", rule.Pattern, err)
+		}
+	}
 	client, err := bigquery.NewClient(ctx, config.ProjectID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create bigquery client: %w", err)
 	}
-	return &BigQueryDatasetExport{
+	bqe := &BigQueryDatasetExport{
 		config: config,
 		client: client,
-	}, nil
+	}
+	if config.StagingBucketName != "" {
+		if bqe.config.StagingPrefix == "" {
+			bqe.config.StagingPrefix = bigqueryDefaultStagingPrefix
+		}
+		if bqe.staging, err = gcs.NewClient(ctx); err != nil {
+			return nil, fmt.Errorf("failed to create staging client: %w", err)
+		}
+	}
+	return bqe, nil
 }
 
 func (bqe *BigQueryDatasetExport) Export(ctx context.Context, l *slog.Logger) (string, error) {
 	if l == nil {
 		l = slog.Default()
 	}
-	exportTimestamp := time.Now().Format(TimestampFormat)
-	bigqueryGCSURIPrefix := fmt.Sprintf(bigqueryGCSURIPrefix, bqe.config.BucketName, exportTimestamp)
+	prefix := bqe.config.Prefix
+	if prefix == "" {
+		prefix = time.Now().Format(TimestampFormat)
+	}
+	bigqueryGCSURIPrefix := bqe.stagingURIPrefix(prefix)
+	defer func() {
+		if err := bqe.cleanupStaging(context.WithoutCancel(ctx), prefix); err != nil {
+			l.Error("Failed to clean up staging prefix", slog.Any("error", err))
+		}
+	}()
 
 	l.With(
 		slog.Any("filterAfter", bqe.config.FilterAfter),
@@ -70,12 +181,22 @@ func (bqe *BigQueryDatasetExport) Export(ctx context.Context, l *slog.Logger) (s
 	).Info("Starting export")
 
 	// Export Information Schemata
-	schemaPath := path.Join(exportTimestamp, "INFORMATION_SCHEMA.SCHEMATA.json.gz")
+	schemaPath := path.Join(prefix, "INFORMATION_SCHEMA.SCHEMATA.json.gz")
 	err := bqe.storeQueryResultAsGzippedJSON(ctx, schemaPath, fmt.Sprintf(bigqueryQueryDataSetSchema, bqe.config.GCSLocation))
 	if err != nil {
 		return "", fmt.Errorf("failed to store schemas: %w", err)
 	}
 	l.Info("Schema export complete", "path", schemaPath)
+
+	var state *BigQueryExportState
+	if bqe.config.ChangedOnly || bqe.config.Partitioned {
+		if _, err := ReadState(ctx, bqe.config.Storage, bqe.config.StatePath, &state); err != nil {
+			return "", err
+		}
+	}
+
+	var results, committed []BigQueryTableResult
+	var failedDatasets []string
 	// Region
 	// get all datasets
 	datasetIterator := bqe.client.Datasets(ctx)
@@ -94,77 +215,278 @@ func (bqe *BigQueryDatasetExport) Export(ctx context.Context, l *slog.Logger) (s
 			slog.String("path", bigqueryGCSURIDataSetPrefix),
 		)
 		// Export Dataset Schema
-		tableSchemaPath := path.Join(exportTimestamp, dataset.DatasetID, "INFORMATION_SCHEMA.TABLES.json.gz")
-		err = bqe.storeQueryResultAsGzippedJSON(ctx, path.Join(exportTimestamp, dataset.DatasetID, "INFORMATION_SCHEMA.TABLES.json.gz"), fmt.Sprintf(bigqueryQueryTableSchema, dataset.ProjectID, dataset.DatasetID))
+		tableSchemaPath := path.Join(prefix, dataset.DatasetID, "INFORMATION_SCHEMA.TABLES.json.gz")
+		err = bqe.storeQueryResultAsGzippedJSON(ctx, tableSchemaPath, fmt.Sprintf(bigqueryQueryTableSchema, dataset.ProjectID, dataset.DatasetID))
 		if err != nil {
 			return "", fmt.Errorf("failed to store schema for dataset %s: %w", dataset.DatasetID, err)
 		}
 		l.Info("Table schema export complete", "path", tableSchemaPath)
 
+		// Export view, routine and external table definitions
+		paths := []string{schemaPath, tableSchemaPath}
+		if definitionPaths, err := bqe.storeDefinitions(ctx, prefix, dataset); err != nil {
+			l.Error("Failed to export definitions, continuing dump...", slog.Any("error", err))
+			failedDatasets = append(failedDatasets, dataset.DatasetID)
+		} else {
+			paths = append(paths, definitionPaths...)
+			l.Info("Definitions export complete")
+		}
+
 		// Export Dataset Data
-		err = bqe.exportDataset(ctx, l, dataset, bigqueryGCSURIDataSetPrefix)
+		datasetResults, err := bqe.exportDataset(ctx, l, dataset, bigqueryGCSURIDataSetPrefix, state)
+		results = append(results, datasetResults...)
+		manifestPath := path.Join(prefix, dataset.DatasetID, bigqueryManifestName)
+		if err == nil {
+			err = bqe.storeManifest(ctx, manifestPath, dataset, datasetResults)
+		}
+		if err == nil {
+			// the dataset is kept even if other tables or datasets fail
+			for _, result := range datasetResults {
+				paths = append(paths, result.paths...)
+			}
+			err = storage.Commit(ctx, bqe.config.Storage, append(paths, manifestPath)...)
+		}
 		if err != nil {
 			// Continue exporting other datasets
 			l.Error("Failed to export dataset, continuing dump...", slog.Any("error", err), slog.String("dataset", dataset.DatasetID))
+			if !slices.Contains(failedDatasets, dataset.DatasetID) {
+				failedDatasets = append(failedDatasets, dataset.DatasetID)
+			}
 			continue
 		}
+		committed = append(committed, datasetResults...)
 		l.Info("Dataset export complete")
 	}
-	return bigqueryGCSURIPrefix, nil
+
+	if bqe.config.ChangedOnly || bqe.config.Partitioned {
+		// only tables of committed datasets are recorded, their objects are kept if the export fails
+		if err := WriteState(ctx, bqe.config.Storage, bqe.config.StatePath, state.next(committed)); err != nil {
+			return "", err
+		}
+		if err := storage.Commit(ctx, bqe.config.Storage, bqe.config.StatePath); err != nil {
+			return "", err
+		}
+	}
+	return bqe.stagedPath(bigqueryGCSURIPrefix), summarizeTableResults(l, "export", results, failedDatasets)
 }
 
-func (bqe *BigQueryDatasetExport) exportDataset(ctx context.Context, l *slog.Logger, dataset *bigquery.Dataset, bigqueryGCSURIDataSetPrefix string) error {
+// summarizeTableResults logs the outcome of all table exports or restores and returns an
+// error listing the failed tables and datasets, if any
+func summarizeTableResults(l *slog.Logger, operation string, results []BigQueryTableResult, failedDatasets []string) error {
+	var failedTables []string
+	var retried, unchanged int
+	for _, result := range results {
+		if result.Unchanged {
+			unchanged++
+		}
+		if result.Attempts > 1 {
+			retried++
+		}
+		if result.Err != nil {
+			failedTables = append(failedTables, result.DatasetID+"."+result.TableID)
+			l.Error("Table "+operation+" failed",
+				slog.String("dataset", result.DatasetID),
+				slog.String("table", result.TableID),
+				slog.Int("attempts", result.Attempts),
+				slog.Any("error", result.Err),
+			)
+		}
+	}
+	l.Info("Summary",
+		slog.String("operation", operation),
+		slog.Int("tables", len(results)),
+		slog.Int("succeeded", len(results)-len(failedTables)),
+		slog.Int("failed", len(failedTables)),
+		slog.Int("retried", retried),
+		slog.Int("unchanged", unchanged),
+		slog.Any("failedTables", failedTables),
+		slog.Any("failedDatasets", failedDatasets),
+	)
+	if len(failedTables) > 0 || len(failedDatasets) > 0 {
+		return fmt.Errorf("%s incomplete: %d of %d tables and %d datasets failed", operation, len(failedTables), len(results), len(failedDatasets))
+	}
+	return nil
+}
+
+// exportDataset extracts all selected tables of the dataset, a failing table doesn't
+// affect the others and is reported in the results
+func (bqe *BigQueryDatasetExport) exportDataset(ctx context.Context, l *slog.Logger, dataset *bigquery.Dataset, bigqueryGCSURIDataSetPrefix string, state *BigQueryExportState) ([]BigQueryTableResult, error) {
 	tableIterator := dataset.Tables(ctx)
 
-	var tables []*bigquery.Table
+	// lastModifiedTime is only part of the storage statistics
+	metadataView := bigquery.BasicMetadataView
+	if bqe.config.ChangedOnly {
+		metadataView = bigquery.StorageStatsMetadataView
+	}
+	var partitions map[string][]bigqueryPartitionRow
+	if bqe.config.Partitioned {
+		var err error
+		if partitions, err = bqe.queryPartitions(ctx, dataset); err != nil {
+			return nil, err
+		}
+	}
+
+	type pendingTable struct {
+		table        *bigquery.Table
+		format       BigQueryExportFormat
+		lastModified time.Time
+		partitioned  bool
+		partitions   []BigQueryPartitionManifest
+	}
+	var tables []*pendingTable
 	var tableNames []string
+	var results []BigQueryTableResult
 	for {
 		t, err := tableIterator.Next()
 		if errors.Is(err, iterator.Done) {
 			break
 		}
 		if err != nil {
-			return fmt.Errorf("failed to iterate dataset %w", err)
+			return nil, fmt.Errorf("failed to iterate dataset %w", err)
 		}
-		excluded, err := isTableExcluded(t, bqe.config.ExcludePatterns, bqe.config.FilterAfter)
+		md, err := bqe.selectTable(ctx, t, metadataView)
 		if err != nil {
-			return fmt.Errorf("failed to check if table is excluded: %w", err)
+			return nil, err
 		}
-		if excluded {
+		if md == nil {
 			continue
 		}
-		md, err := t.Metadata(ctx, bigquery.WithMetadataView(bigquery.BasicMetadataView))
+		format, err := tableFormat(t, bqe.config.FormatRules, bqe.config.Format)
 		if err != nil {
-			return fmt.Errorf("failed to get table metadata: %w", err)
+			return nil, err
 		}
-		if md.Type != bigquery.RegularTable {
-			continue
+
+		if bqe.config.ChangedOnly {
+			if previous, ok := state.unchanged(t, md.LastModifiedTime, format); ok {
+				results = append(results, BigQueryTableResult{
+					DatasetID:    t.DatasetID,
+					TableID:      t.TableID,
+					URI:          previous.URI,
+					Format:       previous.Format,
+					Partitions:   previous.Partitions,
+					LastModified: md.LastModifiedTime,
+					Unchanged:    true,
+				})
+				continue
+			}
 		}
 
-		tables = append(tables, t)
+		pending := &pendingTable{table: t, format: format, lastModified: md.LastModifiedTime}
+		if bqe.config.Partitioned && (md.TimePartitioning != nil || md.RangePartitioning != nil) {
+			pending.partitioned = true
+			pending.partitions = planPartitions(partitions[t.TableID], state.previousPartitions(t, format))
+		}
+		tables = append(tables, pending)
 		tableNames = append(tableNames, t.TableID)
 	}
 
 	if len(tables) == 0 {
-		l.Info("No tables on dataset or all tables are excluded")
-		return nil
+		l.Info("No changed tables on dataset or all tables are excluded", slog.Int("unchanged", len(results)))
+		return results, nil
+	}
+	l.Info("Starting export...", slog.Any("tables", strings.Join(tableNames, ", ")), slog.Int("unchanged", len(results)))
+
+	// Every table or changed partition is extracted by its own job
+	type extractJob struct {
+		pending   *pendingTable
+		partition int // index of the partition, -1 for the whole table
+		uri       string
+		paths     []string
+		attempts  int
+		duration  time.Duration
+		err       error
+	}
+	var jobs []*extractJob
+	for _, pending := range tables {
+		if !pending.partitioned {
+			jobs = append(jobs, &extractJob{pending: pending, partition: -1})
+			continue
+		}
+		for i, partition := range pending.partitions {
+			if partition.URI == "" {
+				jobs = append(jobs, &extractJob{pending: pending, partition: i})
+			}
+		}
 	}
-	l.Info("Starting export...", slog.Any("tables", strings.Join(tableNames, ", ")))
 
-	g, groupCtx := errgroup.WithContext(ctx)
-	// Run exportTableAsCompressedParquet for all tables and log
-	for _, t := range tables {
-		table := t
+	var g errgroup.Group
+	g.SetLimit(bqe.config.Concurrency)
+	// Run exportTable for all jobs and log
+	for _, job := range jobs {
+		spec, err := job.pending.format.spec()
+		if err != nil {
+			return nil, err
+		}
+		table := job.pending.table
+		source := table
+		gcsURI := fmt.Sprintf("%s/%s/*%s", bigqueryGCSURIDataSetPrefix, table.TableID, spec.extension)
+		if job.partition >= 0 {
+			partitionID := job.pending.partitions[job.partition].PartitionID
+			source = &bigquery.Table{ProjectID: table.ProjectID, DatasetID: table.DatasetID, TableID: partitionTableID(table.TableID, partitionID)}
+			gcsURI = fmt.Sprintf("%s/%s/%s/*%s", bigqueryGCSURIDataSetPrefix, table.TableID, partitionID, spec.extension)
+		}
 		g.Go(func() error {
-			gcsURI := fmt.Sprintf("%s/%s/*.parquet.gz", bigqueryGCSURIDataSetPrefix, table.TableID)
-			err := bqe.exportTableAsCompressedParquet(groupCtx, table, gcsURI)
-			if err != nil {
-				return fmt.Errorf("failed to export to table %q with URI %q :%w", table.TableID, gcsURI, err)
+			start := time.Now()
+			job.attempts, job.err = retryJob(ctx, l, bqe.config.MaxRetries, bqe.config.RetryBackoff, func() error {
+				return bqe.exportTable(ctx, source, gcsURI, spec)
+			})
+			if job.err == nil {
+				job.uri, job.paths, job.err = bqe.unstage(ctx, gcsURI)
+			}
+			job.duration = time.Since(start)
+			if job.err != nil {
+				job.err = fmt.Errorf("failed to export to table %q with URI %q :%w", source.TableID, gcsURI, job.err)
+			} else if job.partition >= 0 {
+				job.pending.partitions[job.partition].URI = job.uri
 			}
 			return nil
 		})
 	}
-	return g.Wait()
+	_ = g.Wait()
+
+	for _, pending := range tables {
+		result := BigQueryTableResult{
+			DatasetID:    pending.table.DatasetID,
+			TableID:      pending.table.TableID,
+			URI:          bqe.exportedURI(fmt.Sprintf("%s/%s/", bigqueryGCSURIDataSetPrefix, pending.table.TableID)),
+			Format:       pending.format,
+			LastModified: pending.lastModified,
+		}
+		var errs []error
+		for _, job := range jobs {
+			if job.pending != pending {
+				continue
+			}
+			if job.partition < 0 && job.uri != "" {
+				result.URI = job.uri
+			}
+			result.Attempts = max(result.Attempts, job.attempts)
+			result.Duration += job.duration
+			if job.err == nil {
+				result.paths = append(result.paths, job.paths...)
+			}
+			errs = append(errs, job.err)
+		}
+		result.Err = errors.Join(errs...)
+		if pending.partitioned {
+			// failed partitions keep their previous export, if any, and are retried on the next run
+			previous := map[string]BigQueryPartitionManifest{}
+			for _, partition := range state.previousPartitions(pending.table, pending.format) {
+				previous[partition.PartitionID] = partition
+			}
+			for _, partition := range pending.partitions {
+				if partition.URI == "" {
+					var ok bool
+					if partition, ok = previous[partition.PartitionID]; !ok {
+						continue
+					}
+				}
+				result.Partitions = append(result.Partitions, partition)
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
 }
 
 func (bqe *BigQueryDatasetExport) storeQueryResultAsGzippedJSON(ctx context.Context, storagePath string, query string) error {
@@ -202,14 +524,59 @@ func (bqe *BigQueryDatasetExport) executeQueryAndWriteJSON(ctx context.Context,
 	return json.NewEncoder(writer).Encode(rows)
 }
 
-// exportTableAsCompressedParquet demonstrates using an export job to
-// write the contents of a table into Cloud Storage as compressed CSV.
-func (bqe *BigQueryDatasetExport) exportTableAsCompressedParquet(ctx context.Context, table *bigquery.Table, gcsURI string) error {
+// storeDefinitions stores INFORMATION_SCHEMA.VIEWS and ROUTINES as well as the DDL of all views,
+// materialized views, external tables and routines of the dataset
+func (bqe *BigQueryDatasetExport) storeDefinitions(ctx context.Context, prefix string, dataset *bigquery.Dataset) ([]string, error) {
+	queries := map[string]string{
+		"INFORMATION_SCHEMA.VIEWS.json.gz":    bigqueryQueryViewSchema,
+		"INFORMATION_SCHEMA.ROUTINES.json.gz": bigqueryQueryRoutineSchema,
+		bigqueryDefinitionsName:               bigqueryQueryDefinitions,
+	}
+	var paths []string
+	for name, query := range queries {
+		storagePath := path.Join(prefix, dataset.DatasetID, name)
+		err := bqe.storeQueryResultAsGzippedJSON(ctx, storagePath, fmt.Sprintf(query, dataset.ProjectID, dataset.DatasetID))
+		if err != nil {
+			return nil, fmt.Errorf("failed to store %s: %w", name, err)
+		}
+		paths = append(paths, storagePath)
+	}
+	return paths, nil
+}
+
+// storeManifest records the format of all successfully exported tables of the dataset
+func (bqe *BigQueryDatasetExport) storeManifest(ctx context.Context, storagePath string, dataset *bigquery.Dataset, results []BigQueryTableResult) error {
+	manifest := BigQueryDatasetManifest{
+		ProjectID:  dataset.ProjectID,
+		DatasetID:  dataset.DatasetID,
+		ExportedAt: time.Now(),
+		Tables:     []BigQueryTableManifest{},
+	}
+	for _, result := range results {
+		if result.Err != nil && len(result.Partitions) == 0 {
+			continue
+		}
+		table, err := newBigQueryTableManifest(result.TableID, result.URI, result.Format)
+		if err != nil {
+			return err
+		}
+		table.Partitions = result.Partitions
+		manifest.Tables = append(manifest.Tables, table)
+	}
+	if err := WriteState(ctx, bqe.config.Storage, storagePath, manifest); err != nil {
+		return fmt.Errorf("failed to store manifest: %w", err)
+	}
+	return nil
+}
+
+func (bqe *BigQueryDatasetExport) exportTable(ctx context.Context, table *bigquery.Table, gcsURI string, spec bigqueryFormatSpec) error {
 	gcsRef := bigquery.NewGCSReference(gcsURI)
-	gcsRef.Compression = bigquery.Gzip
-	gcsRef.DestinationFormat = bigquery.Parquet
+	gcsRef.Compression = spec.compression
+	gcsRef.DestinationFormat = spec.format
 
 	extractor := bqe.client.DatasetInProject(table.ProjectID, table.DatasetID).Table(table.TableID).ExtractorTo(gcsRef)
+	// Keep DATE, TIMESTAMP etc. as avro logical types instead of plain strings and longs
+	extractor.UseAvroLogicalTypes = spec.format == bigquery.Avro
 	// You can choose to run the job in a specific location for more complex data locality scenarios.
 	extractor.Location = bqe.config.GCSLocation
 
@@ -253,3 +620,127 @@ func isTableExcluded(t *bigquery.Table, patterns []string, excludeBefore time.Ti
 	}
 	return false, nil
 }
+
+// selectTable returns the metadata of the table if it is a regular table passing all
+// filters, or nil if it is skipped
+func (bqe *BigQueryDatasetExport) selectTable(ctx context.Context, t *bigquery.Table, view bigquery.TableMetadataView) (*bigquery.TableMetadata, error) {
+	excluded, err := isTableExcluded(t, bqe.config.ExcludePatterns, bqe.filterAfter(t.DatasetID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to check if table is excluded: %w", err)
+	}
+	if excluded {
+		return nil, nil
+	}
+	included, err := isTableIncluded(t, bqe.config.IncludePatterns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check if table is included: %w", err)
+	}
+	if !included {
+		return nil, nil
+	}
+	md, err := t.Metadata(ctx, bigquery.WithMetadataView(view))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get table metadata: %w", err)
+	}
+	if md.Type != bigquery.RegularTable || !hasLabels(md.Labels, bqe.config.Labels) {
+		return nil, nil
+	}
+	return md, nil
+}
+
+// isTableIncluded reports whether the `dataset.table` key matches any of the patterns,
+// all tables are included without patterns
+func isTableIncluded(t *bigquery.Table, patterns []string) (bool, error) {
+	tableKey := fmt.Sprintf("%s.%s", t.DatasetID, t.TableID)
+	included := true
+	for _, p := range patterns {
+		if p == "" {
+			continue
+		}
+		included = false
+		matched, err := filepath.Match(p, tableKey)
+		if err != nil {
+			return false, fmt.Errorf("pattern %s is malformed: %w", p, err)
+		}
+		if matched {
+			return true, nil
+		}
+	}
+	return included, nil
+}
+
+// hasLabels reports whether all required labels are set, an empty required value matches any value
+func hasLabels(labels, required map[string]string) bool {
+	for key, value := range required {
+		actual, ok := labels[key]
+		if !ok || (value != "" && actual != value) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseBigQueryLabels parses label filters given as `key=value` or `key` to match any value
+func ParseBigQueryLabels(values []string) map[string]string {
+	labels := map[string]string{}
+	for _, value := range values {
+		key, value, _ := strings.Cut(value, "=")
+		labels[key] = value
+	}
+	return labels
+}
+
+func (bqe *BigQueryDatasetExport) filterAfter(datasetID string) time.Time {
+	if filterAfter, ok := bqe.config.DatasetFilterAfter[datasetID]; ok {
+		return filterAfter
+	}
+	return bqe.config.FilterAfter
+}
+
+// retryJob runs fn until it succeeds, fails with an error which is not retryable or
+// maxRetries is exceeded; the backoff is doubled after each attempt
+func retryJob(ctx context.Context, l *slog.Logger, maxRetries int, backoff time.Duration, fn func() error) (attempts int, err error) {
+	for {
+		attempts++
+		err = fn()
+		if err == nil || attempts > maxRetries || !isRetryableJobError(err) {
+			return attempts, err
+		}
+		l.Warn("Retrying job after retryable error", slog.Int("attempt", attempts), slog.Duration("backoff", backoff), slog.Any("error", err))
+		select {
+		case <-ctx.Done():
+			return attempts, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// isRetryableJobError reports whether the job or api error is transient, e.g. rate limits
+// and backend errors
+func isRetryableJobError(err error) bool {
+	var jobErr *bigquery.Error
+	if errors.As(err, &jobErr) {
+		return isRetryableReason(jobErr.Reason)
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		if apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= http.StatusInternalServerError {
+			return true
+		}
+		for _, item := range apiErr.Errors {
+			if isRetryableReason(item.Reason) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isRetryableReason(reason string) bool {
+	switch reason {
+	case "rateLimitExceeded", "backendError", "internalError", "jobBackendError", "jobInternalError":
+		return true
+	}
+	return false
+}
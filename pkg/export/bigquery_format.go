@@ -0,0 +1,125 @@
+package export
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// BigQueryExportFormat combines the destination format and compression of extract jobs
+type BigQueryExportFormat string
+
+const (
+	BigQueryFormatParquetGzip   BigQueryExportFormat = "parquet-gzip"
+	BigQueryFormatParquetSnappy BigQueryExportFormat = "parquet-snappy"
+	BigQueryFormatParquetZSTD   BigQueryExportFormat = "parquet-zstd"
+	BigQueryFormatAvro          BigQueryExportFormat = "avro"
+	BigQueryFormatAvroSnappy    BigQueryExportFormat = "avro-snappy"
+	BigQueryFormatAvroDeflate   BigQueryExportFormat = "avro-deflate"
+	BigQueryFormatJSON          BigQueryExportFormat = "json"
+	BigQueryFormatJSONGzip      BigQueryExportFormat = "json-gzip"
+
+	bigqueryDefaultFormat = BigQueryFormatParquetGzip
+	bigqueryManifestName  = "MANIFEST.json"
+)
+
+// bigqueryCompressionZSTD is supported by extract jobs to Parquet, but not defined by the client library
+const bigqueryCompressionZSTD bigquery.Compression = "ZSTD"
+
+type bigqueryFormatSpec struct {
+	format      bigquery.DataFormat
+	compression bigquery.Compression
+	extension   string
+}
+
+var bigqueryFormats = map[BigQueryExportFormat]bigqueryFormatSpec{
+	BigQueryFormatParquetGzip:   {format: bigquery.Parquet, compression: bigquery.Gzip, extension: ".parquet.gz"},
+	BigQueryFormatParquetSnappy: {format: bigquery.Parquet, compression: bigquery.Snappy, extension: ".parquet"},
+	BigQueryFormatParquetZSTD:   {format: bigquery.Parquet, compression: bigqueryCompressionZSTD, extension: ".parquet"},
+	BigQueryFormatAvro:          {format: bigquery.Avro, compression: bigquery.None, extension: ".avro"},
+	BigQueryFormatAvroSnappy:    {format: bigquery.Avro, compression: bigquery.Snappy, extension: ".avro"},
+	BigQueryFormatAvroDeflate:   {format: bigquery.Avro, compression: bigquery.Deflate, extension: ".avro"},
+	BigQueryFormatJSON:          {format: bigquery.JSON, compression: bigquery.None, extension: ".json"},
+	BigQueryFormatJSONGzip:      {format: bigquery.JSON, compression: bigquery.Gzip, extension: ".json.gz"},
+}
+
+func (f BigQueryExportFormat) spec() (bigqueryFormatSpec, error) {
+	spec, ok := bigqueryFormats[f]
+	if !ok {
+		return spec, fmt.Errorf("unknown bigquery export format %q", f)
+	}
+	return spec, nil
+}
+
+// BigQueryFormatRule selects the export format of all tables whose `dataset.table` key
+// matches the pattern, e.g. `analytics.*` for a whole dataset
+type BigQueryFormatRule struct {
+	Pattern string
+	Format  BigQueryExportFormat
+}
+
+// ParseBigQueryFormatRules parses rules given as `pattern=format`
+func ParseBigQueryFormatRules(values []string) ([]BigQueryFormatRule, error) {
+	var rules []BigQueryFormatRule
+	for _, value := range values {
+		pattern, format, ok := strings.Cut(value, "=")
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("format rule %q must be given as pattern=format", value)
+		}
+		rules = append(rules, BigQueryFormatRule{Pattern: pattern, Format: BigQueryExportFormat(format)})
+	}
+	return rules, nil
+}
+
+// tableFormat returns the format of the first rule matching the table, or the default format
+func tableFormat(t *bigquery.Table, rules []BigQueryFormatRule, defaultFormat BigQueryExportFormat) (BigQueryExportFormat, error) {
+	tableKey := fmt.Sprintf("%s.%s", t.DatasetID, t.TableID)
+	for _, rule := range rules {
+		matched, err := filepath.Match(rule.Pattern, tableKey)
+		if err != nil {
+			return "", fmt.Errorf("pattern %s is malformed: %w", rule.Pattern, err)
+		}
+		if matched {
+			return rule.Format, nil
+		}
+	}
+	return defaultFormat, nil
+}
+
+// BigQueryDatasetManifest records how the tables of a dataset have been exported, so
+// they can be loaded again with the matching source format
+type BigQueryDatasetManifest struct {
+	ProjectID  string                  `json:"projectId"`
+	DatasetID  string                  `json:"datasetId"`
+	ExportedAt time.Time               `json:"exportedAt"`
+	Tables     []BigQueryTableManifest `json:"tables"`
+}
+
+type BigQueryTableManifest struct {
+	TableID             string               `json:"tableId"`
+	URI                 string               `json:"uri"`
+	Format              BigQueryExportFormat `json:"format"`
+	DestinationFormat   bigquery.DataFormat  `json:"destinationFormat"`
+	Compression         bigquery.Compression `json:"compression"`
+	UseAvroLogicalTypes bool                 `json:"useAvroLogicalTypes,omitempty"`
+
+	Partitions []BigQueryPartitionManifest `json:"partitions,omitempty"` // Set if partitions are exported on their own
+}
+
+func newBigQueryTableManifest(tableID, uri string, format BigQueryExportFormat) (BigQueryTableManifest, error) {
+	spec, err := format.spec()
+	if err != nil {
+		return BigQueryTableManifest{}, err
+	}
+	return BigQueryTableManifest{
+		TableID:             tableID,
+		URI:                 uri,
+		Format:              format,
+		DestinationFormat:   spec.format,
+		Compression:         spec.compression,
+		UseAvroLogicalTypes: spec.format == bigquery.Avro,
+	}, nil
+}
@@ -0,0 +1,83 @@
+package export
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// bigqueryQueryPartitions lists the partitions of all tables of a dataset, rows still in the
+	// streaming buffer can not be extracted and are picked up by a later run
+	bigqueryQueryPartitions = "SELECT table_name, partition_id, last_modified_time FROM %s.%s.INFORMATION_SCHEMA.PARTITIONS WHERE partition_id IS NOT NULL AND partition_id != '__STREAMING_UNPARTITIONED__'"
+
+	bigqueryPartitionNull          = "__NULL__"
+	bigqueryPartitionUnpartitioned = "__UNPARTITIONED__"
+)
+
+// BigQueryPartitionManifest is a partition exported on its own, unchanged partitions refer to
+// the export of an earlier run
+type BigQueryPartitionManifest struct {
+	PartitionID  string    `json:"partitionId"`
+	URI          string    `json:"uri"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+type bigqueryPartitionRow struct {
+	TableName        string    `bigquery:"table_name"`
+	PartitionID      string    `bigquery:"partition_id"`
+	LastModifiedTime time.Time `bigquery:"last_modified_time"`
+}
+
+// queryPartitions returns the partitions of all partitioned tables of the dataset by table name
+func (bqe *BigQueryDatasetExport) queryPartitions(ctx context.Context, dataset *bigquery.Dataset) (map[string][]bigqueryPartitionRow, error) {
+	q := bqe.client.Query(fmt.Sprintf(bigqueryQueryPartitions, dataset.ProjectID, dataset.DatasetID))
+	q.Location = bqe.config.GCSLocation
+	it, err := q.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query partitions: %w", err)
+	}
+	partitions := map[string][]bigqueryPartitionRow{}
+	for {
+		var row bigqueryPartitionRow
+		err := it.Next(&row)
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to iterate partitions: %w", err)
+		}
+		partitions[row.TableName] = append(partitions[row.TableName], row)
+	}
+	return partitions, nil
+}
+
+// planPartitions keeps the previous export of unchanged partitions, partitions to export
+// have an empty URI
+func planPartitions(current []bigqueryPartitionRow, previous []BigQueryPartitionManifest) []BigQueryPartitionManifest {
+	exported := map[string]BigQueryPartitionManifest{}
+	for _, partition := range previous {
+		exported[partition.PartitionID] = partition
+	}
+	planned := make([]BigQueryPartitionManifest, 0, len(current))
+	for _, row := range current {
+		if prev, ok := exported[row.PartitionID]; ok && prev.URI != "" && prev.LastModified.Equal(row.LastModifiedTime) {
+			planned = append(planned, prev)
+			continue
+		}
+		planned = append(planned, BigQueryPartitionManifest{
+			PartitionID:  row.PartitionID,
+			LastModified: row.LastModifiedTime,
+		})
+	}
+	return planned
+}
+
+// partitionTableID addresses a single partition with a partition decorator
+func partitionTableID(tableID, partitionID string) string {
+	return tableID + "$" + partitionID
+}
@@ -0,0 +1,513 @@
+package export
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/foomo/dump-buckets/pkg/compression"
+	"github.com/foomo/dump-buckets/pkg/storage"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/googleapi"
+)
+
+const bigqueryTableTypeBase = "BASE TABLE"
+
+type BigQueryRestoreConfig struct {
+	BucketName  string
+	StorageGCS  bool   // Storage is the GCS bucket BucketName, relative URIs of staged exports are loaded from it
+	ProjectID   string // Target project of the restored datasets
+	GCSLocation string
+	Storage     Storage
+
+	Datasets  []string          // Source datasets to restore, all exported datasets if empty
+	Renames   map[string]string // Renames `dataset` to a target dataset or `dataset.table` to a target table
+	Overwrite bool              // Replaces existing tables instead of failing
+
+	Definitions bool // Replays the DDL of views, materialized views, external tables and routines
+
+	Concurrency  int // Load jobs running in parallel per dataset, defaults to 4
+	MaxRetries   int
+	RetryBackoff time.Duration
+}
+
+// BigQueryRestore reloads a dump written by BigQueryDatasetExport.Export
+type BigQueryRestore struct {
+	config BigQueryRestoreConfig
+	client *bigquery.Client
+}
+
+// bigqueryTableSchemaRow holds the columns of INFORMATION_SCHEMA.TABLES needed to recreate a table
+type bigqueryTableSchemaRow struct {
+	TableCatalog string `json:"table_catalog"`
+	TableSchema  string `json:"table_schema"`
+	TableName    string `json:"table_name"`
+	TableType    string `json:"table_type"`
+	DDL          string `json:"ddl"`
+}
+
+type bigquerySchemataRow struct {
+	CatalogName string `json:"catalog_name"`
+	SchemaName  string `json:"schema_name"`
+}
+
+// bigqueryDefinitionRow is a row of the definitions written by storeDefinitions
+type bigqueryDefinitionRow struct {
+	ObjectName string `json:"object_name"`
+	ObjectType string `json:"object_type"`
+	DDL        string `json:"ddl"`
+}
+
+var bigqueryIdentifierRegex = regexp.MustCompile("`([^`.]+)\\.([^`.]+)\\.([^`]+)`")
+
+func NewBigQueryRestore(ctx context.Context, config BigQueryRestoreConfig) (*BigQueryRestore, error) {
+	if config.Concurrency <= 0 {
+		config.Concurrency = bigqueryDefaultConcurrency
+	}
+	if config.MaxRetries < 0 {
+		config.MaxRetries = 0
+	} else if config.MaxRetries == 0 {
+		config.MaxRetries = bigqueryDefaultMaxRetries
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = bigqueryDefaultRetryBackoff
+	}
+	client, err := bigquery.NewClient(ctx, config.ProjectID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create BigQuery client: %w", err)
+	}
+	return &BigQueryRestore{
+		config: config,
+		client: client,
+	}, nil
+}
+
+// Restore recreates the datasets and tables of the export stored below the first of the
+// prefixes holding one, including partitioning and clustering, and loads the exported data
+// into them
+func (bqr *BigQueryRestore) Restore(ctx context.Context, l *slog.Logger, prefixes ...string) error {
+	if l == nil {
+		l = slog.Default()
+	}
+	prefix, schemata, err := bqr.findExport(ctx, prefixes)
+	if err != nil {
+		return err
+	}
+	l.Info("Found export", slog.String("prefix", prefix))
+
+	var results []BigQueryTableResult
+	var failedDatasets []string
+	var restored []bigquerySchemataRow
+	for _, schema := range schemata {
+		if len(bqr.config.Datasets) > 0 && !slices.Contains(bqr.config.Datasets, schema.SchemaName) {
+			continue
+		}
+		l := l.With(slog.String("dataset", schema.SchemaName))
+		datasetResults, err := bqr.restoreDataset(ctx, l, prefix, schema.SchemaName)
+		results = append(results, datasetResults...)
+		if err != nil {
+			// Continue restoring other datasets
+			l.Error("Failed to restore dataset, continuing restore...", slog.Any("error", err))
+			failedDatasets = append(failedDatasets, schema.SchemaName)
+			continue
+		}
+		restored = append(restored, schema)
+	}
+
+	// Views and routines may refer to tables of other datasets, so they are replayed last
+	if bqr.config.Definitions {
+		definitionResults, err := bqr.restoreDefinitions(ctx, l, prefix, restored)
+		if err != nil {
+			return err
+		}
+		results = append(results, definitionResults...)
+	}
+	return summarizeTableResults(l, "restore", results, failedDatasets)
+}
+
+// findExport returns the first of the prefixes an export is stored below, along with the
+// exported datasets
+func (bqr *BigQueryRestore) findExport(ctx context.Context, prefixes []string) (string, []bigquerySchemataRow, error) {
+	for _, prefix := range prefixes {
+		var schemata []bigquerySchemataRow
+		found, err := readCompressedJSON(ctx, bqr.config.Storage, path.Join(prefix, "INFORMATION_SCHEMA.SCHEMATA.json.gz"), &schemata)
+		if err != nil {
+			return "", nil, err
+		}
+		if found {
+			return prefix, schemata, nil
+		}
+	}
+	return "", nil, fmt.Errorf("no bigquery export found for %q", strings.Join(prefixes, ", "))
+}
+
+// restoreDefinitions replays the definitions of all datasets; definitions depending on ones
+// not created yet are retried until a pass makes no progress
+func (bqr *BigQueryRestore) restoreDefinitions(ctx context.Context, l *slog.Logger, prefix string, datasets []bigquerySchemataRow) ([]BigQueryTableResult, error) {
+	type pendingDefinition struct {
+		datasetID string
+		row       bigqueryDefinitionRow
+		ddl       string
+		attempts  int
+		err       error
+	}
+	var pending []*pendingDefinition
+	for _, dataset := range datasets {
+		var rows []bigqueryDefinitionRow
+		found, err := readCompressedJSON(ctx, bqr.config.Storage, path.Join(prefix, dataset.SchemaName, bigqueryDefinitionsName), &rows)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			l.Info("Dataset export has no definitions, skipping", slog.String("dataset", dataset.SchemaName))
+			continue
+		}
+		for _, row := range rows {
+			pending = append(pending, &pendingDefinition{
+				datasetID: dataset.SchemaName,
+				row:       row,
+				ddl:       rewriteDefinitionDDL(row.DDL, dataset.CatalogName, bqr.targetIdentifier, bqr.config.Overwrite),
+			})
+		}
+	}
+	l.Info("Replaying definitions...", slog.Int("definitions", len(pending)))
+
+	var results []BigQueryTableResult
+	for len(pending) > 0 {
+		var failed []*pendingDefinition
+		for _, definition := range pending {
+			start := time.Now()
+			attempts, err := retryJob(ctx, l, bqr.config.MaxRetries, bqr.config.RetryBackoff, func() error {
+				return bqr.runQuery(ctx, definition.ddl)
+			})
+			definition.attempts += attempts
+			if err != nil {
+				definition.err = fmt.Errorf("failed to create %s %q: %w", strings.ToLower(definition.row.ObjectType), definition.row.ObjectName, err)
+				failed = append(failed, definition)
+				continue
+			}
+			results = append(results, BigQueryTableResult{
+				DatasetID: definition.datasetID,
+				TableID:   definition.row.ObjectName,
+				Attempts:  definition.attempts,
+				Duration:  time.Since(start),
+			})
+		}
+		if len(failed) == len(pending) {
+			break
+		}
+		pending = failed
+	}
+	for _, definition := range pending {
+		if definition.err == nil {
+			continue
+		}
+		results = append(results, BigQueryTableResult{
+			DatasetID: definition.datasetID,
+			TableID:   definition.row.ObjectName,
+			Attempts:  definition.attempts,
+			Err:       definition.err,
+		})
+	}
+	return results, nil
+}
+
+func (bqr *BigQueryRestore) restoreDataset(ctx context.Context, l *slog.Logger, prefix, datasetID string) ([]BigQueryTableResult, error) {
+	var tables []bigqueryTableSchemaRow
+	found, err := readCompressedJSON(ctx, bqr.config.Storage, path.Join(prefix, datasetID, "INFORMATION_SCHEMA.TABLES.json.gz"), &tables)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		l.Info("Dataset has not been exported, skipping")
+		return nil, nil
+	}
+
+	// Dumps written before the manifest existed are gzipped parquet only
+	var manifest BigQueryDatasetManifest
+	hasManifest, err := ReadState(ctx, bqr.config.Storage, path.Join(prefix, datasetID, bigqueryManifestName), &manifest)
+	if err != nil {
+		return nil, err
+	}
+	exported := map[string]BigQueryTableManifest{}
+	for _, table := range manifest.Tables {
+		exported[table.TableID] = table
+	}
+
+	targetDataset := bqr.targetDataset(datasetID)
+	if err := bqr.createDataset(ctx, targetDataset); err != nil {
+		return nil, err
+	}
+	l.Info("Starting restore...", slog.String("targetDataset", targetDataset))
+
+	var g errgroup.Group
+	g.SetLimit(bqr.config.Concurrency)
+	var mutex sync.Mutex
+	var results []BigQueryTableResult
+	for _, table := range tables {
+		if table.TableType != bigqueryTableTypeBase {
+			continue
+		}
+		source, ok := exported[table.TableName]
+		if !ok {
+			if hasManifest {
+				// excluded or failed during the export
+				continue
+			}
+			source, err = newBigQueryTableManifest(
+				table.TableName,
+				fmt.Sprintf("gs://%s/%s/%s/%s/*%s", bqr.config.BucketName, prefix, datasetID, table.TableName, bigqueryFormats[bigqueryDefaultFormat].extension),
+				bigqueryDefaultFormat,
+			)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		g.Go(func() error {
+			start := time.Now()
+			targetTable := bqr.targetTable(datasetID, table.TableName)
+			attempts, err := retryJob(ctx, l, bqr.config.MaxRetries, bqr.config.RetryBackoff, func() error {
+				return bqr.createTable(ctx, table, targetDataset, targetTable)
+			})
+			if err == nil {
+				var loadAttempts int
+				loadAttempts, err = bqr.loadTable(ctx, l, source, targetDataset, targetTable)
+				attempts = max(attempts, loadAttempts)
+			}
+			if err != nil {
+				err = fmt.Errorf("failed to restore table %q from URI %q: %w", table.TableName, source.URI, err)
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			results = append(results, BigQueryTableResult{
+				DatasetID: datasetID,
+				TableID:   table.TableName,
+				URI:       source.URI,
+				Format:    source.Format,
+				Attempts:  attempts,
+				Duration:  time.Since(start),
+				Err:       err,
+			})
+			return nil
+		})
+	}
+	_ = g.Wait()
+	return results, nil
+}
+
+// createTable recreates the table from its DDL
+func (bqr *BigQueryRestore) createTable(ctx context.Context, table bigqueryTableSchemaRow, targetDataset, targetTable string) error {
+	ddl, err := rewriteTableDDL(
+		table.DDL,
+		fmt.Sprintf("`%s.%s.%s`", table.TableCatalog, table.TableSchema, table.TableName),
+		fmt.Sprintf("`%s.%s.%s`", bqr.config.ProjectID, targetDataset, targetTable),
+		bqr.config.Overwrite,
+	)
+	if err != nil {
+		return err
+	}
+	if err := bqr.runQuery(ctx, ddl); err != nil {
+		return fmt.Errorf("failed to create table: %w", err)
+	}
+	return nil
+}
+
+// loadTable loads the exported files into the recreated, empty table; partitions exported on
+// their own are loaded one by one into their partition
+func (bqr *BigQueryRestore) loadTable(ctx context.Context, l *slog.Logger, source BigQueryTableManifest, targetDataset, targetTable string) (int, error) {
+	if len(source.Partitions) == 0 {
+		return retryJob(ctx, l, bqr.config.MaxRetries, bqr.config.RetryBackoff, func() error {
+			return bqr.load(ctx, source, source.URI, targetDataset, targetTable, bigquery.WriteAppend)
+		})
+	}
+
+	var attempts int
+	for _, partition := range source.Partitions {
+		// rows without partition value can not be addressed by a decorator, loads into
+		// the table put them into their partition anyway
+		tableID, disposition := partitionTableID(targetTable, partition.PartitionID), bigquery.WriteTruncate
+		if partition.PartitionID == bigqueryPartitionNull || partition.PartitionID == bigqueryPartitionUnpartitioned {
+			tableID, disposition = targetTable, bigquery.WriteAppend
+		}
+		partitionAttempts, err := retryJob(ctx, l, bqr.config.MaxRetries, bqr.config.RetryBackoff, func() error {
+			return bqr.load(ctx, source, partition.URI, targetDataset, tableID, disposition)
+		})
+		attempts = max(attempts, partitionAttempts)
+		if err != nil {
+			return attempts, fmt.Errorf("failed to load partition %s: %w", partition.PartitionID, err)
+		}
+	}
+	return attempts, nil
+}
+
+func (bqr *BigQueryRestore) load(ctx context.Context, source BigQueryTableManifest, uri, targetDataset, targetTable string, disposition bigquery.TableWriteDisposition) error {
+	uri, err := bqr.gcsURI(uri)
+	if err != nil {
+		return err
+	}
+	gcsRef := bigquery.NewGCSReference(uri)
+	gcsRef.SourceFormat = source.DestinationFormat
+	if source.UseAvroLogicalTypes {
+		gcsRef.AvroOptions = &bigquery.AvroOptions{UseAvroLogicalTypes: true}
+	}
+	loader := bqr.client.DatasetInProject(bqr.config.ProjectID, targetDataset).Table(targetTable).LoaderFrom(gcsRef)
+	loader.Location = bqr.config.GCSLocation
+	loader.CreateDisposition = bigquery.CreateNever
+	loader.WriteDisposition = disposition
+
+	job, err := loader.Run(ctx)
+	if err != nil {
+		return err
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
+
+// gcsURI resolves the URI of exported files against the bucket, exports staged into other
+// storage vendors have to be copied to a bucket first
+func (bqr *BigQueryRestore) gcsURI(uri string) (string, error) {
+	if strings.HasPrefix(uri, "gs://") {
+		return uri, nil
+	}
+	if !bqr.config.StorageGCS {
+		return "", fmt.Errorf("exported files %q are not stored in GCS, copy them to a bucket first", uri)
+	}
+	return fmt.Sprintf(bigqueryGCSURIPrefix, bqr.config.BucketName, uri), nil
+}
+
+func (bqr *BigQueryRestore) runQuery(ctx context.Context, query string) error {
+	return runQueryJob(ctx, bqr.client, bqr.config.GCSLocation, query)
+}
+
+func (bqr *BigQueryRestore) createDataset(ctx context.Context, datasetID string) error {
+	return createDataset(ctx, bqr.client, bqr.config.ProjectID, datasetID, bqr.config.GCSLocation)
+}
+
+// runQueryJob runs a statement like DDL to completion
+func runQueryJob(ctx context.Context, client *bigquery.Client, location, query string) error {
+	q := client.Query(query)
+	q.Location = location
+	job, err := q.Run(ctx)
+	if err != nil {
+		return err
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
+
+// createDataset creates the dataset unless it exists already
+func createDataset(ctx context.Context, client *bigquery.Client, projectID, datasetID, location string) error {
+	err := client.DatasetInProject(projectID, datasetID).Create(ctx, &bigquery.DatasetMetadata{
+		Location: location,
+	})
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create dataset %s: %w", datasetID, err)
+	}
+	return nil
+}
+
+// targetIdentifier returns the quoted target of the object of a source dataset
+func (bqr *BigQueryRestore) targetIdentifier(datasetID, name string) string {
+	return fmt.Sprintf("`%s.%s.%s`", bqr.config.ProjectID, bqr.targetDataset(datasetID), bqr.targetTable(datasetID, name))
+}
+
+func (bqr *BigQueryRestore) targetDataset(datasetID string) string {
+	if renamed, ok := bqr.config.Renames[datasetID]; ok {
+		return renamed
+	}
+	return datasetID
+}
+
+func (bqr *BigQueryRestore) targetTable(datasetID, tableID string) string {
+	if renamed, ok := bqr.config.Renames[datasetID+"."+tableID]; ok {
+		return renamed
+	}
+	return tableID
+}
+
+// ParseBigQueryRenames parses renames given as `source=target`
+func ParseBigQueryRenames(values []string) (map[string]string, error) {
+	renames := map[string]string{}
+	for _, value := range values {
+		source, target, ok := strings.Cut(value, "=")
+		if !ok || source == "" || target == "" {
+			return nil, fmt.Errorf("rename %q must be given as source=target", value)
+		}
+		renames[source] = target
+	}
+	return renames, nil
+}
+
+// rewriteTableDDL points the CREATE TABLE statement of INFORMATION_SCHEMA.TABLES to the target
+// table, keeping columns, partitioning, clustering and options
+func rewriteTableDDL(ddl, source, target string, overwrite bool) (string, error) {
+	statement, ok := strings.CutPrefix(ddl, "CREATE TABLE "+source)
+	if !ok {
+		return "", fmt.Errorf("unexpected table ddl %q", ddl)
+	}
+	if overwrite {
+		return "CREATE OR REPLACE TABLE " + target + statement, nil
+	}
+	return "CREATE TABLE " + target + statement, nil
+}
+
+// rewriteDefinitionDDL points all fully qualified identifiers of the source project to their
+// target; unqualified references within view queries or routine bodies are kept as they are
+func rewriteDefinitionDDL(ddl, sourceProject string, target func(datasetID, name string) string, overwrite bool) string {
+	ddl = bigqueryIdentifierRegex.ReplaceAllStringFunc(ddl, func(identifier string) string {
+		match := bigqueryIdentifierRegex.FindStringSubmatch(identifier)
+		if match[1] != sourceProject {
+			return identifier
+		}
+		return target(match[2], match[3])
+	})
+	if statement, ok := strings.CutPrefix(ddl, "CREATE "); ok && overwrite && !strings.HasPrefix(statement, "OR REPLACE ") {
+		return "CREATE OR REPLACE " + statement
+	}
+	return ddl
+}
+
+// readCompressedJSON decodes a JSON object written by storeQueryResultAsGzippedJSON, the codec is
+// picked by the extension of the path
+func readCompressedJSON(ctx context.Context, s Storage, storagePath string, v any) (found bool, err error) {
+	reader, err := s.NewReader(ctx, storagePath)
+	if errors.Is(err, storage.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to open %q: %w", storagePath, err)
+	}
+	defer reader.Close()
+
+	decompressed, err := compression.NewReader(reader, compression.FromPath(storagePath))
+	if err != nil {
+		return false, fmt.Errorf("failed to decompress %q: %w", storagePath, err)
+	}
+	defer decompressed.Close()
+	if err := json.NewDecoder(decompressed).Decode(v); err != nil {
+		return false, fmt.Errorf("failed to decode %q: %w", storagePath, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,170 @@
+package export
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/iterator"
+)
+
+const bigquerySnapshotDDL = "CREATE SNAPSHOT TABLE `%s.%s.%s` CLONE `%s.%s.%s`"
+
+var bigquerySnapshotNameRegex = regexp.MustCompile(`^(.+)__(\d{8}T\d{6})$`)
+
+// snapshotName names the snapshot of a table `<dataset>__<table>__<timestamp>`
+func snapshotName(datasetID, tableID string, ts time.Time) string {
+	return fmt.Sprintf("%s__%s__%s", datasetID, tableID, ts.Format(TimestampFormat))
+}
+
+// Snapshot creates table snapshots of all selected tables in the snapshot dataset instead of
+// extracting them, and prunes the oldest snapshots of each table beyond the retention count
+func (bqe *BigQueryDatasetExport) Snapshot(ctx context.Context, l *slog.Logger) (string, error) {
+	if l == nil {
+		l = slog.Default()
+	}
+	if bqe.config.SnapshotDataset == "" {
+		return "", errors.New("snapshots require a snapshot dataset")
+	}
+	ts := time.Now()
+	if err := createDataset(ctx, bqe.client, bqe.config.ProjectID, bqe.config.SnapshotDataset, bqe.config.GCSLocation); err != nil {
+		return "", err
+	}
+
+	var tables []*bigquery.Table
+	datasetIterator := bqe.client.Datasets(ctx)
+	for {
+		dataset, err := datasetIterator.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to iterate datasets: %w", err)
+		}
+		if dataset.DatasetID == bqe.config.SnapshotDataset {
+			continue
+		}
+		tableIterator := dataset.Tables(ctx)
+		for {
+			t, err := tableIterator.Next()
+			if errors.Is(err, iterator.Done) {
+				break
+			}
+			if err != nil {
+				return "", fmt.Errorf("failed to iterate dataset %s: %w", dataset.DatasetID, err)
+			}
+			md, err := bqe.selectTable(ctx, t, bigquery.BasicMetadataView)
+			if err != nil {
+				return "", err
+			}
+			if md != nil {
+				tables = append(tables, t)
+			}
+		}
+	}
+	l.Info("Creating snapshots...", slog.String("snapshotDataset", bqe.config.SnapshotDataset), slog.Int("tables", len(tables)))
+
+	var g errgroup.Group
+	g.SetLimit(bqe.config.Concurrency)
+	results := make([]BigQueryTableResult, len(tables))
+	for i, table := range tables {
+		g.Go(func() error {
+			start := time.Now()
+			name := snapshotName(table.DatasetID, table.TableID, ts)
+			ddl := fmt.Sprintf(bigquerySnapshotDDL, bqe.config.ProjectID, bqe.config.SnapshotDataset, name, table.ProjectID, table.DatasetID, table.TableID)
+			if bqe.config.SnapshotExpiration > 0 {
+				ddl += fmt.Sprintf(" OPTIONS(expiration_timestamp = TIMESTAMP_ADD(CURRENT_TIMESTAMP(), INTERVAL %d SECOND))", int64(bqe.config.SnapshotExpiration.Seconds()))
+			}
+			attempts, err := retryJob(ctx, l, bqe.config.MaxRetries, bqe.config.RetryBackoff, func() error {
+				return runQueryJob(ctx, bqe.client, bqe.config.GCSLocation, ddl)
+			})
+			if err != nil {
+				err = fmt.Errorf("failed to snapshot table %q: %w", table.TableID, err)
+			}
+			results[i] = BigQueryTableResult{
+				DatasetID: table.DatasetID,
+				TableID:   table.TableID,
+				URI:       fmt.Sprintf("%s.%s.%s", bqe.config.ProjectID, bqe.config.SnapshotDataset, name),
+				Attempts:  attempts,
+				Duration:  time.Since(start),
+				Err:       err,
+			}
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	if bqe.config.SnapshotRetention > 0 {
+		if err := bqe.pruneSnapshots(ctx, l); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%s.%s", bqe.config.ProjectID, bqe.config.SnapshotDataset), summarizeTableResults(l, "snapshot", results, nil)
+}
+
+func (bqe *BigQueryDatasetExport) pruneSnapshots(ctx context.Context, l *slog.Logger) error {
+	var snapshots []string
+	it := bqe.client.DatasetInProject(bqe.config.ProjectID, bqe.config.SnapshotDataset).Tables(ctx)
+	for {
+		t, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to iterate snapshots: %w", err)
+		}
+		snapshots = append(snapshots, t.TableID)
+	}
+
+	var mutex sync.Mutex
+	var errs []error
+	var g errgroup.Group
+	g.SetLimit(bqe.config.Concurrency)
+	for _, name := range snapshotsToPrune(snapshots, bqe.config.SnapshotRetention) {
+		g.Go(func() error {
+			err := bqe.client.DatasetInProject(bqe.config.ProjectID, bqe.config.SnapshotDataset).Table(name).Delete(ctx)
+			if err != nil {
+				mutex.Lock()
+				defer mutex.Unlock()
+				errs = append(errs, fmt.Errorf("failed to delete snapshot %s: %w", name, err))
+				return nil
+			}
+			l.Info("Pruned snapshot", slog.String("snapshot", name))
+			return nil
+		})
+	}
+	_ = g.Wait()
+	return errors.Join(errs...)
+}
+
+// snapshotsToPrune returns the snapshots beyond the newest retention snapshots of each table,
+// tables not named by snapshotName are ignored
+func snapshotsToPrune(names []string, retention int) []string {
+	byTable := map[string][]string{}
+	for _, name := range names {
+		match := bigquerySnapshotNameRegex.FindStringSubmatch(name)
+		if match == nil {
+			continue
+		}
+		byTable[match[1]] = append(byTable[match[1]], name)
+	}
+
+	var prune []string
+	for _, snapshots := range byTable {
+		// the timestamp suffix sorts chronologically
+		slices.Sort(snapshots)
+		slices.Reverse(snapshots)
+		if len(snapshots) > retention {
+			prune = append(prune, snapshots[retention:]...)
+		}
+	}
+	slices.Sort(prune)
+	return prune
+}
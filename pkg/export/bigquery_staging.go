@@ -0,0 +1,116 @@
+package export
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	gcs "cloud.google.com/go/storage"
+	"github.com/foomo/dump-buckets/pkg/storage"
+	"google.golang.org/api/iterator"
+)
+
+const bigqueryDefaultStagingPrefix = "staging"
+
+// stagingURIPrefix is the URI the extract jobs write to, which is a temporary prefix of the
+// staging bucket if staging is configured
+func (bqe *BigQueryDatasetExport) stagingURIPrefix(prefix string) string {
+	if bqe.staging == nil {
+		return fmt.Sprintf(bigqueryGCSURIPrefix, bqe.config.BucketName, prefix)
+	}
+	return fmt.Sprintf(bigqueryGCSURIPrefix, bqe.config.StagingBucketName, path.Join(bqe.config.StagingPrefix, prefix))
+}
+
+// stagedPath maps a staging URI to the path the files are copied to in Storage
+func (bqe *BigQueryDatasetExport) stagedPath(uri string) string {
+	if bqe.staging == nil {
+		return uri
+	}
+	return strings.TrimPrefix(uri, fmt.Sprintf(bigqueryGCSURIPrefix+"/", bqe.config.StagingBucketName, bqe.config.StagingPrefix))
+}
+
+// exportedURI maps a staging URI to the URI recorded in the manifest, which is the gs:// URI
+// of the copied files if Storage is the bucket and their Storage path otherwise
+func (bqe *BigQueryDatasetExport) exportedURI(uri string) string {
+	if bqe.staging == nil || !bqe.config.StorageGCS {
+		return bqe.stagedPath(uri)
+	}
+	return fmt.Sprintf(bigqueryGCSURIPrefix, bqe.config.BucketName, bqe.stagedPath(uri))
+}
+
+// unstage copies all files extracted to the wildcard URI through Storage and deletes them
+// from the staging bucket, returning the wildcard path and the paths of the copied files
+func (bqe *BigQueryDatasetExport) unstage(ctx context.Context, uri string) (string, []string, error) {
+	if bqe.staging == nil {
+		return uri, nil, nil
+	}
+	bucket := bqe.staging.Bucket(bqe.config.StagingBucketName)
+	prefix := path.Dir(strings.TrimPrefix(uri, fmt.Sprintf("gs://%s/", bqe.config.StagingBucketName))) + "/"
+	it := bucket.Objects(ctx, &gcs.Query{Prefix: prefix})
+	var paths []string
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to list staged files: %w", err)
+		}
+		target := bqe.stagedPath(fmt.Sprintf("gs://%s/%s", bqe.config.StagingBucketName, attrs.Name))
+		if err := bqe.copyStaged(ctx, bucket.Object(attrs.Name), target, attrs.ContentType); err != nil {
+			return "", nil, fmt.Errorf("failed to copy staged file %s: %w", attrs.Name, err)
+		}
+		paths = append(paths, target)
+		if err := bucket.Object(attrs.Name).Delete(ctx); err != nil {
+			return "", nil, fmt.Errorf("failed to delete staged file %s: %w", attrs.Name, err)
+		}
+	}
+	return bqe.exportedURI(uri), paths, nil
+}
+
+func (bqe *BigQueryDatasetExport) copyStaged(ctx context.Context, object *gcs.ObjectHandle, target, contentType string) error {
+	reader, err := object.ReadCompressed(true).NewReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	var opts []storage.WriterOption
+	if contentType != "" {
+		opts = append(opts, storage.WithContentType(contentType))
+	}
+	writer, err := bqe.config.Storage.NewWriter(ctx, target, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to initialize writer: %w", err)
+	}
+	if _, err := io.Copy(writer, reader); err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+// cleanupStaging deletes whatever is left in the staging prefix of the export, e.g. files of
+// failed copies
+func (bqe *BigQueryDatasetExport) cleanupStaging(ctx context.Context, prefix string) error {
+	if bqe.staging == nil {
+		return nil
+	}
+	bucket := bqe.staging.Bucket(bqe.config.StagingBucketName)
+	it := bucket.Objects(ctx, &gcs.Query{Prefix: path.Join(bqe.config.StagingPrefix, prefix) + "/"})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to list staged files: %w", err)
+		}
+		if err := bucket.Object(attrs.Name).Delete(ctx); err != nil && !errors.Is(err, gcs.ErrObjectNotExist) {
+			return fmt.Errorf("failed to delete staged file %s: %w", attrs.Name, err)
+		}
+	}
+}
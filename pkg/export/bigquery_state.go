@@ -0,0 +1,83 @@
+package export
+
+import (
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+const bigqueryDefaultStatePath = "bigquery-export.state.json"
+
+// BigQueryExportState tracks the last successful export of every table, so unchanged
+// tables are not extracted again
+type BigQueryExportState struct {
+	UpdatedAt time.Time                     `json:"updatedAt"`
+	Tables    map[string]BigQueryTableState `json:"tables"` // keyed by dataset.table
+}
+
+type BigQueryTableState struct {
+	LastModified time.Time             `json:"lastModified"`
+	ExportedAt   time.Time             `json:"exportedAt"`
+	Export       BigQueryTableManifest `json:"export"`
+}
+
+// unchanged returns the previous export of the table if the table has not been modified
+// since and is still exported in the same format
+func (s *BigQueryExportState) unchanged(t *bigquery.Table, lastModified time.Time, format BigQueryExportFormat) (BigQueryTableManifest, bool) {
+	if s == nil || lastModified.IsZero() {
+		return BigQueryTableManifest{}, false
+	}
+	previous, ok := s.Tables[t.DatasetID+"."+t.TableID]
+	if !ok || !previous.LastModified.Equal(lastModified) || previous.Export.Format != format {
+		return BigQueryTableManifest{}, false
+	}
+	return previous.Export, true
+}
+
+// previousPartitions returns the partitions of the previous export of the table if it was
+// exported in the same format
+func (s *BigQueryExportState) previousPartitions(t *bigquery.Table, format BigQueryExportFormat) []BigQueryPartitionManifest {
+	if s == nil {
+		return nil
+	}
+	previous, ok := s.Tables[t.DatasetID+"."+t.TableID]
+	if !ok || previous.Export.Format != format {
+		return nil
+	}
+	return previous.Export.Partitions
+}
+
+// next returns the state after the run, failed tables keep their previous state while the
+// exported partitions of partially failed tables are kept
+func (s *BigQueryExportState) next(results []BigQueryTableResult) *BigQueryExportState {
+	next := &BigQueryExportState{
+		UpdatedAt: time.Now(),
+		Tables:    map[string]BigQueryTableState{},
+	}
+	if s != nil {
+		for key, table := range s.Tables {
+			next.Tables[key] = table
+		}
+	}
+	for _, result := range results {
+		if result.Unchanged || (result.Err != nil && len(result.Partitions) == 0) {
+			continue
+		}
+		export, err := newBigQueryTableManifest(result.TableID, result.URI, result.Format)
+		if err != nil {
+			continue
+		}
+		export.Partitions = result.Partitions
+		lastModified := result.LastModified
+		if result.Err != nil {
+			// the table is not skipped by ChangedOnly until all partitions have been exported
+			lastModified = time.Time{}
+		}
+		next.Tables[result.DatasetID+"."+result.TableID] = BigQueryTableState{
+			LastModified: lastModified,
+			ExportedAt:   next.UpdatedAt,
+			Export:       export,
+		}
+	}
+	return next
+}
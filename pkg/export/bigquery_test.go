@@ -1,13 +1,20 @@
 package export
 
 import (
+	"compress/gzip"
 	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
 	"testing"
 	"time"
 
 	"cloud.google.com/go/bigquery"
+	gcs "cloud.google.com/go/storage"
 	"github.com/foomo/dump-buckets/pkg/storage"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/api/googleapi"
 )
 
 func Test_Export(t *testing.T) {
@@ -110,3 +117,346 @@ func TestIsTableExcluded(t *testing.T) {
 		})
 	}
 }
+
+func TestIsRetryableJobError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "rate limit", err: &bigquery.Error{Reason: "rateLimitExceeded"}, want: true},
+		{name: "backend error wrapped", err: fmt.Errorf("job failed: %w", &bigquery.Error{Reason: "backendError"}), want: true},
+		{name: "invalid query", err: &bigquery.Error{Reason: "invalid"}, want: false},
+		{name: "api too many requests", err: &googleapi.Error{Code: http.StatusTooManyRequests}, want: true},
+		{name: "api unavailable", err: &googleapi.Error{Code: http.StatusServiceUnavailable}, want: true},
+		{name: "api quota reason", err: &googleapi.Error{Code: http.StatusForbidden, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}, want: true},
+		{name: "api not found", err: &googleapi.Error{Code: http.StatusNotFound}, want: false},
+		{name: "other", err: errors.New("boom"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, isRetryableJobError(tt.err))
+		})
+	}
+}
+
+func TestRetryJob(t *testing.T) {
+	retryable := &bigquery.Error{Reason: "backendError"}
+	tests := []struct {
+		name         string
+		errs         []error
+		maxRetries   int
+		wantAttempts int
+		wantErr      bool
+	}{
+		{name: "success", errs: []error{nil}, maxRetries: 3, wantAttempts: 1},
+		{name: "success after retries", errs: []error{retryable, retryable, nil}, maxRetries: 3, wantAttempts: 3},
+		{name: "retries exhausted", errs: []error{retryable, retryable, retryable}, maxRetries: 2, wantAttempts: 3, wantErr: true},
+		{name: "not retryable", errs: []error{errors.New("invalid"), nil}, maxRetries: 3, wantAttempts: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			attempts, err := retryJob(context.Background(), slog.Default(), tt.maxRetries, time.Millisecond, func() error {
+				err := tt.errs[calls]
+				calls++
+				return err
+			})
+			require.Equal(t, tt.wantAttempts, attempts)
+			require.Equal(t, tt.wantAttempts, calls)
+			require.Equal(t, tt.wantErr, err != nil)
+		})
+	}
+}
+
+func TestTableFormat(t *testing.T) {
+	rules, err := ParseBigQueryFormatRules([]string{"SAS.GPredictiveScore=json-gzip", "SAS.*=avro"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		table *bigquery.Table
+		want  BigQueryExportFormat
+	}{
+		{name: "table rule", table: &bigquery.Table{DatasetID: "SAS", TableID: "GPredictiveScore"}, want: BigQueryFormatJSONGzip},
+		{name: "dataset rule", table: &bigquery.Table{DatasetID: "SAS", TableID: "Other"}, want: BigQueryFormatAvro},
+		{name: "default", table: &bigquery.Table{DatasetID: "Sales", TableID: "Orders"}, want: BigQueryFormatParquetZSTD},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tableFormat(tt.table, rules, BigQueryFormatParquetZSTD)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err = ParseBigQueryFormatRules([]string{"avro"})
+	require.Error(t, err)
+}
+
+func TestRewriteTableDDL(t *testing.T) {
+	ddl := "CREATE TABLE `source.sales.orders`\n(\n  id INT64\n)\nPARTITION BY DATE(created_at)\nCLUSTER BY id;"
+	tests := []struct {
+		name      string
+		ddl       string
+		overwrite bool
+		want      string
+		wantErr   bool
+	}{
+		{
+			name: "create",
+			ddl:  ddl,
+			want: "CREATE TABLE `target.archive.orders_restored`\n(\n  id INT64\n)\nPARTITION BY DATE(created_at)\nCLUSTER BY id;",
+		},
+		{
+			name:      "replace",
+			ddl:       ddl,
+			overwrite: true,
+			want:      "CREATE OR REPLACE TABLE `target.archive.orders_restored`\n(\n  id INT64\n)\nPARTITION BY DATE(created_at)\nCLUSTER BY id;",
+		},
+		{
+			name:    "other table",
+			ddl:     "CREATE TABLE `source.sales.items`\n(\n  id INT64\n);",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := rewriteTableDDL(tt.ddl, "`source.sales.orders`", "`target.archive.orders_restored`", tt.overwrite)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestBigQueryRestore_Targets(t *testing.T) {
+	renames, err := ParseBigQueryRenames([]string{"sales=sales_restored", "sales.orders=orders_v1"})
+	require.NoError(t, err)
+	bqr := &BigQueryRestore{config: BigQueryRestoreConfig{Renames: renames}}
+
+	require.Equal(t, "sales_restored", bqr.targetDataset("sales"))
+	require.Equal(t, "marketing", bqr.targetDataset("marketing"))
+	require.Equal(t, "orders_v1", bqr.targetTable("sales", "orders"))
+	require.Equal(t, "items", bqr.targetTable("sales", "items"))
+
+	_, err = ParseBigQueryRenames([]string{"sales="})
+	require.Error(t, err)
+}
+
+func TestBigQueryRestore_findExport(t *testing.T) {
+	ctx := context.Background()
+	fs, err := storage.NewFSStorage(ctx, t.TempDir())
+	require.NoError(t, err)
+	bqr := &BigQueryRestore{config: BigQueryRestoreConfig{Storage: fs}}
+
+	// dumps written before the name template prefix are stored below the bare timestamp
+	writer, err := fs.NewWriter(ctx, "20240101T000000/INFORMATION_SCHEMA.SCHEMATA.json.gz")
+	require.NoError(t, err)
+	gzw := gzip.NewWriter(writer)
+	_, err = gzw.Write([]byte(`[{"catalog_name":"project","schema_name":"sales"}]`))
+	require.NoError(t, err)
+	require.NoError(t, gzw.Close())
+	require.NoError(t, writer.Close())
+
+	prefix, schemata, err := bqr.findExport(ctx, []string{"backup/bigquery-20240101T000000", "20240101T000000"})
+	require.NoError(t, err)
+	require.Equal(t, "20240101T000000", prefix)
+	require.Equal(t, []bigquerySchemataRow{{CatalogName: "project", SchemaName: "sales"}}, schemata)
+
+	_, _, err = bqr.findExport(ctx, []string{"backup/bigquery-20240102T000000", "20240102T000000"})
+	require.Error(t, err)
+}
+
+func TestIsTableIncluded(t *testing.T) {
+	tests := []struct {
+		name     string
+		table    *bigquery.Table
+		patterns []string
+		want     bool
+	}{
+		{name: "no patterns", table: &bigquery.Table{DatasetID: "SAS", TableID: "Orders"}, patterns: []string{""}, want: true},
+		{name: "dataset match", table: &bigquery.Table{DatasetID: "SAS", TableID: "Orders"}, patterns: []string{"SAS.*"}, want: true},
+		{name: "no match", table: &bigquery.Table{DatasetID: "Sales", TableID: "Orders"}, patterns: []string{"SAS.*"}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := isTableIncluded(tt.table, tt.patterns)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestHasLabels(t *testing.T) {
+	labels := map[string]string{"env": "prod", "team": "data"}
+	require.True(t, hasLabels(labels, nil))
+	require.True(t, hasLabels(labels, ParseBigQueryLabels([]string{"env=prod", "team"})))
+	require.False(t, hasLabels(labels, ParseBigQueryLabels([]string{"env=dev"})))
+	require.False(t, hasLabels(labels, ParseBigQueryLabels([]string{"backup"})))
+}
+
+func TestBigQueryExportState(t *testing.T) {
+	modified := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	table := &bigquery.Table{DatasetID: "sales", TableID: "orders"}
+
+	var state *BigQueryExportState
+	_, ok := state.unchanged(table, modified, BigQueryFormatAvro)
+	require.False(t, ok)
+
+	state = state.next([]BigQueryTableResult{
+		{DatasetID: "sales", TableID: "orders", URI: "gs://bucket/1/sales/orders/*.avro", Format: BigQueryFormatAvro, LastModified: modified},
+		{DatasetID: "sales", TableID: "items", URI: "gs://bucket/1/sales/items/*.avro", Format: BigQueryFormatAvro, LastModified: modified, Err: errors.New("failed")},
+	})
+	require.Len(t, state.Tables, 1)
+
+	previous, ok := state.unchanged(table, modified, BigQueryFormatAvro)
+	require.True(t, ok)
+	require.Equal(t, "gs://bucket/1/sales/orders/*.avro", previous.URI)
+
+	_, ok = state.unchanged(table, modified.Add(time.Hour), BigQueryFormatAvro)
+	require.False(t, ok)
+	_, ok = state.unchanged(table, modified, BigQueryFormatJSON)
+	require.False(t, ok)
+
+	// partially failed tables keep their exported partitions but are not considered unchanged
+	partitions := []BigQueryPartitionManifest{{PartitionID: "20240101", URI: "gs://bucket/2/sales/items/20240101/*.avro", LastModified: modified}}
+	partial := state.next([]BigQueryTableResult{
+		{DatasetID: "sales", TableID: "items", Format: BigQueryFormatAvro, LastModified: modified, Partitions: partitions, Err: errors.New("failed")},
+	})
+	require.Equal(t, partitions, partial.previousPartitions(&bigquery.Table{DatasetID: "sales", TableID: "items"}, BigQueryFormatAvro))
+	require.Nil(t, partial.previousPartitions(&bigquery.Table{DatasetID: "sales", TableID: "items"}, BigQueryFormatJSON))
+	_, ok = partial.unchanged(&bigquery.Table{DatasetID: "sales", TableID: "items"}, modified, BigQueryFormatAvro)
+	require.False(t, ok)
+
+	// unchanged tables keep the state of their last export
+	next := state.next([]BigQueryTableResult{{DatasetID: "sales", TableID: "orders", URI: previous.URI, Format: BigQueryFormatAvro, LastModified: modified, Unchanged: true}})
+	require.Equal(t, state.Tables, next.Tables)
+}
+
+func TestRewriteDefinitionDDL(t *testing.T) {
+	bqr := &BigQueryRestore{config: BigQueryRestoreConfig{
+		ProjectID: "target",
+		Renames:   map[string]string{"sales": "sales_restored", "sales.orders": "orders_v1"},
+	}}
+	tests := []struct {
+		name      string
+		ddl       string
+		overwrite bool
+		want      string
+	}{
+		{
+			name: "view",
+			ddl:  "CREATE VIEW `source.sales.daily`\nAS SELECT * FROM `source.sales.orders` JOIN `source.shop.items` USING (id);",
+			want: "CREATE VIEW `target.sales_restored.daily`\nAS SELECT * FROM `target.sales_restored.orders_v1` JOIN `target.shop.items` USING (id);",
+		},
+		{
+			name:      "routine replaced",
+			ddl:       "CREATE FUNCTION `source.sales.net`(x FLOAT64) AS (x / 1.077);",
+			overwrite: true,
+			want:      "CREATE OR REPLACE FUNCTION `target.sales_restored.net`(x FLOAT64) AS (x / 1.077);",
+		},
+		{
+			name: "other project",
+			ddl:  "CREATE VIEW `source.sales.public`\nAS SELECT * FROM `bigquery-public-data.samples.shakespeare`;",
+			want: "CREATE VIEW `target.sales_restored.public`\nAS SELECT * FROM `bigquery-public-data.samples.shakespeare`;",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, rewriteDefinitionDDL(tt.ddl, "source", bqr.targetIdentifier, tt.overwrite))
+		})
+	}
+}
+
+func TestPlanPartitions(t *testing.T) {
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	current := []bigqueryPartitionRow{
+		{PartitionID: "20240101", LastModifiedTime: day},
+		{PartitionID: "20240102", LastModifiedTime: day.Add(48 * time.Hour)},
+		{PartitionID: "20240103", LastModifiedTime: day.Add(48 * time.Hour)},
+	}
+	previous := []BigQueryPartitionManifest{
+		{PartitionID: "20231231", URI: "gs://bucket/1/sales/orders/20231231/*.avro", LastModified: day},
+		{PartitionID: "20240101", URI: "gs://bucket/1/sales/orders/20240101/*.avro", LastModified: day},
+		{PartitionID: "20240102", URI: "gs://bucket/1/sales/orders/20240102/*.avro", LastModified: day.Add(24 * time.Hour)},
+	}
+
+	require.Equal(t, []BigQueryPartitionManifest{
+		{PartitionID: "20240101", URI: "gs://bucket/1/sales/orders/20240101/*.avro", LastModified: day},
+		{PartitionID: "20240102", LastModified: day.Add(48 * time.Hour)},
+		{PartitionID: "20240103", LastModified: day.Add(48 * time.Hour)},
+	}, planPartitions(current, previous))
+	require.Equal(t, "orders$20240101", partitionTableID("orders", "20240101"))
+}
+
+func TestBigQueryDatasetExport_Staging(t *testing.T) {
+	direct := &BigQueryDatasetExport{config: BigQueryDatasetExportConfig{BucketName: "backups"}}
+	require.Equal(t, "gs://backups/20240101T000000", direct.stagingURIPrefix("20240101T000000"))
+	require.Equal(t, "gs://backups/20240101T000000/sales/orders/*.avro", direct.exportedURI("gs://backups/20240101T000000/sales/orders/*.avro"))
+
+	staged := &BigQueryDatasetExport{
+		config:  BigQueryDatasetExportConfig{BucketName: "/mnt/backups", StagingBucketName: "scratch", StagingPrefix: "staging"},
+		staging: &gcs.Client{},
+	}
+	require.Equal(t, "gs://scratch/staging/20240101T000000", staged.stagingURIPrefix("20240101T000000"))
+	require.Equal(t, "20240101T000000/sales/orders/*.avro", staged.exportedURI("gs://scratch/staging/20240101T000000/sales/orders/*.avro"))
+	require.Equal(t, "20240101T000000", staged.stagedPath(staged.stagingURIPrefix("20240101T000000")))
+
+	// staged in the storage bucket itself, e.g. with replicas
+	staged.config.BucketName, staged.config.StagingBucketName, staged.config.StorageGCS = "backups", "backups", true
+	require.Equal(t, "gs://backups/20240101T000000/sales/orders/*.avro", staged.exportedURI("gs://backups/staging/20240101T000000/sales/orders/*.avro"))
+	require.Equal(t, "20240101T000000/sales/orders/*.avro", staged.stagedPath("gs://backups/staging/20240101T000000/sales/orders/*.avro"))
+}
+
+func TestBigQueryRestore_stagedExport(t *testing.T) {
+	ctx := context.Background()
+	fs, err := storage.NewFSStorage(ctx, t.TempDir())
+	require.NoError(t, err)
+
+	bqe := &BigQueryDatasetExport{
+		config:  BigQueryDatasetExportConfig{BucketName: "backups", Storage: fs, StagingBucketName: "backups", StagingPrefix: "staging", StorageGCS: true},
+		staging: &gcs.Client{},
+	}
+	uri := bqe.stagingURIPrefix("backup/bigquery-20240101T000000") + "/sales/orders/*.avro"
+	manifestPath := "backup/bigquery-20240101T000000/sales/" + bigqueryManifestName
+	require.NoError(t, bqe.storeManifest(ctx, manifestPath, &bigquery.Dataset{ProjectID: "project", DatasetID: "sales"}, []BigQueryTableResult{
+		{DatasetID: "sales", TableID: "orders", URI: bqe.exportedURI(uri), Format: BigQueryFormatAvro},
+	}))
+
+	bqr := &BigQueryRestore{config: BigQueryRestoreConfig{BucketName: "backups", Storage: fs, StorageGCS: true}}
+	var manifest BigQueryDatasetManifest
+	found, err := ReadState(ctx, fs, manifestPath, &manifest)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Len(t, manifest.Tables, 1)
+	got, err := bqr.gcsURI(manifest.Tables[0].URI)
+	require.NoError(t, err)
+	require.Equal(t, "gs://backups/backup/bigquery-20240101T000000/sales/orders/*.avro", got)
+
+	// manifests of earlier staged exports record storage paths
+	got, err = bqr.gcsURI("backup/bigquery-20240101T000000/sales/orders/*.avro")
+	require.NoError(t, err)
+	require.Equal(t, "gs://backups/backup/bigquery-20240101T000000/sales/orders/*.avro", got)
+
+	bqr.config.StorageGCS = false
+	_, err = bqr.gcsURI("backup/bigquery-20240101T000000/sales/orders/*.avro")
+	require.Error(t, err)
+}
+
+func TestSnapshotsToPrune(t *testing.T) {
+	ts := time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)
+	names := []string{
+		snapshotName("sales", "orders", ts),
+		snapshotName("sales", "orders", ts.Add(-24*time.Hour)),
+		snapshotName("sales", "orders", ts.Add(-48*time.Hour)),
+		snapshotName("sales", "items", ts.Add(-48*time.Hour)),
+		"manual_copy",
+	}
+	require.Equal(t, "sales__orders__20240103T000000", names[0])
+	require.Equal(t, []string{"sales__orders__20240101T000000"}, snapshotsToPrune(names, 2))
+	require.Empty(t, snapshotsToPrune(names, 3))
+}
@@ -1,6 +1,7 @@
 package bitbucket
 
 import (
+	"archive/tar"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -10,10 +11,20 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
+	"github.com/foomo/dump-buckets/pkg/compression"
 	"github.com/foomo/dump-buckets/pkg/export"
 	"github.com/go-git/go-git/v5"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	defaultConcurrency = 4
+	apiTimeout         = 60 * time.Second
 )
 
 var (
@@ -24,24 +35,89 @@ var (
 type Exporter struct {
 	config     Config
 	httpClient *http.Client
+	// downloadClient has no overall timeout as downloads may take longer than any API request,
+	// they are bounded by the context and the response header timeout
+	downloadClient *http.Client
 }
 
 func NewExporter(_ context.Context, config Config) (*Exporter, error) {
+	if config.Concurrency <= 0 {
+		config.Concurrency = defaultConcurrency
+	}
+	if config.CloneProtocol == "" {
+		config.CloneProtocol = CloneProtocolHTTPS
+	}
+	if config.CloneProtocol != CloneProtocolHTTPS && config.CloneProtocol != CloneProtocolSSH {
+		return nil, fmt.Errorf("clone protocol %q not supported", config.CloneProtocol)
+	}
+	if config.CloneProtocol == CloneProtocolSSH && config.SSHKeyPath == "" {
+		return nil, fmt.Errorf("ssh cloning requires a private key path")
+	}
+	if config.ServerURL != "" && (!config.UpdatedAfter.IsZero() || config.UpdatedSinceLastRun || config.MaxSize > 0) {
+		return nil, fmt.Errorf("filtering by update time or size is only supported for bitbucket cloud")
+	}
+	if err := validateCollectors(config.Collectors); err != nil {
+		return nil, err
+	}
+	if config.ServerURL != "" && len(config.Collectors) > 0 {
+		return nil, fmt.Errorf("metadata collectors are only supported for bitbucket cloud")
+	}
+	if config.UpdatedSinceLastRun && (config.Storage == nil || config.StatePath == "") {
+		return nil, fmt.Errorf("selecting repositories updated since the last run requires a storage and state path")
+	}
+	if config.Compression.Codec == "" {
+		config.Compression.Codec = compression.Gzip
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = apiTimeout
 	return &Exporter{
 		config: config,
 		httpClient: &http.Client{
-			Timeout: 60 * time.Second,
+			Timeout: apiTimeout,
+		},
+		downloadClient: &http.Client{
+			Transport: transport,
 		},
 	}, nil
 }
 
 type Config struct {
 	AccountName string // GlobusDigital
-	Token       string
+	Token       string // Cloud access token or Server / Data Center HTTP access token
+	Concurrency int    // Number of repositories cloned in parallel, defaults to 4
+
+	ServerURL      string // Base URL of a Bitbucket Server / Data Center instance, bitbucket.org if empty
+	CloneProtocol  string // https (default) or ssh
+	SSHKeyPath     string // Private key used for ssh cloning
+	SSHKeyPassword string
+	SSHKnownHosts  string // known_hosts file verifying the host keys, SSH_KNOWN_HOSTS or ~/.ssh/known_hosts if empty
+
+	IncludePatterns []string  // Glob patterns on the repository slug, all repositories if empty
+	ExcludePatterns []string  // Glob patterns on the repository slug, applied after includes
+	ProjectKeys     []string  // Only repositories of these projects, all projects if empty
+	UpdatedAfter    time.Time // Skip repositories not updated since, disabled if zero
+	MaxSize         int       // Skip repositories larger than this many bytes, disabled if zero
+
+	// Skip repositories not updated since the start of the last successful run recorded at StatePath
+	UpdatedSinceLastRun bool
+	StatePath           string
+
+	Collectors []string // Metadata collectors archived next to each mirror, e.g. pullrequests, hooks
+
+	// Incremental bundle backups, see ExportBundles
+	Storage         export.Storage
+	BundlePath      string // Storage prefix of the bundles and their state
+	FullBundleEvery int    // Create a full bundle every N runs, only the first run if zero
+
+	Compression compression.Config // Compression of the archive, defaults to gzip
 }
 
+// Export clones all repositories of the account as mirrors and streams them into a
+// compressed tar archive; each clone is appended to the archive as soon as it completes
+// and removed from disk afterwards, so only the in-flight clones occupy disk space
 func (e *Exporter) Export(ctx context.Context, l *slog.Logger, writer io.Writer) error {
-	l.Info("Starting bitbucket account export")
+	l.Info("Starting bitbucket account export", slog.Int("concurrency", e.config.Concurrency))
+	start := time.Now()
 
 	tdir, err := os.MkdirTemp("", "")
 	if err != nil {
@@ -49,42 +125,166 @@ func (e *Exporter) Export(ctx context.Context, l *slog.Logger, writer io.Writer)
 	}
 	defer os.RemoveAll(tdir)
 
-	repos, err := e.fetchAllRepositories(ctx)
+	repos, err := e.selectRepositories(ctx, l)
+	if err != nil {
+		return err
+	}
+
+	gzw, err := e.config.Compression.NewWriter(writer)
 	if err != nil {
 		return err
 	}
+	tw := tar.NewWriter(gzw)
+	var tarMutex sync.Mutex
 
+	g, groupCtx := errgroup.WithContext(ctx)
+	g.SetLimit(e.config.Concurrency)
 	for _, repo := range repos {
-		err := e.cloneGitRepository(ctx, l, tdir, repo.Slug)
-		if err != nil {
-			return fmt.Errorf("failed to clone git repository: %w", err)
-		}
+		g.Go(func() error {
+			name := e.repositoryName(repo)
+			repoDir := filepath.Join(tdir, name)
+			defer os.RemoveAll(repoDir)
+			metadataDir := repoDir + metadataDirSuffix
+			defer os.RemoveAll(metadataDir)
+
+			err := e.cloneGitRepository(groupCtx, l, repoDir, repo)
+			if err != nil {
+				return fmt.Errorf("failed to clone git repository %q: %w", name, err)
+			}
+			if len(e.config.Collectors) > 0 {
+				l.Info("Collecting repository metadata", "repository", repo.Slug)
+				if err := e.collectMetadata(groupCtx, repo, metadataDir); err != nil {
+					return fmt.Errorf("failed to collect metadata of %q: %w", repo.Slug, err)
+				}
+			}
+
+			tarMutex.Lock()
+			defer tarMutex.Unlock()
+			l.Info("Archiving git repository", "repository", name)
+			if err := export.TarDir(groupCtx, tw, repoDir, name); err != nil {
+				return fmt.Errorf("failed to archive git repository %q: %w", name, err)
+			}
+			if len(e.config.Collectors) > 0 {
+				if err := export.TarDir(groupCtx, tw, metadataDir, name+metadataDirSuffix); err != nil {
+					return fmt.Errorf("failed to archive metadata of %q: %w", repo.Slug, err)
+				}
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
 	}
 
-	l.Info("Taring git dump directory")
-	return export.Tar(ctx, tdir, true, writer)
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to close tar writer: %w", err)
+	}
+	if err := gzw.Close(); err != nil {
+		return fmt.Errorf("failed to close compression writer: %w", err)
+	}
+	if err := e.recordRun(ctx, start); err != nil {
+		return err
+	}
+	l.Info("Bitbucket account export complete", slog.Int("repositories", len(repos)))
+	return nil
 }
 
-func (e *Exporter) cloneGitRepository(ctx context.Context, l *slog.Logger, tdir string, repoSlug string) error {
-	l.Info("Cloning git repository", "repository", repoSlug)
+// selectRepositories lists the repositories of the cloud account or server instance and
+// applies the configured filters
+func (e *Exporter) selectRepositories(ctx context.Context, l *slog.Logger) ([]Repository, error) {
+	fetchRepositories := e.fetchAllRepositories
+	if e.config.ServerURL != "" {
+		fetchRepositories = e.fetchAllServerRepositories
+	}
+	allRepos, err := fetchRepositories(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cfg := e.config
+	if cfg.UpdatedAfter, err = e.updatedAfter(ctx, l); err != nil {
+		return nil, err
+	}
+	repos, err := filterRepositories(l, allRepos, cfg)
+	if err != nil {
+		return nil, err
+	}
+	l.Info("Repositories selected for export", slog.Int("selected", len(repos)), slog.Int("total", len(allRepos)))
+	return repos, nil
+}
+
+func (e *Exporter) cloneGitRepository(ctx context.Context, l *slog.Logger, outputPath string, repo Repository) error {
+	l.Info("Cloning git repository", "repository", e.repositoryName(repo))
 
-	cloneURL, err := url.Parse(fmt.Sprintf(defaultCloneURL, e.config.AccountName, repoSlug))
+	options, err := e.cloneOptions(repo)
 	if err != nil {
 		return err
 	}
+	options.Mirror = true
+	options.Progress = os.Stdout
 
-	if e.config.Token != "" {
-		cloneURL.User = url.UserPassword("x-token-auth", e.config.Token)
+	_, err = git.PlainCloneContext(ctx, outputPath, false, options)
+	return err
+}
+
+// cloneOptions resolves the clone URL and authentication for the configured protocol
+func (e *Exporter) cloneOptions(repo Repository) (*git.CloneOptions, error) {
+	cfg := e.config
+
+	if cfg.CloneProtocol == CloneProtocolSSH {
+		cloneURL := repositoryCloneLink(repo, "ssh")
+		if cloneURL == "" {
+			return nil, fmt.Errorf("repository %q has no ssh clone link", repo.Slug)
+		}
+		auth, err := gitssh.NewPublicKeysFromFile("git", cfg.SSHKeyPath, cfg.SSHKeyPassword)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load ssh key: %w", err)
+		}
+		if cfg.SSHKnownHosts != "" {
+			if auth.HostKeyCallback, err = gitssh.NewKnownHostsCallback(cfg.SSHKnownHosts); err != nil {
+				return nil, fmt.Errorf("failed to load ssh known hosts: %w", err)
+			}
+		}
+		return &git.CloneOptions{URL: cloneURL, Auth: auth}, nil
 	}
 
-	outputPath := filepath.Join(tdir, repoSlug)
-	_, err = git.PlainCloneContext(ctx, outputPath, false, &git.CloneOptions{
-		URL:      cloneURL.String(),
-		Mirror:   true,
-		Progress: os.Stdout,
-	})
+	if cfg.ServerURL != "" {
+		cloneURL := repositoryCloneLink(repo, "http")
+		if cloneURL == "" {
+			return nil, fmt.Errorf("repository %q has no http clone link", repo.Slug)
+		}
+		options := &git.CloneOptions{URL: cloneURL}
+		if cfg.Token != "" {
+			options.Auth = &githttp.TokenAuth{Token: cfg.Token}
+		}
+		return options, nil
+	}
 
-	return err
+	cloneURL, err := url.Parse(fmt.Sprintf(defaultCloneURL, cfg.AccountName, repo.Slug))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Token != "" {
+		cloneURL.User = url.UserPassword("x-token-auth", cfg.Token)
+	}
+	return &git.CloneOptions{URL: cloneURL.String()}, nil
+}
+
+// repositoryName is the path of the repository within the archive; server slugs are
+// only unique per project and are therefore prefixed with the project key
+func (e *Exporter) repositoryName(repo Repository) string {
+	if e.config.ServerURL != "" {
+		return filepath.Join(repo.Project.Key, repo.Slug)
+	}
+	return repo.Slug
+}
+
+func repositoryCloneLink(repo Repository, name string) string {
+	for _, link := range repo.Links.Clone {
+		if link.Name == name {
+			return link.Href
+		}
+	}
+	return ""
 }
 
 func (e *Exporter) fetchAllRepositories(ctx context.Context) ([]Repository, error) {
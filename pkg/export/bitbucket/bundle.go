@@ -0,0 +1,351 @@
+package bitbucket
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"maps"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foomo/dump-buckets/pkg/export"
+	"github.com/foomo/dump-buckets/pkg/storage"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	bundleStateName = "state.json"
+	bundleExt       = ".bundle"
+
+	BundleTypeFull        = "full"
+	BundleTypeIncremental = "incremental"
+)
+
+// BundleState is stored next to the bundles and records, per repository, the refs of the
+// last successful backup and the chain of bundles needed to restore them
+type BundleState struct {
+	Repositories map[string]*RepositoryBundleState `json:"repositories"`
+}
+
+type RepositoryBundleState struct {
+	Refs map[string]string `json:"refs"`
+	// Bundles since the last full bundle, oldest first
+	Bundles []string `json:"bundles"`
+	// Incremental bundles created since the last full bundle
+	Runs      int       `json:"runs"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// ExportBundles mirrors all selected repositories and uploads a git bundle per repository
+// below BundlePath; repositories with a previous backup only get a bundle with the objects
+// reachable from new refs unless a full bundle is due, unchanged repositories are skipped.
+// A failing repository doesn't affect the others, whose bundles and state are committed.
+func (e *Exporter) ExportBundles(ctx context.Context, l *slog.Logger) (string, error) {
+	cfg := e.config
+	if cfg.Storage == nil || cfg.BundlePath == "" {
+		return "", errors.New("bundle export requires a storage and bundle path")
+	}
+	l.Info("Starting bitbucket bundle export", slog.String("path", cfg.BundlePath), slog.Int("fullBundleEvery", cfg.FullBundleEvery))
+
+	start := time.Now()
+	statePath := path.Join(cfg.BundlePath, bundleStateName)
+	state := BundleState{}
+	if _, err := export.ReadState(ctx, cfg.Storage, statePath, &state); err != nil {
+		return "", err
+	}
+	if state.Repositories == nil {
+		state.Repositories = map[string]*RepositoryBundleState{}
+	}
+
+	tdir, err := os.MkdirTemp("", "")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp output dir: %w", err)
+	}
+	defer os.RemoveAll(tdir)
+
+	repos, err := e.selectRepositories(ctx, l)
+	if err != nil {
+		return "", err
+	}
+
+	timestamp := time.Now().Format(export.TimestampFormat)
+	var stateMutex sync.Mutex
+	var bundlePaths []string
+	var errs []error
+
+	var g errgroup.Group
+	g.SetLimit(cfg.Concurrency)
+	for _, repo := range repos {
+		g.Go(func() error {
+			name := e.repositoryName(repo)
+			l := l.With(slog.String("repository", name))
+			repoDir := filepath.Join(tdir, name)
+			defer os.RemoveAll(repoDir)
+
+			stateMutex.Lock()
+			previous := state.Repositories[name]
+			stateMutex.Unlock()
+
+			next, err := e.exportBundle(ctx, l, repoDir, name, repo, previous, timestamp)
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
+			if err != nil {
+				// Continue bundling other repositories
+				l.Error("Failed to bundle repository, continuing dump...", slog.Any("error", err))
+				errs = append(errs, err)
+				return nil
+			}
+			if next != nil && next != previous {
+				state.Repositories[name] = next
+				bundlePaths = append(bundlePaths, next.Bundles[len(next.Bundles)-1])
+			}
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	// the state only advances for repositories which were bundled successfully, their bundles
+	// are kept even if other repositories failed
+	if err := export.WriteState(ctx, cfg.Storage, statePath, state); err != nil {
+		return "", err
+	}
+	if err := storage.Commit(ctx, cfg.Storage, append(bundlePaths, statePath)...); err != nil {
+		return "", err
+	}
+	if len(errs) > 0 {
+		return "", errors.Join(errs...)
+	}
+	if err := e.recordRun(ctx, start); err != nil {
+		return "", err
+	}
+	return cfg.BundlePath, nil
+}
+
+// exportBundle mirrors the repository and uploads its bundle
+func (e *Exporter) exportBundle(ctx context.Context, l *slog.Logger, repoDir, name string, repo Repository, previous *RepositoryBundleState, timestamp string) (*RepositoryBundleState, error) {
+	if err := e.cloneGitRepository(ctx, l, repoDir, repo); err != nil {
+		return nil, fmt.Errorf("failed to clone git repository %q: %w", name, err)
+	}
+	next, err := e.bundleRepository(ctx, l, repoDir, name, previous, timestamp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to bundle git repository %q: %w", name, err)
+	}
+	return next, nil
+}
+
+// bundleRepository uploads the bundle of a mirrored repository and returns its new state
+func (e *Exporter) bundleRepository(ctx context.Context, l *slog.Logger, repoDir, name string, previous *RepositoryBundleState, timestamp string) (*RepositoryBundleState, error) {
+	repository, err := git.PlainOpen(repoDir)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := readRefs(repository)
+	if err != nil {
+		return nil, err
+	}
+	if len(refs) == 0 {
+		l.Info("Skipping empty repository")
+		return previous, nil
+	}
+	if previous != nil && maps.Equal(previous.Refs, refs) {
+		l.Info("Skipping unchanged repository")
+		return previous, nil
+	}
+
+	bundleType := BundleTypeFull
+	args := []string{"bundle", "create", "--quiet"}
+	bundleFile := repoDir + bundleExt
+	if previous != nil && !e.fullBundleDue(previous) {
+		bundleType = BundleTypeIncremental
+		args = append(args, bundleFile, "--all", "--not")
+		for _, sha := range previous.Refs {
+			// refs rewritten by force pushes may point to objects which no longer exist
+			if repository.Storer.HasEncodedObject(plumbing.NewHash(sha)) == nil {
+				args = append(args, sha)
+			}
+		}
+	} else {
+		args = append(args, bundleFile, "--all")
+	}
+	defer os.Remove(bundleFile)
+
+	err = runGit(ctx, repoDir, args...)
+	if bundleType == BundleTypeIncremental && errors.Is(err, errEmptyBundle) {
+		// only refs were deleted or moved to known objects, which an incremental bundle can't express
+		bundleType = BundleTypeFull
+		err = runGit(ctx, repoDir, "bundle", "create", "--quiet", bundleFile, "--all")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	bundlePath := path.Join(e.config.BundlePath, filepath.ToSlash(name), timestamp+"."+bundleType+bundleExt)
+	if err := e.uploadFile(ctx, bundleFile, bundlePath, storage.WithMetadata("BundleType", bundleType)); err != nil {
+		return nil, err
+	}
+	l.Info("Uploaded git bundle", slog.String("type", bundleType), slog.String("path", bundlePath))
+
+	next := &RepositoryBundleState{
+		Refs:      refs,
+		Bundles:   []string{bundlePath},
+		UpdatedAt: time.Now(),
+	}
+	if bundleType == BundleTypeIncremental {
+		next.Bundles = append(append([]string{}, previous.Bundles...), bundlePath)
+		next.Runs = previous.Runs + 1
+	}
+	return next, nil
+}
+
+// fullBundleDue reports whether the next bundle completes a cycle of FullBundleEvery runs
+func (e *Exporter) fullBundleDue(previous *RepositoryBundleState) bool {
+	if len(previous.Bundles) == 0 {
+		return true
+	}
+	return e.config.FullBundleEvery > 0 && previous.Runs+1 >= e.config.FullBundleEvery
+}
+
+// Restore replays the bundle chain of the repository into a new bare repository at dst
+func (e *Exporter) Restore(ctx context.Context, l *slog.Logger, name, dst string) error {
+	cfg := e.config
+	if cfg.Storage == nil || cfg.BundlePath == "" {
+		return errors.New("bundle restore requires a storage and bundle path")
+	}
+
+	state := BundleState{}
+	found, err := export.ReadState(ctx, cfg.Storage, path.Join(cfg.BundlePath, bundleStateName), &state)
+	if err != nil {
+		return err
+	}
+	repoState, ok := state.Repositories[name]
+	if !found || !ok || len(repoState.Bundles) == 0 {
+		return fmt.Errorf("no bundles recorded for repository %q", name)
+	}
+
+	if err := os.MkdirAll(dst, 0o755); err != nil {
+		return fmt.Errorf("failed to create restore dir: %w", err)
+	}
+	if err := runGit(ctx, dst, "init", "--quiet", "--bare"); err != nil {
+		return err
+	}
+
+	tdir, err := os.MkdirTemp("", "")
+	if err != nil {
+		return fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tdir)
+
+	for i, bundlePath := range repoState.Bundles {
+		l.Info("Applying git bundle", slog.String("path", bundlePath), slog.Int("index", i))
+		bundleFile := filepath.Join(tdir, fmt.Sprintf("%04d%s", i, bundleExt))
+		if err := e.downloadFile(ctx, bundlePath, bundleFile); err != nil {
+			return err
+		}
+		if err := runGit(ctx, dst, "fetch", "--quiet", "--update-head-ok", bundleFile, "+refs/*:refs/*"); err != nil {
+			return fmt.Errorf("failed to apply bundle %q: %w", bundlePath, err)
+		}
+		os.Remove(bundleFile)
+	}
+	// incremental bundles only contain the changed refs, so refs deleted upstream are removed
+	// by applying the refs of the last run
+	return applyRefs(dst, repoState.Refs)
+}
+
+// applyRefs sets the refs of the repository to the given refs and deletes all others
+func applyRefs(dir string, refs map[string]string) error {
+	repository, err := git.PlainOpen(dir)
+	if err != nil {
+		return err
+	}
+	current, err := readRefs(repository)
+	if err != nil {
+		return err
+	}
+	for name := range current {
+		if _, ok := refs[name]; !ok {
+			if err := repository.Storer.RemoveReference(plumbing.ReferenceName(name)); err != nil {
+				return fmt.Errorf("failed to delete ref %s: %w", name, err)
+			}
+		}
+	}
+	for name, sha := range refs {
+		ref := plumbing.NewHashReference(plumbing.ReferenceName(name), plumbing.NewHash(sha))
+		if err := repository.Storer.SetReference(ref); err != nil {
+			return fmt.Errorf("failed to set ref %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (e *Exporter) uploadFile(ctx context.Context, src, dst string, opts ...storage.WriterOption) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	writer, err := e.config.Storage.NewWriter(ctx, dst, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to initialize writer: %w", err)
+	}
+	if _, err := io.Copy(writer, f); err != nil {
+		writer.Close()
+		return fmt.Errorf("failed to upload %q: %w", dst, err)
+	}
+	return writer.Close()
+}
+
+func (e *Exporter) downloadFile(ctx context.Context, src, dst string) error {
+	reader, err := e.config.Storage.NewReader(ctx, src)
+	if err != nil {
+		return fmt.Errorf("failed to open %q: %w", src, err)
+	}
+	defer reader.Close()
+
+	return writeFile(dst, reader)
+}
+
+// readRefs returns all non symbolic refs of the repository with their object ids
+func readRefs(repository *git.Repository) (map[string]string, error) {
+	iter, err := repository.References()
+	if err != nil {
+		return nil, err
+	}
+	refs := map[string]string{}
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			refs[ref.Name().String()] = ref.Hash().String()
+		}
+		return nil
+	})
+	return refs, err
+}
+
+var errEmptyBundle = errors.New("empty bundle")
+
+// runGit executes the git cli, which is required for bundles as go-git doesn't support them
+func runGit(ctx context.Context, dir string, args ...string) error {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Stdout = log.Writer()
+	cmd.Stderr = io.MultiWriter(log.Writer(), &stderr)
+	if err := cmd.Run(); err != nil {
+		if strings.Contains(stderr.String(), "Refusing to create empty bundle") {
+			return errEmptyBundle
+		}
+		return fmt.Errorf("git %s failed: %w", args[0], err)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package bitbucket
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/foomo/dump-buckets/pkg/export"
+	"github.com/foomo/dump-buckets/pkg/storage"
+	"github.com/go-git/go-git/v5"
+	"github.com/stretchr/testify/require"
+)
+
+type memoryStorage struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+}
+
+type memoryWriter struct {
+	bytes.Buffer
+	storage *memoryStorage
+	path    string
+}
+
+func (w *memoryWriter) Close() error {
+	w.storage.mutex.Lock()
+	defer w.storage.mutex.Unlock()
+	w.storage.objects[w.path] = w.Bytes()
+	return nil
+}
+
+func (s *memoryStorage) NewWriter(_ context.Context, path string, _ ...storage.WriterOption) (io.WriteCloser, error) {
+	return &memoryWriter{storage: s, path: path}, nil
+}
+
+func (s *memoryStorage) NewReader(_ context.Context, path string) (io.ReadCloser, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data, ok := s.objects[path]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", path, storage.ErrNotExist)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func TestExporter_bundleRepository(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git cli not available")
+	}
+
+	ctx := context.Background()
+	tdir := t.TempDir()
+	source := filepath.Join(tdir, "source")
+	mirror := filepath.Join(tdir, "mirror")
+	gitCmd(t, tdir, "init", "--quiet", "--initial-branch=main", source)
+
+	store := &memoryStorage{objects: map[string][]byte{}}
+	e, err := NewExporter(ctx, Config{Storage: store, BundlePath: "backup", FullBundleEvery: 3})
+	require.NoError(t, err)
+
+	var state *RepositoryBundleState
+	run := func(timestamp string) {
+		require.NoError(t, os.RemoveAll(mirror))
+		gitCmd(t, tdir, "clone", "--quiet", "--mirror", source, mirror)
+		state, err = e.bundleRepository(ctx, slog.Default(), mirror, "repo", state, timestamp)
+		require.NoError(t, err)
+	}
+
+	commit(t, source, "first")
+	run("1")
+	require.Equal(t, []string{"backup/repo/1.full.bundle"}, state.Bundles)
+
+	commit(t, source, "second")
+	gitCmd(t, source, "tag", "v1")
+	run("2")
+	require.Equal(t, []string{"backup/repo/1.full.bundle", "backup/repo/2.incremental.bundle"}, state.Bundles)
+
+	// unchanged repositories don't produce a bundle
+	run("3")
+	require.Len(t, state.Bundles, 2)
+
+	commit(t, source, "third")
+	run("4")
+	require.Len(t, state.Bundles, 3)
+	require.Equal(t, 2, state.Runs)
+
+	// the third run after the full bundle starts a new chain
+	commit(t, source, "fourth")
+	run("5")
+	require.Equal(t, []string{"backup/repo/5.full.bundle"}, state.Bundles)
+
+	commit(t, source, "fifth")
+	gitCmd(t, source, "checkout", "--quiet", "-b", "feature")
+	commit(t, source, "feature")
+	run("6")
+
+	// branches deleted upstream are not restored
+	gitCmd(t, source, "checkout", "--quiet", "main")
+	gitCmd(t, source, "branch", "--quiet", "-D", "feature")
+	commit(t, source, "sixth")
+	run("7")
+	require.Len(t, state.Bundles, 3)
+	require.NotContains(t, state.Refs, "refs/heads/feature")
+	require.NoError(t, export.WriteState(ctx, store, "backup/"+bundleStateName, BundleState{
+		Repositories: map[string]*RepositoryBundleState{"repo": state},
+	}))
+
+	restored := filepath.Join(tdir, "restored")
+	require.NoError(t, e.Restore(ctx, slog.Default(), "repo", restored))
+
+	restoredRepository, err := git.PlainOpen(restored)
+	require.NoError(t, err)
+	refs, err := readRefs(restoredRepository)
+	require.NoError(t, err)
+	require.Equal(t, state.Refs, refs)
+}
+
+func TestExporter_ExportBundles(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git cli not available")
+	}
+
+	ctx := context.Background()
+	tdir := t.TempDir()
+	source := filepath.Join(tdir, "source")
+	gitCmd(t, tdir, "init", "--quiet", "--initial-branch=main", source)
+	commit(t, source, "first")
+
+	// the second repository can't be cloned
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"values":[
+			{"slug":"frontend","project":{"key":"WEB"},"links":{"clone":[{"name":"http","href":%q}]}},
+			{"slug":"backend","project":{"key":"WEB"},"links":{"clone":[{"name":"http","href":%q}]}}
+		],"isLastPage":true}`, "file://"+source, "file://"+filepath.Join(tdir, "missing"))
+	}))
+	defer server.Close()
+
+	fs, err := storage.NewFSStorage(ctx, filepath.Join(tdir, "bucket"))
+	require.NoError(t, err)
+	atomic, err := storage.NewAtomic(fs)
+	require.NoError(t, err)
+	e, err := NewExporter(ctx, Config{ServerURL: server.URL, ProjectKeys: []string{"WEB"}, Storage: atomic, BundlePath: "backup"})
+	require.NoError(t, err)
+
+	_, err = e.ExportBundles(ctx, slog.Default())
+	require.ErrorContains(t, err, "WEB/backend")
+	require.NoError(t, atomic.Abort(ctx))
+
+	// the bundle and state of the repository which succeeded are kept
+	state := BundleState{}
+	found, err := export.ReadState(ctx, fs, "backup/"+bundleStateName, &state)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Len(t, state.Repositories, 1)
+	bundles := state.Repositories["WEB/frontend"].Bundles
+	require.Len(t, bundles, 1)
+	reader, err := fs.NewReader(ctx, bundles[0])
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+}
+
+func commit(t *testing.T, dir, message string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "file.txt"), []byte(message), 0o644))
+	gitCmd(t, dir, "add", "file.txt")
+	gitCmd(t, dir, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--quiet", "-m", message)
+}
+
+func gitCmd(t *testing.T, dir string, args ...string) {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+}
@@ -0,0 +1,117 @@
+package bitbucket
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/foomo/dump-buckets/pkg/export"
+)
+
+// RunState is stored at StatePath and records the start of the last successful run
+type RunState struct {
+	LastRun time.Time `json:"lastRun"`
+}
+
+// updatedAfter returns the update cutoff of the repositories, which is the start of the last
+// successful run if UpdatedSinceLastRun is set and that run is more recent than UpdatedAfter
+func (e *Exporter) updatedAfter(ctx context.Context, l *slog.Logger) (time.Time, error) {
+	cfg := e.config
+	if !cfg.UpdatedSinceLastRun {
+		return cfg.UpdatedAfter, nil
+	}
+	state := RunState{}
+	found, err := export.ReadState(ctx, cfg.Storage, cfg.StatePath, &state)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !found {
+		l.Info("No previous run recorded, exporting all repositories", slog.String("state", cfg.StatePath))
+		return cfg.UpdatedAfter, nil
+	}
+	l.Info("Exporting repositories updated since the last run", slog.Time("lastRun", state.LastRun))
+	if state.LastRun.After(cfg.UpdatedAfter) {
+		return state.LastRun, nil
+	}
+	return cfg.UpdatedAfter, nil
+}
+
+// recordRun stores the start of the successful run, so the next run selects the repositories
+// updated since
+func (e *Exporter) recordRun(ctx context.Context, start time.Time) error {
+	if !e.config.UpdatedSinceLastRun {
+		return nil
+	}
+	return export.WriteState(ctx, e.config.Storage, e.config.StatePath, RunState{LastRun: start})
+}
+
+// filterRepositories returns the repositories selected for export by the config filters
+func filterRepositories(l *slog.Logger, repos []Repository, cfg Config) ([]Repository, error) {
+	var selected []Repository
+	for _, repo := range repos {
+		reason, err := repositoryExclusionReason(repo, cfg)
+		if err != nil {
+			return nil, err
+		}
+		if reason != "" {
+			l.Debug("Skipping repository", slog.String("repository", repo.Slug), slog.String("reason", reason))
+			continue
+		}
+		selected = append(selected, repo)
+	}
+	return selected, nil
+}
+
+// repositoryExclusionReason returns why a repository is excluded from the export or an
+// empty string if it should be exported
+func repositoryExclusionReason(repo Repository, cfg Config) (string, error) {
+	if len(cfg.IncludePatterns) > 0 {
+		included, err := matchesAny(cfg.IncludePatterns, repo.Slug)
+		if err != nil {
+			return "", err
+		}
+		if !included {
+			return "not included", nil
+		}
+	}
+
+	excluded, err := matchesAny(cfg.ExcludePatterns, repo.Slug)
+	if err != nil {
+		return "", err
+	}
+	if excluded {
+		return "excluded", nil
+	}
+
+	if len(cfg.ProjectKeys) > 0 && !slices.ContainsFunc(cfg.ProjectKeys, func(key string) bool {
+		return strings.EqualFold(key, repo.Project.Key)
+	}) {
+		return "project not selected", nil
+	}
+
+	if !cfg.UpdatedAfter.IsZero() && !repo.UpdatedOn.IsZero() && repo.UpdatedOn.Before(cfg.UpdatedAfter) {
+		return "not updated", nil
+	}
+
+	if cfg.MaxSize > 0 && repo.Size > cfg.MaxSize {
+		return "too large", nil
+	}
+	return "", nil
+}
+
+func matchesAny(patterns []string, value string) (bool, error) {
+	for _, p := range patterns {
+		matched, err := filepath.Match(p, value)
+		if err != nil {
+			return false, fmt.Errorf("pattern %s is malformed: %w", p, err)
+		}
+		if matched {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,127 @@
+package bitbucket
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepositoryExclusionReason(t *testing.T) {
+	now := time.Date(2025, 1, 10, 0, 0, 0, 0, time.UTC)
+	repo := func(slug, project string, updatedOn time.Time, size int) Repository {
+		r := Repository{Slug: slug, UpdatedOn: updatedOn, Size: size}
+		r.Project.Key = project
+		return r
+	}
+
+	tests := []struct {
+		name    string
+		repo    Repository
+		config  Config
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "no filters",
+			repo:   repo("website", "WEB", now, 100),
+			config: Config{},
+			want:   "",
+		},
+		{
+			name:   "include match",
+			repo:   repo("website-frontend", "WEB", now, 100),
+			config: Config{IncludePatterns: []string{"website-*"}},
+			want:   "",
+		},
+		{
+			name:   "include mismatch",
+			repo:   repo("assets", "WEB", now, 100),
+			config: Config{IncludePatterns: []string{"website-*"}},
+			want:   "not included",
+		},
+		{
+			name:   "exclude wins over include",
+			repo:   repo("website-fork", "WEB", now, 100),
+			config: Config{IncludePatterns: []string{"website-*"}, ExcludePatterns: []string{"*-fork"}},
+			want:   "excluded",
+		},
+		{
+			name:   "project key case insensitive",
+			repo:   repo("website", "WEB", now, 100),
+			config: Config{ProjectKeys: []string{"web"}},
+			want:   "",
+		},
+		{
+			name:   "project not selected",
+			repo:   repo("website", "WEB", now, 100),
+			config: Config{ProjectKeys: []string{"INFRA"}},
+			want:   "project not selected",
+		},
+		{
+			name:   "updated before cutoff",
+			repo:   repo("website", "WEB", now.Add(-48*time.Hour), 100),
+			config: Config{UpdatedAfter: now.Add(-24 * time.Hour)},
+			want:   "not updated",
+		},
+		{
+			name:   "updated after cutoff",
+			repo:   repo("website", "WEB", now, 100),
+			config: Config{UpdatedAfter: now.Add(-24 * time.Hour)},
+			want:   "",
+		},
+		{
+			name:   "too large",
+			repo:   repo("assets", "WEB", now, 2048),
+			config: Config{MaxSize: 1024},
+			want:   "too large",
+		},
+		{
+			name:    "malformed pattern",
+			repo:    repo("website", "WEB", now, 100),
+			config:  Config{ExcludePatterns: []string{"[website"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := repositoryExclusionReason(tt.repo, tt.config)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestExporter_updatedAfter(t *testing.T) {
+	ctx := context.Background()
+	cutoff := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := &memoryStorage{objects: map[string][]byte{}}
+	e, err := NewExporter(ctx, Config{
+		UpdatedAfter:        cutoff,
+		UpdatedSinceLastRun: true,
+		Storage:             s,
+		StatePath:           "backup/bitbucket.state.json",
+	})
+	require.NoError(t, err)
+
+	// the first run has no recorded run
+	updatedAfter, err := e.updatedAfter(ctx, slog.Default())
+	require.NoError(t, err)
+	require.Equal(t, cutoff, updatedAfter)
+
+	lastRun := time.Date(2025, 1, 10, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, e.recordRun(ctx, lastRun))
+	updatedAfter, err = e.updatedAfter(ctx, slog.Default())
+	require.NoError(t, err)
+	require.True(t, lastRun.Equal(updatedAfter))
+
+	_, err = NewExporter(ctx, Config{UpdatedSinceLastRun: true})
+	require.Error(t, err)
+}
@@ -0,0 +1,289 @@
+package bitbucket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	CollectorPullRequests       = "pullrequests"
+	CollectorIssues             = "issues"
+	CollectorDownloads          = "downloads"
+	CollectorHooks              = "hooks"
+	CollectorBranchRestrictions = "branch-restrictions"
+	CollectorPipelinesConfig    = "pipelines-config"
+)
+
+// metadataDirSuffix is appended to the repository slug for the directory holding the
+// collected metadata next to the mirror in the archive
+const metadataDirSuffix = ".metadata"
+
+var errNotFound = errors.New("resource not found")
+
+// collector writes one kind of repository metadata into the metadata directory
+type collector func(ctx context.Context, e *Exporter, repo Repository, dir string) error
+
+var collectors = map[string]collector{
+	CollectorPullRequests:       collectPullRequests,
+	CollectorIssues:             collectIssues,
+	CollectorDownloads:          collectDownloads,
+	CollectorHooks:              collectHooks,
+	CollectorBranchRestrictions: collectBranchRestrictions,
+	CollectorPipelinesConfig:    collectPipelinesConfig,
+}
+
+type pagedResponse struct {
+	Values []json.RawMessage `json:"values"`
+	Next   string            `json:"next"`
+}
+
+func validateCollectors(names []string) error {
+	for _, name := range names {
+		if _, ok := collectors[name]; !ok {
+			return fmt.Errorf("unknown metadata collector %q", name)
+		}
+	}
+	return nil
+}
+
+// collectMetadata runs all configured collectors for the repository
+func (e *Exporter) collectMetadata(ctx context.Context, repo Repository, dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create metadata dir: %w", err)
+	}
+	for _, name := range e.config.Collectors {
+		if err := collectors[name](ctx, e, repo, dir); err != nil {
+			return fmt.Errorf("failed to collect %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func collectPullRequests(ctx context.Context, e *Exporter, repo Repository, dir string) error {
+	if repo.Links.Pullrequests.Href == "" {
+		return nil
+	}
+	pageURL := repo.Links.Pullrequests.Href + "?state=OPEN&state=MERGED&state=DECLINED&state=SUPERSEDED&pagelen=50"
+	return e.writeJSONLines(ctx, filepath.Join(dir, "pullrequests.jsonl"), pageURL, func(value json.RawMessage) (any, error) {
+		var pr struct {
+			Links struct {
+				Comments struct {
+					Href string `json:"href"`
+				} `json:"comments"`
+			} `json:"links"`
+		}
+		if err := json.Unmarshal(value, &pr); err != nil {
+			return nil, err
+		}
+
+		comments := []json.RawMessage{}
+		if pr.Links.Comments.Href != "" {
+			err := e.fetchPages(ctx, pr.Links.Comments.Href, func(comment json.RawMessage) error {
+				comments = append(comments, comment)
+				return nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to fetch pull request comments: %w", err)
+			}
+		}
+		return struct {
+			PullRequest json.RawMessage   `json:"pullrequest"`
+			Comments    []json.RawMessage `json:"comments"`
+		}{PullRequest: value, Comments: comments}, nil
+	})
+}
+
+func collectIssues(ctx context.Context, e *Exporter, repo Repository, dir string) error {
+	if !repo.HasIssues || repo.Links.Self.Href == "" {
+		return nil
+	}
+	return e.writeJSONLines(ctx, filepath.Join(dir, "issues.jsonl"), repo.Links.Self.Href+"/issues", nil)
+}
+
+func collectHooks(ctx context.Context, e *Exporter, repo Repository, dir string) error {
+	if repo.Links.Hooks.Href == "" {
+		return nil
+	}
+	return e.writeJSONLines(ctx, filepath.Join(dir, "hooks.jsonl"), repo.Links.Hooks.Href, nil)
+}
+
+func collectBranchRestrictions(ctx context.Context, e *Exporter, repo Repository, dir string) error {
+	if repo.Links.Self.Href == "" {
+		return nil
+	}
+	return e.writeJSONLines(ctx, filepath.Join(dir, "branch-restrictions.jsonl"), repo.Links.Self.Href+"/branch-restrictions", nil)
+}
+
+func collectPipelinesConfig(ctx context.Context, e *Exporter, repo Repository, dir string) error {
+	if repo.Links.Self.Href == "" {
+		return nil
+	}
+	resp, err := e.get(ctx, repo.Links.Self.Href+"/pipelines_config")
+	if errors.Is(err, errNotFound) {
+		// pipelines are not enabled for the repository
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return writeFile(filepath.Join(dir, "pipelines-config.json"), resp.Body)
+}
+
+func collectDownloads(ctx context.Context, e *Exporter, repo Repository, dir string) error {
+	if repo.Links.Downloads.Href == "" {
+		return nil
+	}
+	downloadsDir := filepath.Join(dir, "downloads")
+	if err := os.MkdirAll(downloadsDir, 0o755); err != nil {
+		return err
+	}
+	return e.writeJSONLines(ctx, filepath.Join(dir, "downloads.jsonl"), repo.Links.Downloads.Href, func(value json.RawMessage) (any, error) {
+		var download struct {
+			Name  string `json:"name"`
+			Links struct {
+				Self struct {
+					Href string `json:"href"`
+				} `json:"self"`
+			} `json:"links"`
+		}
+		if err := json.Unmarshal(value, &download); err != nil {
+			return nil, err
+		}
+		if download.Name == "" || download.Links.Self.Href == "" {
+			return value, nil
+		}
+
+		resp, err := e.do(ctx, e.downloadClient, download.Links.Self.Href)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download %q: %w", download.Name, err)
+		}
+		defer resp.Body.Close()
+
+		if err := writeFile(filepath.Join(downloadsDir, filepath.Base(download.Name)), resp.Body); err != nil {
+			return nil, fmt.Errorf("failed to store download %q: %w", download.Name, err)
+		}
+		return value, nil
+	})
+}
+
+// writeJSONLines pages through the endpoint and writes one JSON line per entity into the
+// file; the optional transform is applied to each entity before it is written
+func (e *Exporter) writeJSONLines(ctx context.Context, file string, pageURL string, transform func(value json.RawMessage) (any, error)) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	encoder := json.NewEncoder(f)
+	err = e.fetchPages(ctx, pageURL, func(value json.RawMessage) error {
+		var entity any = value
+		if transform != nil {
+			transformed, err := transform(value)
+			if err != nil {
+				return err
+			}
+			entity = transformed
+		}
+		return encoder.Encode(entity)
+	})
+	if errors.Is(err, errNotFound) {
+		// the feature is disabled for the repository
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// fetchPages follows the 'next' links of a paginated bitbucket endpoint; only a missing
+// first page is reported as errNotFound, nested requests and later pages fail otherwise
+func (e *Exporter) fetchPages(ctx context.Context, pageURL string, fn func(value json.RawMessage) error) error {
+	for first := true; pageURL != ""; first = false {
+		resp, err := e.get(ctx, pageURL)
+		if err != nil && !first {
+			return notFoundAsFailure(err)
+		}
+		if err != nil {
+			return err
+		}
+
+		var page pagedResponse
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to decode page: %w", err)
+		}
+
+		for _, value := range page.Values {
+			if err := fn(value); err != nil {
+				return notFoundAsFailure(err)
+			}
+		}
+		pageURL = page.Next
+	}
+	return nil
+}
+
+// notFoundAsFailure unwraps errNotFound from the error so that callers don't mistake it
+// for a disabled feature of the repository
+func notFoundAsFailure(err error) error {
+	if !errors.Is(err, errNotFound) {
+		return err
+	}
+	return errors.New(err.Error())
+}
+
+// get executes an authenticated GET request of the API and fails on unexpected status codes
+func (e *Exporter) get(ctx context.Context, uri string) (*http.Response, error) {
+	return e.do(ctx, e.httpClient, uri)
+}
+
+// do executes an authenticated GET request with the client and fails on unexpected status codes
+func (e *Exporter) do(ctx context.Context, client *http.Client, uri string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	if e.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+e.config.Token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %w", uri, errNotFound)
+	case resp.StatusCode != http.StatusOK:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("invalid status code %d received for %s: %s", resp.StatusCode, uri, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+func writeFile(name string, r io.Reader) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,129 @@
+package bitbucket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExporter_collectMetadata(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		switch r.URL.Path {
+		case "/repo/pullrequests":
+			if r.URL.Query().Get("page") == "" {
+				fmt.Fprintf(w, `{"values":[{"id":1,"links":{"comments":{"href":"%s/repo/pullrequests/1/comments"}}}],"next":"%s/repo/pullrequests?page=2"}`, server.URL, server.URL)
+				return
+			}
+			fmt.Fprint(w, `{"values":[{"id":2}]}`)
+		case "/repo/pullrequests/1/comments":
+			fmt.Fprint(w, `{"values":[{"id":10},{"id":11}]}`)
+		case "/repo/hooks":
+			fmt.Fprint(w, `{"values":[{"uuid":"{hook}"}]}`)
+		case "/repo/downloads":
+			fmt.Fprintf(w, `{"values":[{"name":"release.zip","links":{"self":{"href":"%s/repo/downloads/release.zip"}}}]}`, server.URL)
+		case "/repo/downloads/release.zip":
+			fmt.Fprint(w, "zip-content")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	var repo Repository
+	repo.Slug = "repo"
+	repo.Links.Self.Href = server.URL + "/repo"
+	repo.Links.Pullrequests.Href = server.URL + "/repo/pullrequests"
+	repo.Links.Hooks.Href = server.URL + "/repo/hooks"
+	repo.Links.Downloads.Href = server.URL + "/repo/downloads"
+
+	ctx := context.Background()
+	e, err := NewExporter(ctx, Config{
+		Token: "token",
+		Collectors: []string{
+			CollectorPullRequests,
+			CollectorHooks,
+			CollectorDownloads,
+			CollectorBranchRestrictions,
+			CollectorPipelinesConfig,
+		},
+	})
+	require.NoError(t, err)
+	// downloads are only bounded by the context
+	require.Zero(t, e.downloadClient.Timeout)
+
+	dir := filepath.Join(t.TempDir(), "repo"+metadataDirSuffix)
+	require.NoError(t, e.collectMetadata(ctx, repo, dir))
+
+	pullRequests := readLines(t, filepath.Join(dir, "pullrequests.jsonl"))
+	require.Len(t, pullRequests, 2)
+	var first struct {
+		PullRequest struct {
+			ID int `json:"id"`
+		} `json:"pullrequest"`
+		Comments []json.RawMessage `json:"comments"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(pullRequests[0]), &first))
+	require.Equal(t, 1, first.PullRequest.ID)
+	require.Len(t, first.Comments, 2)
+
+	require.Equal(t, []string{`{"uuid":"{hook}"}`}, readLines(t, filepath.Join(dir, "hooks.jsonl")))
+	require.Len(t, readLines(t, filepath.Join(dir, "downloads.jsonl")), 1)
+	require.FileExists(t, filepath.Join(dir, "downloads", "release.zip"))
+	require.Empty(t, readLines(t, filepath.Join(dir, "branch-restrictions.jsonl")))
+	require.NoFileExists(t, filepath.Join(dir, "pipelines-config.json"))
+}
+
+func TestExporter_collectMetadata_nestedNotFound(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repo/pullrequests":
+			fmt.Fprintf(w, `{"values":[{"id":1,"links":{"comments":{"href":"%s/repo/pullrequests/1/comments"}}}]}`, server.URL)
+		case "/repo/downloads":
+			fmt.Fprintf(w, `{"values":[{"name":"release.zip","links":{"self":{"href":"%s/repo/downloads/release.zip"}}}],"next":"%s/repo/downloads?page=2"}`, server.URL, server.URL)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	var repo Repository
+	repo.Slug = "repo"
+	repo.Links.Pullrequests.Href = server.URL + "/repo/pullrequests"
+	repo.Links.Downloads.Href = server.URL + "/repo/downloads"
+
+	for _, collector := range []string{CollectorPullRequests, CollectorDownloads} {
+		t.Run(collector, func(t *testing.T) {
+			ctx := context.Background()
+			e, err := NewExporter(ctx, Config{Collectors: []string{collector}})
+			require.NoError(t, err)
+
+			dir := filepath.Join(t.TempDir(), "repo"+metadataDirSuffix)
+			err = e.collectMetadata(ctx, repo, dir)
+			require.Error(t, err)
+			require.NotErrorIs(t, err, errNotFound)
+		})
+	}
+}
+
+func TestNewExporter_unknownCollector(t *testing.T) {
+	_, err := NewExporter(context.Background(), Config{Collectors: []string{"wiki"}})
+	require.Error(t, err)
+}
+
+func readLines(t *testing.T, name string) []string {
+	t.Helper()
+	data, err := os.ReadFile(name)
+	require.NoError(t, err)
+	return strings.Fields(string(data))
+}
@@ -0,0 +1,73 @@
+package bitbucket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+var (
+	defaultServerProjectRepositoriesURL = "%s/rest/api/1.0/projects/%s/repos?limit=100&start=%d"
+	defaultServerRepositoriesURL        = "%s/rest/api/1.0/repos?limit=100&start=%d"
+)
+
+const (
+	CloneProtocolHTTPS = "https"
+	CloneProtocolSSH   = "ssh"
+)
+
+// fetchAllServerRepositories lists the repositories of the configured projects, or all
+// repositories visible to the token if no project keys are configured
+func (e *Exporter) fetchAllServerRepositories(ctx context.Context) ([]Repository, error) {
+	baseURL := strings.TrimSuffix(e.config.ServerURL, "/")
+
+	var pageURLs []func(start int) string
+	for _, key := range e.config.ProjectKeys {
+		if key == "" {
+			continue
+		}
+		pageURLs = append(pageURLs, func(start int) string {
+			return fmt.Sprintf(defaultServerProjectRepositoriesURL, baseURL, url.PathEscape(key), start)
+		})
+	}
+	if len(pageURLs) == 0 {
+		pageURLs = append(pageURLs, func(start int) string {
+			return fmt.Sprintf(defaultServerRepositoriesURL, baseURL, start)
+		})
+	}
+
+	var allRepositories []Repository
+	for _, pageURL := range pageURLs {
+		start := 0
+		for {
+			page, err := e.fetchServerRepositoryPage(ctx, pageURL(start))
+			if err != nil {
+				return nil, fmt.Errorf("failed to fetch repository page: %w", err)
+			}
+			for _, repo := range page.Values {
+				allRepositories = append(allRepositories, repo.Repository())
+			}
+			if page.IsLastPage {
+				break
+			}
+			start = page.NextPageStart
+		}
+	}
+	return allRepositories, nil
+}
+
+func (e *Exporter) fetchServerRepositoryPage(ctx context.Context, pageURI string) (*ServerRepositoryResponse, error) {
+	resp, err := e.get(ctx, pageURI)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var data ServerRepositoryResponse
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
@@ -0,0 +1,107 @@
+package bitbucket
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestExporter_fetchAllServerRepositories(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		require.Equal(t, "/rest/api/1.0/projects/WEB/repos", r.URL.Path)
+		switch r.URL.Query().Get("start") {
+		case "0":
+			fmt.Fprint(w, `{"values":[{"slug":"frontend","project":{"key":"WEB"},"links":{"clone":[{"name":"http","href":"https://git.example.com/scm/web/frontend.git"},{"name":"ssh","href":"ssh://git@git.example.com:7999/web/frontend.git"}]}}],"isLastPage":false,"nextPageStart":1}`)
+		case "1":
+			fmt.Fprint(w, `{"values":[{"slug":"backend","project":{"key":"WEB"}}],"isLastPage":true}`)
+		default:
+			t.Fatalf("unexpected start %q", r.URL.Query().Get("start"))
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	e, err := NewExporter(ctx, Config{
+		ServerURL:   server.URL + "/",
+		Token:       "token",
+		ProjectKeys: []string{"WEB"},
+	})
+	require.NoError(t, err)
+
+	repos, err := e.fetchAllServerRepositories(ctx)
+	require.NoError(t, err)
+	require.Len(t, repos, 2)
+	require.Equal(t, "WEB/frontend", repos[0].FullName)
+	require.Equal(t, "WEB/frontend", e.repositoryName(repos[0]))
+
+	options, err := e.cloneOptions(repos[0])
+	require.NoError(t, err)
+	require.Equal(t, "https://git.example.com/scm/web/frontend.git", options.URL)
+	require.NotNil(t, options.Auth)
+
+	_, err = e.cloneOptions(repos[1])
+	require.Error(t, err)
+}
+
+func TestNewExporter_serverFilters(t *testing.T) {
+	ctx := context.Background()
+	for _, config := range []Config{
+		{ServerURL: "https://git.example.com", UpdatedAfter: time.Now()},
+		{ServerURL: "https://git.example.com", MaxSize: 1024},
+	} {
+		_, err := NewExporter(ctx, config)
+		require.ErrorContains(t, err, "only supported for bitbucket cloud")
+	}
+}
+
+func TestExporter_cloneOptionsKnownHosts(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	block, err := ssh.MarshalPrivateKey(key, "")
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "id_ed25519")
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(block), 0o600))
+	knownHostsPath := filepath.Join(dir, "known_hosts")
+	require.NoError(t, os.WriteFile(knownHostsPath, []byte(knownhosts.Line([]string{"git.example.com"}, signer.PublicKey())+"\n"), 0o600))
+
+	e, err := NewExporter(context.Background(), Config{
+		ServerURL:     "https://git.example.com",
+		CloneProtocol: CloneProtocolSSH,
+		SSHKeyPath:    keyPath,
+		SSHKnownHosts: knownHostsPath,
+	})
+	require.NoError(t, err)
+
+	repo := Repository{Slug: "frontend"}
+	repo.Links.Clone = append(repo.Links.Clone, struct {
+		Name string `json:"name"`
+		Href string `json:"href"`
+	}{Name: "ssh", Href: "ssh://git@git.example.com:22/web/frontend.git"})
+	options, err := e.cloneOptions(repo)
+	require.NoError(t, err)
+
+	auth, ok := options.Auth.(*gitssh.PublicKeys)
+	require.True(t, ok)
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}
+	require.NoError(t, auth.HostKeyCallback("git.example.com:22", remote, signer.PublicKey()))
+	require.Error(t, auth.HostKeyCallback("other.example.com:22", remote, signer.PublicKey()))
+}
@@ -146,3 +146,59 @@ type RepositoryResponse struct {
 	Page    int          `json:"page"`
 	Next    string       `json:"next"`
 }
+
+// ServerRepository is a repository as returned by the Bitbucket Server / Data Center REST API
+type ServerRepository struct {
+	ID      int    `json:"id"`
+	Slug    string `json:"slug"`
+	Name    string `json:"name"`
+	ScmID   string `json:"scmId"`
+	State   string `json:"state"`
+	Public  bool   `json:"public"`
+	Project struct {
+		ID   int    `json:"id"`
+		Key  string `json:"key"`
+		Name string `json:"name"`
+	} `json:"project"`
+	Links struct {
+		Clone []struct {
+			Name string `json:"name"`
+			Href string `json:"href"`
+		} `json:"clone"`
+		Self []struct {
+			Href string `json:"href"`
+		} `json:"self"`
+	} `json:"links"`
+}
+
+// Repository maps the server representation onto the fields shared with bitbucket cloud
+func (sr ServerRepository) Repository() Repository {
+	var repo Repository
+	repo.Type = "repository"
+	repo.Slug = sr.Slug
+	repo.Name = sr.Name
+	repo.Scm = sr.ScmID
+	repo.IsPrivate = !sr.Public
+	repo.FullName = sr.Project.Key + "/" + sr.Slug
+	repo.Project.Key = sr.Project.Key
+	repo.Project.Name = sr.Project.Name
+	if len(sr.Links.Self) > 0 {
+		repo.Links.HTML.Href = sr.Links.Self[0].Href
+	}
+	for _, clone := range sr.Links.Clone {
+		repo.Links.Clone = append(repo.Links.Clone, struct {
+			Name string `json:"name"`
+			Href string `json:"href"`
+		}{Name: clone.Name, Href: clone.Href})
+	}
+	return repo
+}
+
+type ServerRepositoryResponse struct {
+	Values        []ServerRepository `json:"values"`
+	Size          int                `json:"size"`
+	Limit         int                `json:"limit"`
+	Start         int                `json:"start"`
+	IsLastPage    bool               `json:"isLastPage"`
+	NextPageStart int                `json:"nextPageStart"`
+}
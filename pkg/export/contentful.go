@@ -1,74 +1,162 @@
 package export
 
 import (
-	"compress/gzip"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
-	"log"
-	"os"
-	"os/exec"
-	"path/filepath"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/foomo/dump-buckets/pkg/compression"
+)
+
+const (
+	contentfulDefaultEnvironment = "master"
+	contentfulDefaultTimeout     = 60 * time.Second
 )
 
 type ContentfulExportConfig struct {
 	ManagementToken string
 	SpaceID         string
+	EnvironmentID   string // Defaults to master
+
+	// Multiple spaces and environments, see Targets
+	SpaceIDs       []string
+	AllSpaces      bool
+	EnvironmentIDs []string // "*" selects all environments of a space
+	IncludeAliases bool     // Export environment aliases along with all environments
+
+	BaseURL string       // Defaults to the Contentful Management API
+	Client  *http.Client // Defaults to a client with a timeout of 60s, asset downloads are only bounded by the response header timeout
+
+	// Incremental exports with the Sync API, see Sync
+	DeliveryToken string // Delivery or preview API token
+	SyncBaseURL   string // Defaults to the Content Delivery API, the Preview API includes drafts
+
+	AssetConcurrency int // Parallel asset file downloads, defaults to 4
+
+	Compression compression.Config // Compression of exports and asset archives, defaults to gzip
 }
 
 type ContentfulExport struct {
-	config ContentfulExportConfig
+	config         ContentfulExportConfig
+	api            *contentfulClient
+	downloadClient *http.Client
+}
+
+// contentfulCollection maps a key of the `contentful space import` file format to the API
+// path of the collection, which is either space or environment scoped
+type contentfulCollection struct {
+	key              string
+	path             string
+	order            string
+	environmentScope bool
+}
+
+const contentfulCreationOrder = "sys.createdAt,sys.id"
+
+var contentfulCollections = []contentfulCollection{
+	{key: "contentTypes", path: "/content_types", order: contentfulCreationOrder, environmentScope: true},
+	{key: "tags", path: "/tags", environmentScope: true},
+	{key: "editorInterfaces", path: "/editor_interfaces", environmentScope: true},
+	{key: "entries", path: "/entries", order: contentfulCreationOrder, environmentScope: true},
+	{key: "assets", path: "/assets", order: contentfulCreationOrder, environmentScope: true},
+	{key: "locales", path: "/locales", environmentScope: true},
+	{key: "webhooks", path: "/webhook_definitions"},
+	{key: "roles", path: "/roles"},
 }
 
 func NewContentfulExport(_ context.Context, config ContentfulExportConfig) (*ContentfulExport, error) {
-	return &ContentfulExport{config: config}, nil
+	if config.EnvironmentID == "" {
+		config.EnvironmentID = contentfulDefaultEnvironment
+	}
+	if config.BaseURL == "" {
+		config.BaseURL = contentfulDefaultBaseURL
+	}
+	if config.SyncBaseURL == "" {
+		config.SyncBaseURL = contentfulDefaultSyncBaseURL
+	}
+	downloadClient := config.Client
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: contentfulDefaultTimeout}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.ResponseHeaderTimeout = contentfulDefaultTimeout
+		downloadClient = &http.Client{Transport: transport}
+	}
+	if config.Compression.Codec == "" {
+		config.Compression.Codec = compression.Gzip
+	}
+	return &ContentfulExport{
+		config:         config,
+		downloadClient: downloadClient,
+		api: &contentfulClient{
+			baseURL:      config.BaseURL,
+			token:        config.ManagementToken,
+			client:       config.Client,
+			retryBackoff: time.Second,
+		},
+	}, nil
 }
 
-// Export exports contentful space data as a gzipped JSON file
-func (ce *ContentfulExport) Export(ctx context.Context, writer io.Writer) error {
-	tdir, err := os.MkdirTemp("", "contentful-export-")
+// Export exports contentful space data as a compressed JSON file, which can be loaded
+// with `contentful space import`; items are streamed so the space is never held in memory
+func (ce *ContentfulExport) Export(ctx context.Context, l *slog.Logger, writer io.Writer) error {
+	gzw, err := ce.config.Compression.NewWriter(writer)
 	if err != nil {
-		return fmt.Errorf("failed to create temp output dir: %w", err)
+		return err
+	}
+
+	if _, err := io.WriteString(gzw, "{"); err != nil {
+		return err
+	}
+	for i, collection := range contentfulCollections {
+		count, err := ce.exportCollection(ctx, gzw, collection, i == 0)
+		if err != nil {
+			return fmt.Errorf("failed to export %s: %w", collection.key, err)
+		}
+		l.Info("Exported contentful collection", slog.String("collection", collection.key), slog.Int("count", count))
 	}
-	defer os.RemoveAll(tdir)
-
-	exportFile := filepath.Join(tdir, "contentful-export.json")
-
-	args := []string{
-		"space",
-		"export",
-		"--use-verbose-renderer",
-		"--management-token", ce.config.ManagementToken,
-		"--space-id", ce.config.SpaceID,
-		"--max-allowed-limit", "100",
-		"--export-dir", tdir,
-		"--content-file", "contentful-export.json",
+	if _, err := io.WriteString(gzw, "}\n"); err != nil {
+		return err
 	}
 
-	// Export
-	cmd := exec.CommandContext(ctx, "contentful", args...)
-	cmd.Stdout = log.Writer()
-	cmd.Stderr = log.Writer()
-	err = cmd.Run()
-	if err != nil {
-		return fmt.Errorf("contentful export failed: %w", err)
+	if err := gzw.Close(); err != nil {
+		return fmt.Errorf("failed to compress content: %w", err)
 	}
+	return nil
+}
 
-	// Open the exported JSON file
-	jsonFile, err := os.Open(exportFile)
-	if err != nil {
-		return fmt.Errorf("failed to open exported file: %w", err)
+func (ce *ContentfulExport) exportCollection(ctx context.Context, writer io.Writer, collection contentfulCollection, first bool) (int, error) {
+	prefix := ""
+	if !first {
+		prefix = ","
+	}
+	if _, err := fmt.Fprintf(writer, "%s%q:[", prefix, collection.key); err != nil {
+		return 0, err
 	}
-	defer jsonFile.Close()
 
-	// Create gzip writer and copy the JSON file content
-	gzw := gzip.NewWriter(writer)
-	defer gzw.Close()
+	path := "/spaces/" + ce.config.SpaceID
+	if collection.environmentScope {
+		path += "/environments/" + ce.config.EnvironmentID
+	}
 
-	_, err = io.Copy(gzw, jsonFile)
+	count := 0
+	err := ce.api.collection(ctx, path+collection.path, collection.order, func(item json.RawMessage) error {
+		if count > 0 {
+			if _, err := io.WriteString(writer, ","); err != nil {
+				return err
+			}
+		}
+		count++
+		_, err := writer.Write(item)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("failed to gzip content: %w", err)
+		return count, err
 	}
 
-	return nil
+	_, err = io.WriteString(writer, "]")
+	return count, err
 }
@@ -0,0 +1,115 @@
+package export
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	contentfulDefaultBaseURL  = "https://api.contentful.com"
+	contentfulPageLimit       = 100
+	contentfulMaxRetries      = 8
+	contentfulMaxRetryBackoff = time.Minute
+)
+
+// contentfulPage is a page of a Contentful Management API collection
+type contentfulPage struct {
+	Total int               `json:"total"`
+	Skip  int               `json:"skip"`
+	Limit int               `json:"limit"`
+	Items []json.RawMessage `json:"items"`
+}
+
+// contentfulClient is a minimal client for the Contentful Management API which pages
+// through collections and backs off on rate limits
+type contentfulClient struct {
+	baseURL      string
+	token        string
+	client       *http.Client
+	retryBackoff time.Duration
+}
+
+// collection calls fn for every item of the collection at path, e.g. /spaces/{id}/roles;
+// large collections should be ordered to page consistently
+func (cc *contentfulClient) collection(ctx context.Context, path string, order string, fn func(item json.RawMessage) error) error {
+	skip := 0
+	for {
+		query := url.Values{}
+		query.Set("skip", strconv.Itoa(skip))
+		query.Set("limit", strconv.Itoa(contentfulPageLimit))
+		if order != "" {
+			query.Set("order", order)
+		}
+
+		var page contentfulPage
+		if err := cc.get(ctx, path, query, &page); err != nil {
+			return err
+		}
+		for _, item := range page.Items {
+			if err := fn(item); err != nil {
+				return err
+			}
+		}
+
+		skip += len(page.Items)
+		if len(page.Items) == 0 || skip >= page.Total {
+			return nil
+		}
+	}
+}
+
+// get decodes the JSON response of path into v, retrying rate limited and failed requests
+func (cc *contentfulClient) get(ctx context.Context, path string, query url.Values, v any) error {
+	uri := strings.TrimSuffix(cc.baseURL, "/") + path
+	if len(query) > 0 {
+		uri += "?" + query.Encode()
+	}
+
+	backoff := cc.retryBackoff
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+cc.token)
+
+		resp, err := cc.client.Do(req)
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(v)
+			resp.Body.Close()
+			if err != nil {
+				return fmt.Errorf("failed to decode %s: %w", path, err)
+			}
+			return nil
+		}
+
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		retryable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+		if !retryable || attempt >= contentfulMaxRetries {
+			return fmt.Errorf("invalid status code %d received for %s: %s", resp.StatusCode, path, strings.TrimSpace(string(body)))
+		}
+
+		wait := backoff
+		if reset, err := strconv.Atoi(resp.Header.Get("X-Contentful-RateLimit-Reset")); err == nil {
+			wait = time.Duration(reset) * time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		backoff = min(backoff*2, contentfulMaxRetryBackoff)
+	}
+}
@@ -0,0 +1,251 @@
+package export
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	contentfulDefaultAssetConcurrency = 4
+	contentfulAssetManifestName       = "manifest.json"
+)
+
+var contentfulETagMD5Regex = regexp.MustCompile(`^"?([0-9a-f]{32})"?$`)
+
+// ContentfulAssetManifest lists every downloaded asset file and the archive it is stored
+// in; unchanged files are not downloaded again and keep pointing to an earlier archive
+type ContentfulAssetManifest struct {
+	CreatedAt time.Time                      `json:"createdAt"`
+	Files     map[string]ContentfulAssetFile `json:"files"` // keyed by asset id and locale
+}
+
+type ContentfulAssetFile struct {
+	AssetID     string `json:"assetId"`
+	Locale      string `json:"locale"`
+	URL         string `json:"url"`
+	FileName    string `json:"fileName"`
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+	Archive     string `json:"archive"` // storage path of the archive containing the file
+	Path        string `json:"path"`    // path of the file within the archive
+}
+
+type contentfulAsset struct {
+	Sys struct {
+		ID string `json:"id"`
+	} `json:"sys"`
+	Fields struct {
+		File map[string]struct {
+			URL         string `json:"url"`
+			FileName    string `json:"fileName"`
+			ContentType string `json:"contentType"`
+			Details     struct {
+				Size int64 `json:"size"`
+			} `json:"details"`
+		} `json:"file"`
+	} `json:"fields"`
+}
+
+// ExportAssets downloads the files of all assets in all locales into a compressed tar archive;
+// files already listed with the same URL in the previous manifest are skipped. The returned
+// manifest should be stored to be passed as previous manifest on the next run.
+func (ce *ContentfulExport) ExportAssets(ctx context.Context, l *slog.Logger, writer io.Writer, archive string, previous *ContentfulAssetManifest) (*ContentfulAssetManifest, error) {
+	manifest := &ContentfulAssetManifest{
+		CreatedAt: time.Now(),
+		Files:     map[string]ContentfulAssetFile{},
+	}
+
+	var pending []ContentfulAssetFile
+	assetsPath := fmt.Sprintf("/spaces/%s/environments/%s/assets", ce.config.SpaceID, ce.config.EnvironmentID)
+	err := ce.api.collection(ctx, assetsPath, contentfulCreationOrder, func(item json.RawMessage) error {
+		var asset contentfulAsset
+		if err := json.Unmarshal(item, &asset); err != nil {
+			return fmt.Errorf("failed to decode asset: %w", err)
+		}
+		for locale, file := range asset.Fields.File {
+			if file.URL == "" {
+				// uploads which have not been processed yet
+				continue
+			}
+			assetFile := ContentfulAssetFile{
+				AssetID:     asset.Sys.ID,
+				Locale:      locale,
+				URL:         file.URL,
+				FileName:    file.FileName,
+				ContentType: file.ContentType,
+				Size:        file.Details.Size,
+				Archive:     archive,
+				Path:        path.Join("assets", asset.Sys.ID, locale, path.Base(file.FileName)),
+			}
+			key := asset.Sys.ID + "/" + locale
+			if previous != nil {
+				if prev, ok := previous.Files[key]; ok && prev.URL == file.URL && prev.SHA256 != "" {
+					manifest.Files[key] = prev
+					continue
+				}
+			}
+			pending = append(pending, assetFile)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list assets: %w", err)
+	}
+	l.Info("Downloading contentful asset files", slog.Int("files", len(pending)), slog.Int("unchanged", len(manifest.Files)))
+
+	tdir, err := os.MkdirTemp("", "contentful-assets-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp output dir: %w", err)
+	}
+	defer os.RemoveAll(tdir)
+
+	gzw, err := ce.config.Compression.NewWriter(writer)
+	if err != nil {
+		return nil, err
+	}
+	tw := tar.NewWriter(gzw)
+	var mutex sync.Mutex
+
+	concurrency := ce.config.AssetConcurrency
+	if concurrency <= 0 {
+		concurrency = contentfulDefaultAssetConcurrency
+	}
+	g, groupCtx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+	for i, file := range pending {
+		g.Go(func() error {
+			tmpFile := filepath.Join(tdir, fmt.Sprintf("%06d", i))
+			defer os.Remove(tmpFile)
+
+			downloaded, err := ce.downloadAsset(groupCtx, file, tmpFile)
+			if err != nil {
+				return fmt.Errorf("failed to download asset %s (%s): %w", file.AssetID, file.Locale, err)
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err := tarFile(tw, tmpFile, downloaded.Path); err != nil {
+				return fmt.Errorf("failed to archive asset %s (%s): %w", file.AssetID, file.Locale, err)
+			}
+			manifest.Files[downloaded.AssetID+"/"+downloaded.Locale] = downloaded
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    contentfulAssetManifestName,
+		Mode:    0o644,
+		Size:    int64(len(manifestData)),
+		ModTime: manifest.CreatedAt,
+	}); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(manifestData); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close tar writer: %w", err)
+	}
+	if err := gzw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close compression writer: %w", err)
+	}
+	return manifest, nil
+}
+
+// downloadAsset stores the file at dst and verifies it against the size reported by
+// contentful and the MD5 ETag of the CDN if available
+func (ce *ContentfulExport) downloadAsset(ctx context.Context, file ContentfulAssetFile, dst string) (ContentfulAssetFile, error) {
+	fileURL := file.URL
+	if strings.HasPrefix(fileURL, "//") {
+		fileURL = "https:" + fileURL
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", fileURL, nil)
+	if err != nil {
+		return file, err
+	}
+	resp, err := ce.downloadClient.Do(req)
+	if err != nil {
+		return file, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return file, fmt.Errorf("invalid status code %d received", resp.StatusCode)
+	}
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return file, err
+	}
+	defer f.Close()
+
+	sha := sha256.New()
+	md := md5.New()
+	size, err := io.Copy(io.MultiWriter(f, sha, md), resp.Body)
+	if err != nil {
+		return file, err
+	}
+	if err := f.Close(); err != nil {
+		return file, err
+	}
+
+	if file.Size > 0 && size != file.Size {
+		return file, fmt.Errorf("size mismatch, expected %d bytes but received %d", file.Size, size)
+	}
+	if match := contentfulETagMD5Regex.FindStringSubmatch(resp.Header.Get("ETag")); match != nil {
+		if actual := hex.EncodeToString(md.Sum(nil)); actual != match[1] {
+			return file, fmt.Errorf("checksum mismatch, expected md5 %s but received %s", match[1], actual)
+		}
+	}
+
+	file.Size = size
+	file.SHA256 = hex.EncodeToString(sha.Sum(nil))
+	return file, nil
+}
+
+func tarFile(tw *tar.Writer, src, name string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
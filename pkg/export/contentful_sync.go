@@ -0,0 +1,124 @@
+package export
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"time"
+)
+
+const (
+	contentfulDefaultSyncBaseURL = "https://cdn.contentful.com"
+
+	ContentfulSyncModeFull  = "full"
+	ContentfulSyncModeDelta = "delta"
+)
+
+// ContentfulSyncState is kept between incremental runs of a space environment
+type ContentfulSyncState struct {
+	SyncToken  string    `json:"syncToken"`
+	Runs       int       `json:"runs"` // Delta runs since the last full baseline
+	BaselineAt time.Time `json:"baselineAt"`
+	SyncedAt   time.Time `json:"syncedAt"`
+}
+
+type contentfulSyncPage struct {
+	Items       []json.RawMessage `json:"items"`
+	NextPageURL string            `json:"nextPageUrl"`
+	NextSyncURL string            `json:"nextSyncUrl"`
+}
+
+// SyncMode returns the mode of the next run, a full baseline is forced on the first run
+// and after fullEvery delta runs if fullEvery is positive
+func (s *ContentfulSyncState) SyncMode(fullEvery int) string {
+	if s == nil || s.SyncToken == "" || (fullEvery > 0 && s.Runs >= fullEvery) {
+		return ContentfulSyncModeFull
+	}
+	return ContentfulSyncModeDelta
+}
+
+// Sync writes the changes since the previous state as compressed JSON lines, including
+// Deleted* items, using the Sync API; without a previous state, or when a baseline is due,
+// all items are written. The returned state must be stored for the next run.
+func (ce *ContentfulExport) Sync(ctx context.Context, l *slog.Logger, writer io.Writer, previous *ContentfulSyncState, fullEvery int) (*ContentfulSyncState, error) {
+	if ce.config.DeliveryToken == "" {
+		return nil, errors.New("the sync api requires a delivery or preview token")
+	}
+	mode := previous.SyncMode(fullEvery)
+	syncPath := fmt.Sprintf("/spaces/%s/environments/%s/sync", ce.config.SpaceID, ce.config.EnvironmentID)
+	api := &contentfulClient{
+		baseURL:      ce.config.SyncBaseURL,
+		token:        ce.config.DeliveryToken,
+		client:       ce.config.Client,
+		retryBackoff: ce.api.retryBackoff,
+	}
+
+	query := url.Values{}
+	if mode == ContentfulSyncModeFull {
+		query.Set("initial", "true")
+	} else {
+		query.Set("sync_token", previous.SyncToken)
+	}
+
+	gzw, err := ce.config.Compression.NewWriter(writer)
+	if err != nil {
+		return nil, err
+	}
+	encoder := json.NewEncoder(gzw)
+	count := 0
+	var nextSyncToken string
+	for nextSyncToken == "" {
+		var page contentfulSyncPage
+		if err := api.get(ctx, syncPath, query, &page); err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			if err := encoder.Encode(item); err != nil {
+				return nil, err
+			}
+		}
+		count += len(page.Items)
+
+		next := page.NextPageURL
+		if next == "" {
+			next = page.NextSyncURL
+		}
+		token, err := contentfulSyncToken(next)
+		if err != nil {
+			return nil, err
+		}
+		if page.NextPageURL == "" {
+			nextSyncToken = token
+		}
+		query = url.Values{}
+		query.Set("sync_token", token)
+	}
+	if err := gzw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress content: %w", err)
+	}
+	l.Info("Contentful sync complete", slog.String("mode", mode), slog.Int("items", count))
+
+	now := time.Now()
+	next := &ContentfulSyncState{SyncToken: nextSyncToken, BaselineAt: now, SyncedAt: now}
+	if mode == ContentfulSyncModeDelta {
+		next.Runs = previous.Runs + 1
+		next.BaselineAt = previous.BaselineAt
+	}
+	return next, nil
+}
+
+func contentfulSyncToken(syncURL string) (string, error) {
+	u, err := url.Parse(syncURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid sync url %q: %w", syncURL, err)
+	}
+	token := u.Query().Get("sync_token")
+	if token == "" {
+		return "", fmt.Errorf("sync url %q without sync token", syncURL)
+	}
+	return token, nil
+}
@@ -0,0 +1,117 @@
+package export
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"github.com/foomo/dump-buckets/pkg/compression"
+)
+
+const contentfulAllEnvironments = "*"
+
+// ContentfulTarget is a single space environment, or environment alias, to export
+type ContentfulTarget struct {
+	SpaceID       string
+	EnvironmentID string
+	AliasOf       string // Environment the alias points to, empty for environments
+}
+
+type contentfulSys struct {
+	Sys struct {
+		ID string `json:"id"`
+	} `json:"sys"`
+}
+
+type contentfulAlias struct {
+	Sys struct {
+		ID string `json:"id"`
+	} `json:"sys"`
+	Environment struct {
+		Sys struct {
+			ID string `json:"id"`
+		} `json:"sys"`
+	} `json:"environment"`
+}
+
+// Targets resolves the configured spaces and environments into the list of exports; all
+// spaces visible to the token are used with AllSpaces, and an environment id of "*"
+// selects every environment of a space
+func (ce *ContentfulExport) Targets(ctx context.Context) ([]ContentfulTarget, error) {
+	cfg := ce.config
+
+	spaceIDs := cfg.SpaceIDs
+	if cfg.SpaceID != "" && !slices.Contains(spaceIDs, cfg.SpaceID) {
+		spaceIDs = append([]string{cfg.SpaceID}, spaceIDs...)
+	}
+	if cfg.AllSpaces {
+		spaceIDs = nil
+		err := ce.api.collection(ctx, "/spaces", "", func(item json.RawMessage) error {
+			var space contentfulSys
+			if err := json.Unmarshal(item, &space); err != nil {
+				return err
+			}
+			spaceIDs = append(spaceIDs, space.Sys.ID)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list spaces: %w", err)
+		}
+	}
+
+	environmentIDs := cfg.EnvironmentIDs
+	if len(environmentIDs) == 0 {
+		environmentIDs = []string{cfg.EnvironmentID}
+	}
+
+	var targets []ContentfulTarget
+	for _, spaceID := range spaceIDs {
+		if !slices.Contains(environmentIDs, contentfulAllEnvironments) {
+			for _, environmentID := range environmentIDs {
+				targets = append(targets, ContentfulTarget{SpaceID: spaceID, EnvironmentID: environmentID})
+			}
+			continue
+		}
+
+		err := ce.api.collection(ctx, "/spaces/"+spaceID+"/environments", "", func(item json.RawMessage) error {
+			var environment contentfulSys
+			if err := json.Unmarshal(item, &environment); err != nil {
+				return err
+			}
+			targets = append(targets, ContentfulTarget{SpaceID: spaceID, EnvironmentID: environment.Sys.ID})
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list environments of space %s: %w", spaceID, err)
+		}
+		if !cfg.IncludeAliases {
+			continue
+		}
+		err = ce.api.collection(ctx, "/spaces/"+spaceID+"/environment_aliases", "", func(item json.RawMessage) error {
+			var alias contentfulAlias
+			if err := json.Unmarshal(item, &alias); err != nil {
+				return err
+			}
+			targets = append(targets, ContentfulTarget{SpaceID: spaceID, EnvironmentID: alias.Sys.ID, AliasOf: alias.Environment.Sys.ID})
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list environment aliases of space %s: %w", spaceID, err)
+		}
+	}
+	return targets, nil
+}
+
+// Compression returns the compression of the exports
+func (ce *ContentfulExport) Compression() compression.Config {
+	return ce.config.Compression
+}
+
+// ForTarget returns an exporter for the space environment of the target
+func (ce *ContentfulExport) ForTarget(target ContentfulTarget) *ContentfulExport {
+	export := *ce
+	export.config.SpaceID = target.SpaceID
+	export.config.EnvironmentID = target.EnvironmentID
+	return &export
+}
@@ -0,0 +1,277 @@
+package export
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestContentfulExport_Export(t *testing.T) {
+	rateLimited := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		skip, _ := strconv.Atoi(r.URL.Query().Get("skip"))
+
+		switch r.URL.Path {
+		case "/spaces/space/environments/master/entries":
+			require.Equal(t, contentfulCreationOrder, r.URL.Query().Get("order"))
+			if skip == 1 && !rateLimited {
+				rateLimited = true
+				w.Header().Set("X-Contentful-RateLimit-Reset", "0")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			fmt.Fprintf(w, `{"total":2,"skip":%d,"limit":1,"items":[{"sys":{"id":"entry-%d"}}]}`, skip, skip)
+		case "/spaces/space/environments/master/locales":
+			fmt.Fprint(w, `{"total":1,"items":[{"code":"en-US"}]}`)
+		case "/spaces/space/roles":
+			fmt.Fprint(w, `{"total":1,"items":[{"name":"Editor"}]}`)
+		default:
+			fmt.Fprint(w, `{"total":0,"items":[]}`)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	export, err := NewContentfulExport(ctx, ContentfulExportConfig{
+		ManagementToken: "token",
+		SpaceID:         "space",
+		BaseURL:         server.URL,
+	})
+	require.NoError(t, err)
+	// api requests time out, asset downloads are only bounded by the context
+	require.Equal(t, contentfulDefaultTimeout, export.config.Client.Timeout)
+	require.Zero(t, export.downloadClient.Timeout)
+
+	var buf bytes.Buffer
+	require.NoError(t, export.Export(ctx, slog.Default(), &buf))
+	require.True(t, rateLimited)
+
+	gzr, err := gzip.NewReader(&buf)
+	require.NoError(t, err)
+	var data map[string][]map[string]any
+	require.NoError(t, json.NewDecoder(gzr).Decode(&data))
+
+	require.Len(t, data, len(contentfulCollections))
+	require.Len(t, data["entries"], 2)
+	require.Equal(t, "entry-1", data["entries"][1]["sys"].(map[string]any)["id"])
+	require.Len(t, data["locales"], 1)
+	require.Len(t, data["roles"], 1)
+	require.Empty(t, data["webhooks"])
+}
+
+func TestContentfulExport_ExportAssets(t *testing.T) {
+	var server *httptest.Server
+	var downloads atomic.Int32
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/spaces/space/environments/master/assets":
+			fmt.Fprintf(w, `{"total":2,"items":[
+				{"sys":{"id":"logo"},"fields":{"file":{"en-US":{"url":"%s/files/logo.png","fileName":"logo.png","details":{"size":4}},"de-CH":{"url":"%s/files/logo-de.png","fileName":"logo.png","details":{"size":4}}}}},
+				{"sys":{"id":"broken"},"fields":{"file":{"en-US":{"fileName":"upload.png"}}}}
+			]}`, server.URL, server.URL)
+		case "/files/logo.png", "/files/logo-de.png":
+			downloads.Add(1)
+			w.Header().Set("ETag", `"`+fmt.Sprintf("%x", md5.Sum([]byte("logo")))+`"`)
+			fmt.Fprint(w, "logo")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	export, err := NewContentfulExport(ctx, ContentfulExportConfig{
+		ManagementToken: "token",
+		SpaceID:         "space",
+		BaseURL:         server.URL,
+	})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	manifest, err := export.ExportAssets(ctx, slog.Default(), &buf, "first.tar.gz", nil)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, downloads.Load())
+	require.Len(t, manifest.Files, 2)
+	require.Equal(t, "assets/logo/en-US/logo.png", manifest.Files["logo/en-US"].Path)
+	require.Equal(t, fmt.Sprintf("%x", sha256.Sum256([]byte("logo"))), manifest.Files["logo/en-US"].SHA256)
+
+	gzr, err := gzip.NewReader(&buf)
+	require.NoError(t, err)
+	var names []string
+	tr := tar.NewReader(gzr)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, header.Name)
+	}
+	require.ElementsMatch(t, []string{"assets/logo/en-US/logo.png", "assets/logo/de-CH/logo.png", contentfulAssetManifestName}, names)
+
+	// unchanged files keep pointing to the previous archive
+	next, err := export.ExportAssets(ctx, slog.Default(), io.Discard, "second.tar.gz", manifest)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, downloads.Load())
+	require.Equal(t, "first.tar.gz", next.Files["logo/de-CH"].Archive)
+}
+
+func TestContentfulExport_ForTarget(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/spaces/other/environments/staging/assets":
+			fmt.Fprintf(w, `{"total":1,"items":[{"sys":{"id":"logo"},"fields":{"file":{"en-US":{"url":"%s/files/logo.png","fileName":"logo.png","details":{"size":4}}}}}]}`, server.URL)
+		case "/files/logo.png":
+			fmt.Fprint(w, "logo")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	export, err := NewContentfulExport(ctx, ContentfulExportConfig{
+		ManagementToken: "token",
+		SpaceID:         "space",
+		BaseURL:         server.URL,
+	})
+	require.NoError(t, err)
+
+	target := export.ForTarget(ContentfulTarget{SpaceID: "other", EnvironmentID: "staging"})
+	manifest, err := target.ExportAssets(ctx, slog.Default(), io.Discard, "assets.tar.gz", nil)
+	require.NoError(t, err)
+	require.Len(t, manifest.Files, 1)
+	require.Equal(t, "space", export.config.SpaceID)
+}
+
+func TestContentfulExport_Targets(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/spaces":
+			fmt.Fprint(w, `{"total":2,"items":[{"sys":{"id":"a"}},{"sys":{"id":"b"}}]}`)
+		case "/spaces/a/environments", "/spaces/b/environments":
+			fmt.Fprint(w, `{"total":2,"items":[{"sys":{"id":"master"}},{"sys":{"id":"staging"}}]}`)
+		case "/spaces/a/environment_aliases", "/spaces/b/environment_aliases":
+			fmt.Fprint(w, `{"total":1,"items":[{"sys":{"id":"production"},"environment":{"sys":{"id":"master"}}}]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		config ContentfulExportConfig
+		want   []ContentfulTarget
+	}{
+		{
+			name:   "single space defaults to master",
+			config: ContentfulExportConfig{SpaceID: "a"},
+			want:   []ContentfulTarget{{SpaceID: "a", EnvironmentID: "master"}},
+		},
+		{
+			name:   "selected spaces and environments",
+			config: ContentfulExportConfig{SpaceID: "a", SpaceIDs: []string{"a", "b"}, EnvironmentIDs: []string{"staging"}},
+			want: []ContentfulTarget{
+				{SpaceID: "a", EnvironmentID: "staging"},
+				{SpaceID: "b", EnvironmentID: "staging"},
+			},
+		},
+		{
+			name:   "all spaces all environments with aliases",
+			config: ContentfulExportConfig{AllSpaces: true, EnvironmentIDs: []string{"*"}, IncludeAliases: true},
+			want: []ContentfulTarget{
+				{SpaceID: "a", EnvironmentID: "master"},
+				{SpaceID: "a", EnvironmentID: "staging"},
+				{SpaceID: "a", EnvironmentID: "production", AliasOf: "master"},
+				{SpaceID: "b", EnvironmentID: "master"},
+				{SpaceID: "b", EnvironmentID: "staging"},
+				{SpaceID: "b", EnvironmentID: "production", AliasOf: "master"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			tt.config.BaseURL = server.URL
+			export, err := NewContentfulExport(ctx, tt.config)
+			require.NoError(t, err)
+
+			targets, err := export.Targets(ctx)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, targets)
+		})
+	}
+}
+
+func TestContentfulExport_Sync(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "Bearer delivery", r.Header.Get("Authorization"))
+		require.Equal(t, "/spaces/space/environments/master/sync", r.URL.Path)
+		query := r.URL.Query()
+		switch {
+		case query.Get("initial") == "true":
+			fmt.Fprintf(w, `{"items":[{"sys":{"type":"Entry","id":"a"}}],"nextPageUrl":"%s/sync?sync_token=page2"}`, server.URL)
+		case query.Get("sync_token") == "page2":
+			fmt.Fprintf(w, `{"items":[{"sys":{"type":"Asset","id":"b"}}],"nextSyncUrl":"%s/sync?sync_token=delta1"}`, server.URL)
+		case query.Get("sync_token") == "delta1":
+			fmt.Fprintf(w, `{"items":[{"sys":{"type":"DeletedEntry","id":"a"}}],"nextSyncUrl":"%s/sync?sync_token=delta2"}`, server.URL)
+		default:
+			t.Fatalf("unexpected query %q", r.URL.RawQuery)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	export, err := NewContentfulExport(ctx, ContentfulExportConfig{
+		SpaceID:       "space",
+		DeliveryToken: "delivery",
+		SyncBaseURL:   server.URL,
+	})
+	require.NoError(t, err)
+
+	readLines := func(buf *bytes.Buffer) []string {
+		gzr, err := gzip.NewReader(buf)
+		require.NoError(t, err)
+		data, err := io.ReadAll(gzr)
+		require.NoError(t, err)
+		return strings.Fields(string(data))
+	}
+
+	var buf bytes.Buffer
+	state, err := export.Sync(ctx, slog.Default(), &buf, nil, 2)
+	require.NoError(t, err)
+	require.Equal(t, "delta1", state.SyncToken)
+	require.Equal(t, 0, state.Runs)
+	require.Len(t, readLines(&buf), 2)
+
+	require.Equal(t, ContentfulSyncModeDelta, state.SyncMode(2))
+	state, err = export.Sync(ctx, slog.Default(), &buf, state, 2)
+	require.NoError(t, err)
+	require.Equal(t, "delta2", state.SyncToken)
+	require.Equal(t, 1, state.Runs)
+	require.Equal(t, []string{`{"sys":{"type":"DeletedEntry","id":"a"}}`}, readLines(&buf))
+
+	state.Runs = 2
+	require.Equal(t, ContentfulSyncModeFull, state.SyncMode(2))
+}
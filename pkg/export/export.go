@@ -2,7 +2,6 @@ package export
 
 import (
 	"archive/tar"
-	"compress/gzip"
 	"context"
 	"fmt"
 	"io"
@@ -10,6 +9,7 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/foomo/dump-buckets/pkg/compression"
 	"github.com/foomo/dump-buckets/pkg/storage"
 )
 
@@ -19,6 +19,7 @@ const (
 
 type Storage interface {
 	NewWriter(ctx context.Context, path string, opts ...storage.WriterOption) (writer io.WriteCloser, err error)
+	NewReader(ctx context.Context, path string) (reader io.ReadCloser, err error)
 }
 
 // Tar takes a source and variable writers and walks 'source' writing each file
@@ -27,7 +28,7 @@ type Storage interface {
 func Tar(
 	ctx context.Context,
 	src string,
-	compress bool,
+	codec compression.Config,
 	writers ...io.Writer,
 ) error {
 	// ensure the src actually exists before trying to tar it
@@ -36,16 +37,25 @@ func Tar(
 	}
 
 	mw := io.MultiWriter(writers...)
-	writer := mw // default writer
-	if compress {
-		gzw := gzip.NewWriter(mw)
-		defer gzw.Close()
-		writer = gzw // compressing writer if compress is true
+	cw, err := codec.NewWriter(mw)
+	if err != nil {
+		return fmt.Errorf("unable to tar files: %w", err)
 	}
 
-	tw := tar.NewWriter(writer)
-	defer tw.Close()
+	tw := tar.NewWriter(cw)
+	if err := TarDir(ctx, tw, src, ""); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return cw.Close()
+}
 
+// TarDir walks 'src' and appends each regular file found to an already open tar
+// writer; entry names are relative to 'src' and placed below 'prefix', which allows
+// callers to stream several directories into a single archive one after another
+func TarDir(ctx context.Context, tw *tar.Writer, src string, prefix string) error {
 	// walk path
 	return filepath.Walk(src, func(file string, fi os.FileInfo, err error) error {
 		if ctx.Err() != nil {
@@ -69,6 +79,9 @@ func Tar(
 
 		// update the name to correctly reflect the desired destination when untaring
 		header.Name = strings.TrimPrefix(strings.Replace(file, src, "", -1), string(filepath.Separator))
+		if prefix != "" {
+			header.Name = filepath.ToSlash(filepath.Join(prefix, header.Name))
+		}
 
 		// write the header
 		if err := tw.WriteHeader(header); err != nil {
@@ -83,6 +96,7 @@ func Tar(
 
 		// copy file data into tar writer
 		if _, err := io.Copy(tw, f); err != nil {
+			f.Close()
 			return err
 		}
 
@@ -0,0 +1,46 @@
+package export
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTarDir(t *testing.T) {
+	ctx := context.Background()
+
+	src := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "refs", "heads"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "HEAD"), []byte("ref: refs/heads/main"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "refs", "heads", "main"), []byte("abc"), 0o644))
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, TarDir(ctx, tw, src, "repo-a"))
+	require.NoError(t, TarDir(ctx, tw, src, "repo-b"))
+	require.NoError(t, tw.Close())
+
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, header.Name)
+	}
+	require.ElementsMatch(t, []string{
+		"repo-a/HEAD",
+		"repo-a/refs/heads/main",
+		"repo-b/HEAD",
+		"repo-b/refs/heads/main",
+	}, names)
+}
@@ -0,0 +1,47 @@
+package export
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/foomo/dump-buckets/pkg/storage"
+)
+
+// ReadState decodes the JSON state object stored at path into v; found is false if
+// no state has been written yet, e.g. on the very first run of an incremental export
+func ReadState(ctx context.Context, s Storage, path string, v any) (found bool, err error) {
+	reader, err := s.NewReader(ctx, path)
+	if errors.Is(err, storage.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to open state %q: %w", path, err)
+	}
+	defer reader.Close()
+
+	if err := json.NewDecoder(reader).Decode(v); err != nil {
+		return false, fmt.Errorf("failed to decode state %q: %w", path, err)
+	}
+	return true, nil
+}
+
+// WriteState stores v as JSON state object at path, replacing the previous state
+func WriteState(ctx context.Context, s Storage, path string, v any) error {
+	writer, err := s.NewWriter(ctx, path, storage.WithContentType("application/json"))
+	if err != nil {
+		return fmt.Errorf("failed to initialize state writer: %w", err)
+	}
+
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		writer.Close()
+		return fmt.Errorf("failed to encode state %q: %w", path, err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to store state %q: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package naming
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/foomo/dump-buckets/pkg/export"
+)
+
+// DefaultTemplate names exports `<backup>/<source>/<timestamp><extension>`
+const DefaultTemplate Template = "{backup}/{source}/{ts}{ext}"
+
+const (
+	placeholderBackup   = "backup"
+	placeholderExporter = "exporter"
+	placeholderSource   = "source"
+	placeholderTS       = "ts"
+	placeholderExt      = "ext"
+	placeholderYear     = "yyyy"
+	placeholderMonth    = "mm"
+	placeholderDay      = "dd"
+	placeholderHour     = "hh"
+)
+
+var placeholderRegex = regexp.MustCompile(`\{([a-z]+)\}`)
+
+// datePlaceholders are derived from the timestamp
+var datePlaceholders = map[string]struct {
+	layout  string
+	pattern string
+}{
+	placeholderYear:  {layout: "2006", pattern: `\d{4}`},
+	placeholderMonth: {layout: "01", pattern: `\d{2}`},
+	placeholderDay:   {layout: "02", pattern: `\d{2}`},
+	placeholderHour:  {layout: "15", pattern: `\d{2}`},
+}
+
+// Template builds object names from placeholders, e.g. `{backup}/{exporter}/{yyyy}/{mm}/{ts}{ext}`.
+// Path segments left empty by a placeholder are dropped, so optional values don't produce `//`.
+type Template string
+
+// Values are the parts of an object name
+type Values struct {
+	Backup    string
+	Exporter  string
+	Source    string // e.g. the repository or space of the export, may contain slashes
+	Timestamp time.Time
+	Ext       string // including the leading dot, e.g. `.tar.gz`
+}
+
+// Validate checks that the template only uses known placeholders and contains the timestamp,
+// which keeps names of different runs apart
+func (t Template) Validate() error {
+	hasTS := false
+	for _, match := range placeholderRegex.FindAllStringSubmatch(string(t), -1) {
+		switch name := match[1]; name {
+		case placeholderBackup, placeholderExporter, placeholderSource, placeholderExt:
+		case placeholderTS:
+			hasTS = true
+		default:
+			if _, ok := datePlaceholders[name]; !ok {
+				return fmt.Errorf("unknown placeholder {%s} in name template %q", name, t)
+			}
+		}
+	}
+	if !hasTS {
+		return fmt.Errorf("name template %q must contain {%s}", t, placeholderTS)
+	}
+	return nil
+}
+
+// Format returns the object name for the values
+func (t Template) Format(v Values) string {
+	name := placeholderRegex.ReplaceAllStringFunc(string(t), func(placeholder string) string {
+		switch name := placeholder[1 : len(placeholder)-1]; name {
+		case placeholderBackup:
+			return strings.Trim(v.Backup, "/")
+		case placeholderExporter:
+			return strings.Trim(v.Exporter, "/")
+		case placeholderSource:
+			return strings.Trim(v.Source, "/")
+		case placeholderTS:
+			return v.Timestamp.Format(export.TimestampFormat)
+		case placeholderExt:
+			return v.Ext
+		default:
+			if date, ok := datePlaceholders[name]; ok {
+				return v.Timestamp.Format(date.layout)
+			}
+			return placeholder
+		}
+	})
+
+	var segments []string
+	for _, segment := range strings.Split(name, "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// Parse extracts the values from a name created by Format. Non-empty values of known are matched
+// literally, which is required for a backup or exporter containing slashes and to tell empty
+// segments apart.
+func (t Template) Parse(name string, known Values) (Values, error) {
+	pattern, err := t.regexp(known)
+	if err != nil {
+		return Values{}, err
+	}
+	match := pattern.FindStringSubmatch(name)
+	if match == nil {
+		return Values{}, fmt.Errorf("name %q does not match template %q", name, t)
+	}
+
+	v := known
+	for i, group := range pattern.SubexpNames() {
+		switch group {
+		case placeholderBackup:
+			v.Backup = match[i]
+		case placeholderExporter:
+			v.Exporter = match[i]
+		case placeholderSource:
+			v.Source = match[i]
+		case placeholderExt:
+			v.Ext = match[i]
+		case placeholderTS:
+			// timestamps are formatted in local time
+			ts, err := time.ParseInLocation(export.TimestampFormat, match[i], time.Local)
+			if err != nil {
+				return Values{}, fmt.Errorf("failed to parse timestamp of %q: %w", name, err)
+			}
+			v.Timestamp = ts
+		}
+	}
+	return v, nil
+}
+
+func (t Template) regexp(known Values) (*regexp.Regexp, error) {
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	literals := map[string]string{
+		placeholderBackup:   strings.Trim(known.Backup, "/"),
+		placeholderExporter: strings.Trim(known.Exporter, "/"),
+		placeholderSource:   strings.Trim(known.Source, "/"),
+	}
+
+	var sb strings.Builder
+	sb.WriteString("^")
+	captured := map[string]bool{}
+	needSeparator := false
+	for _, segment := range strings.Split(string(t), "/") {
+		if segment == "" {
+			continue
+		}
+		// segments consisting of placeholders only are dropped by Format if all of them are empty
+		optional := true
+		var segmentPattern strings.Builder
+		last := 0
+		for _, loc := range placeholderRegex.FindAllStringSubmatchIndex(segment, -1) {
+			if loc[0] > last {
+				optional = false
+				segmentPattern.WriteString(regexp.QuoteMeta(segment[last:loc[0]]))
+			}
+			last = loc[1]
+			name := segment[loc[2]:loc[3]]
+			switch {
+			case literals[name] != "":
+				optional = false
+				segmentPattern.WriteString(regexp.QuoteMeta(literals[name]))
+			case datePlaceholders[name].pattern != "":
+				optional = false
+				segmentPattern.WriteString(datePlaceholders[name].pattern)
+			case name == placeholderTS:
+				optional = false
+				if captured[name] {
+					segmentPattern.WriteString(`\d{8}T\d{6}`)
+				} else {
+					segmentPattern.WriteString(`(?P<ts>\d{8}T\d{6})`)
+				}
+			case captured[name]:
+				// placeholders used twice are only captured once
+				segmentPattern.WriteString(".*?")
+			case name == placeholderSource || name == placeholderExt:
+				segmentPattern.WriteString("(?P<" + name + ">.*?)")
+			default:
+				// only the source spans several segments unless the backup or exporter are known
+				segmentPattern.WriteString("(?P<" + name + ">[^/]*?)")
+			}
+			captured[name] = true
+		}
+		if last < len(segment) {
+			optional = false
+			segmentPattern.WriteString(regexp.QuoteMeta(segment[last:]))
+		}
+
+		switch {
+		case optional && needSeparator:
+			sb.WriteString("(?:/" + segmentPattern.String() + ")?")
+		case optional:
+			sb.WriteString("(?:" + segmentPattern.String() + "/)?")
+		default:
+			if needSeparator {
+				sb.WriteString("/")
+			}
+			sb.WriteString(segmentPattern.String())
+			needSeparator = true
+		}
+	}
+	sb.WriteString("$")
+	return regexp.Compile(sb.String())
+}
@@ -0,0 +1,81 @@
+package naming
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTemplate(t *testing.T) {
+	ts := time.Date(2024, 3, 5, 14, 30, 0, 0, time.Local)
+
+	tests := []struct {
+		name     string
+		template Template
+		values   Values
+		known    Values
+		want     string
+	}{
+		{
+			name:     "default",
+			template: DefaultTemplate,
+			values:   Values{Backup: "backup", Source: "foomo/dump-buckets", Timestamp: ts, Ext: ".tar.gz"},
+			known:    Values{Backup: "backup"},
+			want:     "backup/foomo/dump-buckets/20240305T143000.tar.gz",
+		},
+		{
+			name:     "empty source",
+			template: DefaultTemplate,
+			values:   Values{Backup: "backup", Timestamp: ts},
+			known:    Values{Backup: "backup"},
+			want:     "backup/20240305T143000",
+		},
+		{
+			name:     "date partitions",
+			template: "{backup}/{exporter}/{yyyy}/{mm}/{dd}/{source}.{ts}{ext}",
+			values:   Values{Backup: "nightly", Exporter: "mongo", Source: "orders", Timestamp: ts, Ext: ".gz"},
+			known:    Values{Backup: "nightly"},
+			want:     "nightly/mongo/2024/03/05/orders.20240305T143000.gz",
+		},
+		{
+			name:     "exporter and nested source",
+			template: "{backup}/{exporter}/{source}/{ts}{ext}",
+			values:   Values{Backup: "backup", Exporter: "contentful", Source: "space/master", Timestamp: ts, Ext: ".json.gz"},
+			known:    Values{Backup: "backup"},
+			want:     "backup/contentful/space/master/20240305T143000.json.gz",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, tt.template.Validate())
+			name := tt.template.Format(tt.values)
+			require.Equal(t, tt.want, name)
+
+			parsed, err := tt.template.Parse(name, tt.known)
+			require.NoError(t, err)
+			require.Equal(t, tt.values, parsed)
+		})
+	}
+}
+
+func TestTemplateParseAmbiguous(t *testing.T) {
+	// without a known backup an empty segment can't be told apart, earlier placeholders win
+	ts := time.Date(2024, 3, 5, 14, 30, 0, 0, time.Local)
+	parsed, err := DefaultTemplate.Parse("account/20240305T143000.archive.zst", Values{})
+	require.NoError(t, err)
+	require.Equal(t, Values{Backup: "account", Timestamp: ts, Ext: ".archive.zst"}, parsed)
+}
+
+func TestTemplateParseMismatch(t *testing.T) {
+	_, err := DefaultTemplate.Parse("backup/state.json", Values{Backup: "backup"})
+	require.Error(t, err)
+
+	_, err = DefaultTemplate.Parse("other/20240305T143000", Values{Backup: "backup"})
+	require.Error(t, err)
+}
+
+func TestTemplateValidate(t *testing.T) {
+	require.Error(t, Template("{backup}/{source}").Validate())
+	require.Error(t, Template("{backup}/{unknown}/{ts}").Validate())
+}
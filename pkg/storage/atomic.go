@@ -0,0 +1,272 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// PendingSuffix marks objects which have not been committed yet
+	PendingSuffix = ".pending"
+	// SuccessMarkerSuffix is appended to the output path of a committed run
+	SuccessMarkerSuffix = ".SUCCESS"
+)
+
+// Backend is implemented by the storage vendors
+type Backend interface {
+	NewWriter(ctx context.Context, path string, opts ...WriterOption) (writer io.WriteCloser, err error)
+	NewReader(ctx context.Context, path string) (reader io.ReadCloser, err error)
+	UpdateMetadata(ctx context.Context, path string, metadata map[string]string) error
+	Delete(ctx context.Context, path string) error
+	Rename(ctx context.Context, src, dst string) error
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+// SuccessMarker is written next to the output of a committed run
+type SuccessMarker struct {
+	CommittedAt time.Time `json:"committedAt"`
+	Objects     []string  `json:"objects"`
+}
+
+type pendingObject struct {
+	temp   string
+	closed bool
+}
+
+// Atomic writes all objects to temporary names first, they are moved to their final names by
+// Commit once the export completed, or deleted by Abort; so an interrupted export never leaves
+// a truncated object behind that looks valid
+type Atomic struct {
+	backend Backend
+	runID   string
+
+	mutex     sync.Mutex
+	pending   map[string]*pendingObject // keyed by the final path
+	committed []string
+}
+
+func NewAtomic(backend Backend) (*Atomic, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to generate run id: %w", err)
+	}
+	return &Atomic{
+		backend: backend,
+		runID:   hex.EncodeToString(id),
+		pending: map[string]*pendingObject{},
+	}, nil
+}
+
+// NewWriter writes to a temporary name, writers closed after the context has been canceled
+// discard the object
+func (a *Atomic) NewWriter(ctx context.Context, path string, opts ...WriterOption) (io.WriteCloser, error) {
+	temp := fmt.Sprintf("%s.%s%s", path, a.runID, PendingSuffix)
+	writer, err := a.backend.NewWriter(ctx, temp, opts...)
+	if err != nil {
+		return nil, err
+	}
+	object := &pendingObject{temp: temp}
+	a.mutex.Lock()
+	previous, replaced := a.pending[path]
+	a.pending[path] = object
+	a.mutex.Unlock()
+	if replaced && previous.temp != temp {
+		_ = a.backend.Delete(ctx, previous.temp)
+	}
+	return &atomicWriter{WriteCloser: writer, ctx: ctx, atomic: a, object: object}, nil
+}
+
+// NewReader reads pending objects of the run under their final name
+func (a *Atomic) NewReader(ctx context.Context, path string) (io.ReadCloser, error) {
+	return a.backend.NewReader(ctx, a.resolve(path))
+}
+
+func (a *Atomic) UpdateMetadata(ctx context.Context, path string, metadata map[string]string) error {
+	return a.backend.UpdateMetadata(ctx, a.resolve(path), metadata)
+}
+
+// Delete deletes the object, pending objects are discarded
+func (a *Atomic) Delete(ctx context.Context, path string) error {
+	a.mutex.Lock()
+	object, ok := a.pending[path]
+	delete(a.pending, path)
+	a.mutex.Unlock()
+	if ok {
+		return a.backend.Delete(ctx, object.temp)
+	}
+	return a.backend.Delete(ctx, path)
+}
+
+// Rename renames the object, pending objects will be committed under the new name
+func (a *Atomic) Rename(ctx context.Context, src, dst string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if object, ok := a.pending[src]; ok {
+		delete(a.pending, src)
+		a.pending[dst] = object
+		return nil
+	}
+	return a.backend.Rename(ctx, src, dst)
+}
+
+// Commit moves the pending objects to their final names, all pending objects if no paths are given
+func (a *Atomic) Commit(ctx context.Context, paths ...string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if len(paths) == 0 {
+		for path := range a.pending {
+			paths = append(paths, path)
+		}
+		slices.Sort(paths)
+	}
+	var errs []error
+	for _, path := range paths {
+		object, ok := a.pending[path]
+		if !ok {
+			continue
+		}
+		if !object.closed {
+			errs = append(errs, fmt.Errorf("failed to commit %s: writer has not been closed", path))
+			continue
+		}
+		if err := a.backend.Rename(ctx, object.temp, path); err != nil {
+			errs = append(errs, fmt.Errorf("failed to commit %s: %w", path, err))
+			continue
+		}
+		delete(a.pending, path)
+		a.committed = append(a.committed, path)
+	}
+	return errors.Join(errs...)
+}
+
+// Abort deletes all pending objects, also if the context has been canceled
+func (a *Atomic) Abort(ctx context.Context) error {
+	ctx = context.WithoutCancel(ctx)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	var errs []error
+	for path, object := range a.pending {
+		if err := a.backend.Delete(ctx, object.temp); err != nil && !errors.Is(err, ErrNotExist) {
+			errs = append(errs, fmt.Errorf("failed to discard %s: %w", path, err))
+		}
+		delete(a.pending, path)
+	}
+	return errors.Join(errs...)
+}
+
+// Committer is implemented by atomic storages
+type Committer interface {
+	Commit(ctx context.Context, paths ...string) error
+}
+
+// Commit keeps the objects of a finished part of a run, e.g. a single table or environment, even
+// if the run fails later on; storages which aren't atomic write the final names right away
+func Commit(ctx context.Context, s any, paths ...string) error {
+	c, ok := s.(Committer)
+	if !ok || len(paths) == 0 {
+		return nil
+	}
+	return c.Commit(ctx, paths...)
+}
+
+// Committed returns the paths of the committed objects
+func (a *Atomic) Committed() []string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return slices.Clone(a.committed)
+}
+
+// WriteMarker writes the success marker listing the committed objects next to the output path,
+// nothing is written if no objects have been committed
+func (a *Atomic) WriteMarker(ctx context.Context, outputPath string) error {
+	a.mutex.Lock()
+	marker := SuccessMarker{CommittedAt: time.Now(), Objects: slices.Clone(a.committed)}
+	a.mutex.Unlock()
+	if len(marker.Objects) == 0 {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(marker, "", "  ")
+	if err != nil {
+		return err
+	}
+	writer, err := a.backend.NewWriter(ctx, outputPath+SuccessMarkerSuffix, WithContentType("application/json"))
+	if err != nil {
+		return fmt.Errorf("failed to initialize marker writer: %w", err)
+	}
+	if _, err := io.Copy(writer, bytes.NewReader(data)); err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+// committedPath strips the run id and suffix of pending objects
+func committedPath(path string) string {
+	base, ok := strings.CutSuffix(path, PendingSuffix)
+	if !ok {
+		return path
+	}
+	if i := strings.LastIndex(base, "."); i >= 0 {
+		return base[:i]
+	}
+	return base
+}
+
+// discard deletes the object of a canceled writer, which may have been renamed meanwhile
+func (a *Atomic) discard(ctx context.Context, object *pendingObject) {
+	a.mutex.Lock()
+	for path, o := range a.pending {
+		if o == object {
+			delete(a.pending, path)
+		}
+	}
+	a.mutex.Unlock()
+	_ = a.backend.Delete(ctx, object.temp)
+}
+
+// List lists the stored objects, including pending objects under their temporary names
+func (a *Atomic) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	return a.backend.List(ctx, prefix)
+}
+
+func (a *Atomic) resolve(path string) string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if object, ok := a.pending[path]; ok {
+		return object.temp
+	}
+	return path
+}
+
+type atomicWriter struct {
+	io.WriteCloser
+	ctx    context.Context
+	atomic *Atomic
+	object *pendingObject
+}
+
+func (w *atomicWriter) Close() error {
+	err := w.WriteCloser.Close()
+	if ctxErr := w.ctx.Err(); ctxErr != nil {
+		w.atomic.discard(context.WithoutCancel(w.ctx), w.object)
+		return ctxErr
+	}
+	if err != nil {
+		return err
+	}
+	w.atomic.mutex.Lock()
+	w.object.closed = true
+	w.atomic.mutex.Unlock()
+	return nil
+}
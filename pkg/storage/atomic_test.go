@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeObject(t *testing.T, ctx context.Context, s Backend, path, content string) io.WriteCloser {
+	t.Helper()
+	writer, err := s.NewWriter(ctx, path)
+	require.NoError(t, err)
+	_, err = io.WriteString(writer, content)
+	require.NoError(t, err)
+	return writer
+}
+
+func listFiles(t *testing.T, root string) []string {
+	t.Helper()
+	var files []string
+	require.NoError(t, filepath.WalkDir(root, func(file string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, file)
+		files = append(files, filepath.ToSlash(rel))
+		return err
+	}))
+	return files
+}
+
+func TestAtomic(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("commit", func(t *testing.T) {
+		root := t.TempDir()
+		fs, err := NewFSStorage(ctx, root)
+		require.NoError(t, err)
+		atomic, err := NewAtomic(fs)
+		require.NoError(t, err)
+
+		require.NoError(t, writeObject(t, ctx, atomic, "backup/dump", "data").Close())
+		require.NoError(t, writeObject(t, ctx, atomic, "backup/state.json", "{}").Close())
+		for _, file := range listFiles(t, root) {
+			require.Contains(t, file, PendingSuffix)
+		}
+
+		// pending objects are readable under their final name
+		reader, err := atomic.NewReader(ctx, "backup/dump")
+		require.NoError(t, err)
+		data, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.NoError(t, reader.Close())
+		require.Equal(t, "data", string(data))
+
+		require.NoError(t, atomic.Commit(ctx))
+		require.NoError(t, atomic.WriteMarker(ctx, "backup/dump"))
+		require.ElementsMatch(t, []string{"backup/dump", "backup/dump.SUCCESS", "backup/state.json"}, listFiles(t, root))
+
+		var marker SuccessMarker
+		markerData, err := os.ReadFile(filepath.Join(root, "backup/dump.SUCCESS"))
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(markerData, &marker))
+		require.Equal(t, []string{"backup/dump", "backup/state.json"}, marker.Objects)
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		root := t.TempDir()
+		fs, err := NewFSStorage(ctx, root)
+		require.NoError(t, err)
+		atomic, err := NewAtomic(fs)
+		require.NoError(t, err)
+
+		require.NoError(t, writeObject(t, ctx, atomic, "backup/dump", "truncated").Close())
+		require.NoError(t, writeObject(t, ctx, atomic, "backup/dump.log", "broken").Close())
+		require.NoError(t, atomic.Rename(ctx, "backup/dump", "backup/dump.failed"))
+		require.NoError(t, atomic.UpdateMetadata(ctx, "backup/dump.failed", map[string]string{"Status": "failed"}))
+
+		// objects committed explicitly survive the abort, committing no paths commits nothing
+		require.NoError(t, Commit(ctx, atomic))
+		require.NoError(t, Commit(ctx, atomic, "backup/dump.failed"))
+		require.NoError(t, Commit(ctx, fs, "backup/dump.log"))
+		require.NoError(t, atomic.Abort(ctx))
+		require.Equal(t, []string{"backup/dump.failed"}, listFiles(t, root))
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		root := t.TempDir()
+		fs, err := NewFSStorage(ctx, root)
+		require.NoError(t, err)
+		atomic, err := NewAtomic(fs)
+		require.NoError(t, err)
+
+		cancelCtx, cancel := context.WithCancel(ctx)
+		writer := writeObject(t, cancelCtx, atomic, "backup/dump", "partial")
+		cancel()
+		require.ErrorIs(t, writer.Close(), context.Canceled)
+		require.Empty(t, listFiles(t, root))
+		require.NoError(t, atomic.Commit(ctx))
+		require.NoError(t, atomic.WriteMarker(ctx, "backup/dump"))
+		require.Empty(t, listFiles(t, root))
+	})
+
+	t.Run("unclosed writer", func(t *testing.T) {
+		fs, err := NewFSStorage(ctx, t.TempDir())
+		require.NoError(t, err)
+		atomic, err := NewAtomic(fs)
+		require.NoError(t, err)
+
+		writer := writeObject(t, ctx, atomic, "backup/dump", "partial")
+		require.ErrorContains(t, atomic.Commit(ctx), "has not been closed")
+		require.NoError(t, writer.Close())
+		require.NoError(t, atomic.Commit(ctx))
+	})
+}
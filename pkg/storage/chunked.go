@@ -0,0 +1,365 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// PartsSuffix is appended to the path of an object for the directory of its parts
+	PartsSuffix = ".parts"
+	// partManifestName is the name of the manifest in the parts directory
+	partManifestName = "manifest.json"
+
+	chunkedDefaultPartSize     = 64 << 20
+	chunkedDefaultMaxRetries   = 3
+	chunkedDefaultRetryBackoff = time.Second
+)
+
+// Composer is implemented by backends which concatenate stored objects into a new object
+type Composer interface {
+	Compose(ctx context.Context, dst string, srcs []string, opts ...WriterOption) error
+}
+
+// ChunkedConfig configures chunked uploads
+type ChunkedConfig struct {
+	PartSize     int64         // Size of the uploaded parts, defaults to 64 MiB
+	MaxRetries   int           // Retries of failed part uploads, defaults to 3
+	RetryBackoff time.Duration // Initial backoff between retries, doubled on each retry, defaults to 1s
+}
+
+// PartManifest lists the uploaded parts of an object
+type PartManifest struct {
+	Path     string `json:"path"`
+	PartSize int64  `json:"partSize"`
+	Parts    []Part `json:"parts"`
+	Complete bool   `json:"complete"`
+}
+
+// Part is an uploaded part of an object
+type Part struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Chunked uploads objects in parts of a fixed size, each with retries, and composes them once
+// the stream is complete. The part manifest is updated after every part, so a writer for the
+// same object resumes by skipping parts whose checksum matches; the parts of an object which
+// has not been composed can be read with ReadParts. Resuming only saves uploads for streams
+// which reproduce the same bytes, e.g. compressed files; most dumps differ between runs, their
+// parts are uploaded again from the first part that differs.
+type Chunked struct {
+	Backend
+	composer Composer
+	config   ChunkedConfig
+}
+
+func NewChunked(backend Backend, config ChunkedConfig) (*Chunked, error) {
+	composer, ok := backend.(Composer)
+	if !ok {
+		return nil, fmt.Errorf("storage %T does not support composing objects", backend)
+	}
+	if config.PartSize <= 0 {
+		config.PartSize = chunkedDefaultPartSize
+	}
+	if config.MaxRetries < 0 {
+		config.MaxRetries = 0
+	} else if config.MaxRetries == 0 {
+		config.MaxRetries = chunkedDefaultMaxRetries
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = chunkedDefaultRetryBackoff
+	}
+	return &Chunked{Backend: backend, composer: composer, config: config}, nil
+}
+
+func (c *Chunked) NewWriter(ctx context.Context, path string, opts ...WriterOption) (io.WriteCloser, error) {
+	prefix := partsPrefix(path)
+	w := &chunkedWriter{
+		ctx:      ctx,
+		chunked:  c,
+		path:     path,
+		opts:     opts,
+		prefix:   prefix,
+		manifest: PartManifest{Path: path, PartSize: c.config.PartSize},
+		resume:   map[string]Part{},
+	}
+	previous, err := readPartManifest(ctx, c.Backend, prefix)
+	if err != nil && !errors.Is(err, ErrNotExist) {
+		return nil, err
+	}
+	if err == nil && previous.PartSize == c.config.PartSize {
+		for _, part := range previous.Parts {
+			w.resume[part.Path] = part
+		}
+	}
+	return w, nil
+}
+
+// NewReader reassembles the parts of objects which have not been composed
+func (c *Chunked) NewReader(ctx context.Context, path string) (io.ReadCloser, error) {
+	reader, err := c.Backend.NewReader(ctx, path)
+	if errors.Is(err, ErrNotExist) {
+		if parts, partsErr := ReadParts(ctx, c.Backend, path); partsErr == nil {
+			return parts, nil
+		}
+	}
+	return reader, err
+}
+
+// retry calls fn until it succeeds, the retries are exhausted or the context is done
+func (c *Chunked) retry(ctx context.Context, name string, fn func() error) error {
+	backoff := c.config.RetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt > c.config.MaxRetries || ctx.Err() != nil {
+			return err
+		}
+		slog.Warn("Retrying upload", slog.String("path", name), slog.Int("attempt", attempt), slog.Duration("backoff", backoff), slog.Any("error", err))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// ReadParts reads the object from the parts listed in its manifest, each part is verified by its
+// checksum; the reader fails at the end if the upload has not been completed
+func ReadParts(ctx context.Context, b Backend, path string) (io.ReadCloser, error) {
+	manifest, err := readPartManifest(ctx, b, partsPrefix(path))
+	if err != nil {
+		return nil, err
+	}
+	return &partsReader{ctx: ctx, backend: b, manifest: manifest}, nil
+}
+
+// PruneParts deletes the parts of uploads below the prefix which were not updated since before,
+// e.g. of failed runs which are not going to be resumed; the paths of the pruned uploads are
+// returned
+func PruneParts(ctx context.Context, b Backend, prefix string, before time.Time) ([]string, error) {
+	objects, err := b.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	uploads := map[string][]ObjectInfo{}
+	var paths []string
+	for _, object := range objects {
+		path, _, ok := strings.Cut(object.Path, PartsSuffix+"/")
+		if !ok {
+			continue
+		}
+		if _, ok := uploads[path]; !ok {
+			paths = append(paths, path)
+		}
+		uploads[path] = append(uploads[path], object)
+	}
+
+	var pruned []string
+	for _, path := range paths {
+		parts := uploads[path]
+		if slices.ContainsFunc(parts, func(part ObjectInfo) bool { return !part.Updated.Before(before) }) {
+			continue
+		}
+		for _, part := range parts {
+			if err := b.Delete(ctx, part.Path); err != nil && !errors.Is(err, ErrNotExist) {
+				return pruned, fmt.Errorf("failed to delete part %s: %w", part.Path, err)
+			}
+		}
+		pruned = append(pruned, path)
+	}
+	return pruned, nil
+}
+
+// partsPrefix is the directory of the parts, pending objects share it with their final path so
+// a re-run resumes the upload
+func partsPrefix(path string) string {
+	return committedPath(path) + PartsSuffix + "/"
+}
+
+func readPartManifest(ctx context.Context, b Backend, prefix string) (PartManifest, error) {
+	var manifest PartManifest
+	reader, err := b.NewReader(ctx, prefix+partManifestName)
+	if err != nil {
+		return manifest, err
+	}
+	defer reader.Close()
+	if err := json.NewDecoder(reader).Decode(&manifest); err != nil {
+		return manifest, fmt.Errorf("failed to decode part manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+type chunkedWriter struct {
+	ctx      context.Context
+	chunked  *Chunked
+	path     string
+	opts     []WriterOption
+	prefix   string
+	buf      []byte
+	manifest PartManifest
+	resume   map[string]Part // parts of a previous upload, keyed by path, dropped once a part differs
+	err      error
+}
+
+func (w *chunkedWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), int(w.chunked.config.PartSize)-len(w.buf))
+		w.buf = append(w.buf, p[:n]...)
+		p = p[n:]
+		written += n
+		if int64(len(w.buf)) == w.chunked.config.PartSize {
+			if w.err = w.flush(); w.err != nil {
+				return written, w.err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flush uploads the buffer as the next part, unless a previous upload stored the same part
+func (w *chunkedWriter) flush() error {
+	sum := sha256.Sum256(w.buf)
+	part := Part{
+		Path:   fmt.Sprintf("%s%05d", w.prefix, len(w.manifest.Parts)),
+		Size:   int64(len(w.buf)),
+		SHA256: hex.EncodeToString(sum[:]),
+	}
+	if previous, ok := w.resume[part.Path]; !ok || previous != part || !w.stored(part) {
+		// the stream diverged from the previous upload, later parts won't match either
+		w.resume = nil
+		if err := w.chunked.retry(w.ctx, part.Path, func() error {
+			return w.upload(part.Path, w.buf, WithMetadata("sha256", part.SHA256))
+		}); err != nil {
+			return fmt.Errorf("failed to upload part %s: %w", part.Path, err)
+		}
+	}
+	w.manifest.Parts = append(w.manifest.Parts, part)
+	w.buf = w.buf[:0]
+	return w.writeManifest()
+}
+
+// stored reports whether the part of a previous upload is still stored
+func (w *chunkedWriter) stored(part Part) bool {
+	object, err := stat(w.ctx, w.chunked.Backend, part.Path)
+	return err == nil && object.Size == part.Size
+}
+
+func (w *chunkedWriter) upload(path string, data []byte, opts ...WriterOption) error {
+	writer, err := w.chunked.Backend.NewWriter(w.ctx, path, opts...)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(writer, bytes.NewReader(data)); err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+func (w *chunkedWriter) writeManifest() error {
+	data, err := json.MarshalIndent(w.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return w.chunked.retry(w.ctx, w.prefix+partManifestName, func() error {
+		return w.upload(w.prefix+partManifestName, data, WithContentType("application/json"))
+	})
+}
+
+// Close uploads the last part and composes the parts, the parts are deleted afterwards
+func (w *chunkedWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if len(w.buf) > 0 || len(w.manifest.Parts) == 0 {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+	w.manifest.Complete = true
+	if err := w.writeManifest(); err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(w.manifest.Parts))
+	for _, part := range w.manifest.Parts {
+		paths = append(paths, part.Path)
+	}
+	if err := w.chunked.retry(w.ctx, w.path, func() error {
+		return w.chunked.composer.Compose(w.ctx, w.path, paths, w.opts...)
+	}); err != nil {
+		return fmt.Errorf("failed to compose parts of %s: %w", w.path, err)
+	}
+	for _, path := range append(paths, w.prefix+partManifestName) {
+		if err := w.chunked.Backend.Delete(w.ctx, path); err != nil && !errors.Is(err, ErrNotExist) {
+			return fmt.Errorf("failed to delete part %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+type partsReader struct {
+	ctx      context.Context
+	backend  Backend
+	manifest PartManifest
+	index    int
+	current  *bytes.Reader
+}
+
+func (r *partsReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if r.index == len(r.manifest.Parts) {
+				if !r.manifest.Complete {
+					return 0, fmt.Errorf("upload of %s is incomplete: %w", r.manifest.Path, io.ErrUnexpectedEOF)
+				}
+				return 0, io.EOF
+			}
+			part := r.manifest.Parts[r.index]
+			reader, err := r.backend.NewReader(r.ctx, part.Path)
+			if err != nil {
+				return 0, err
+			}
+			data, err := io.ReadAll(reader)
+			reader.Close()
+			if err != nil {
+				return 0, err
+			}
+			if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != part.SHA256 {
+				return 0, fmt.Errorf("checksum of part %s does not match", part.Path)
+			}
+			r.current = bytes.NewReader(data)
+			r.index++
+		}
+		n, err := r.current.Read(p)
+		if errors.Is(err, io.EOF) {
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *partsReader) Close() error {
+	return nil
+}
@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var errUnavailable = errors.New("unavailable")
+
+// flakyBackend fails writers of the given paths a number of times and counts the writers
+type flakyBackend struct {
+	*FSStorage
+	mutex    sync.Mutex
+	failures map[string]int
+	writes   map[string]int
+}
+
+func (b *flakyBackend) NewWriter(ctx context.Context, path string, opts ...WriterOption) (io.WriteCloser, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.failures[path] != 0 {
+		b.failures[path]--
+		return nil, errUnavailable
+	}
+	b.writes[path]++
+	return b.FSStorage.NewWriter(ctx, path, opts...)
+}
+
+func (b *flakyBackend) Compose(ctx context.Context, dst string, srcs []string, opts ...WriterOption) error {
+	b.mutex.Lock()
+	if b.failures[dst] != 0 {
+		b.failures[dst]--
+		b.mutex.Unlock()
+		return errUnavailable
+	}
+	b.mutex.Unlock()
+	return b.FSStorage.Compose(ctx, dst, srcs, opts...)
+}
+
+func readAll(t *testing.T, reader io.ReadCloser) string {
+	t.Helper()
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	return string(data)
+}
+
+func TestChunked(t *testing.T) {
+	ctx := context.Background()
+	newBackend := func(t *testing.T) (string, *flakyBackend) {
+		t.Helper()
+		root := t.TempDir()
+		fs, err := NewFSStorage(ctx, root)
+		require.NoError(t, err)
+		return root, &flakyBackend{FSStorage: fs, failures: map[string]int{}, writes: map[string]int{}}
+	}
+	config := ChunkedConfig{PartSize: 4, MaxRetries: 1, RetryBackoff: time.Millisecond}
+
+	t.Run("compose", func(t *testing.T) {
+		root, backend := newBackend(t)
+		// the first upload of a part fails and is retried
+		backend.failures["backup/dump.parts/00001"] = 1
+		chunked, err := NewChunked(backend, config)
+		require.NoError(t, err)
+
+		require.NoError(t, writeObject(t, ctx, chunked, "backup/dump", "0123456789").Close())
+		require.Equal(t, []string{"backup/dump"}, listFiles(t, root))
+		reader, err := chunked.NewReader(ctx, "backup/dump")
+		require.NoError(t, err)
+		require.Equal(t, "0123456789", readAll(t, reader))
+		require.Equal(t, 1, backend.writes["backup/dump.parts/00001"])
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		root, backend := newBackend(t)
+		chunked, err := NewChunked(backend, config)
+		require.NoError(t, err)
+		require.NoError(t, writeObject(t, ctx, chunked, "backup/dump", "").Close())
+		require.Equal(t, []string{"backup/dump"}, listFiles(t, root))
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		_, backend := newBackend(t)
+		backend.failures["backup/dump.parts/00002"] = 2
+		chunked, err := NewChunked(backend, config)
+		require.NoError(t, err)
+
+		writer, err := chunked.NewWriter(ctx, "backup/dump")
+		require.NoError(t, err)
+		_, err = io.WriteString(writer, "0123456789ab")
+		require.ErrorIs(t, err, errUnavailable)
+
+		// the parts uploaded before are readable, but the upload is incomplete
+		parts, err := ReadParts(ctx, backend, "backup/dump")
+		require.NoError(t, err)
+		data, err := io.ReadAll(parts)
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		require.Equal(t, "01234567", string(data))
+
+		// a re-run of the same stream only uploads the missing parts
+		require.NoError(t, writeObject(t, ctx, chunked, "backup/dump", "0123456789abcd").Close())
+		require.Equal(t, 1, backend.writes["backup/dump.parts/00000"])
+		require.Equal(t, 1, backend.writes["backup/dump.parts/00001"])
+		require.Equal(t, 1, backend.writes["backup/dump.parts/00002"])
+		reader, err := chunked.NewReader(ctx, "backup/dump")
+		require.NoError(t, err)
+		require.Equal(t, "0123456789abcd", readAll(t, reader))
+	})
+
+	t.Run("resume diverged", func(t *testing.T) {
+		_, backend := newBackend(t)
+		backend.failures["backup/dump.parts/00002"] = 2
+		chunked, err := NewChunked(backend, config)
+		require.NoError(t, err)
+
+		writer, err := chunked.NewWriter(ctx, "backup/dump")
+		require.NoError(t, err)
+		_, err = io.WriteString(writer, "0123456789ab")
+		require.ErrorIs(t, err, errUnavailable)
+
+		// once a part differs the later parts are uploaded again, even if they match
+		require.NoError(t, writeObject(t, ctx, chunked, "backup/dump", "X123456789abcd").Close())
+		require.Equal(t, 2, backend.writes["backup/dump.parts/00000"])
+		require.Equal(t, 2, backend.writes["backup/dump.parts/00001"])
+		reader, err := chunked.NewReader(ctx, "backup/dump")
+		require.NoError(t, err)
+		require.Equal(t, "X123456789abcd", readAll(t, reader))
+	})
+
+	t.Run("resume pending", func(t *testing.T) {
+		root, backend := newBackend(t)
+		chunked, err := NewChunked(backend, config)
+		require.NoError(t, err)
+
+		// pending objects of different runs share the parts of their final path
+		for range 2 {
+			atomic, err := NewAtomic(chunked)
+			require.NoError(t, err)
+			backend.failures["backup/dump.parts/00001"] = 2
+			writer := writeObject(t, ctx, atomic, "backup/dump", "0123456")
+			require.ErrorIs(t, writer.Close(), errUnavailable)
+			require.NoError(t, atomic.Abort(ctx))
+		}
+		require.Equal(t, 1, backend.writes["backup/dump.parts/00000"])
+
+		atomic, err := NewAtomic(chunked)
+		require.NoError(t, err)
+		require.NoError(t, writeObject(t, ctx, atomic, "backup/dump", "0123456").Close())
+		require.NoError(t, atomic.Commit(ctx))
+		require.Equal(t, 1, backend.writes["backup/dump.parts/00000"])
+		require.Equal(t, []string{"backup/dump"}, listFiles(t, root))
+	})
+
+	t.Run("reassemble", func(t *testing.T) {
+		_, backend := newBackend(t)
+		// composing fails, so the parts are kept with a complete manifest
+		chunked, err := NewChunked(backend, config)
+		require.NoError(t, err)
+		backend.failures["backup/dump"] = 2
+		require.ErrorIs(t, writeObject(t, ctx, chunked, "backup/dump", "0123456789").Close(), errUnavailable)
+
+		reader, err := chunked.NewReader(ctx, "backup/dump")
+		require.NoError(t, err)
+		require.Equal(t, "0123456789", readAll(t, reader))
+
+		// corrupted parts are detected
+		require.NoError(t, writeObject(t, ctx, backend.FSStorage, "backup/dump.parts/00001", "XXXX").Close())
+		reader, err = ReadParts(ctx, backend, "backup/dump")
+		require.NoError(t, err)
+		_, err = io.ReadAll(reader)
+		require.ErrorContains(t, err, "checksum")
+	})
+
+	t.Run("prune", func(t *testing.T) {
+		root, backend := newBackend(t)
+		backend.failures["backup/dump.parts/00001"] = 2
+		chunked, err := NewChunked(backend, config)
+		require.NoError(t, err)
+		writer, err := chunked.NewWriter(ctx, "backup/dump")
+		require.NoError(t, err)
+		_, err = io.WriteString(writer, "0123456789")
+		require.ErrorIs(t, err, errUnavailable)
+		require.NoError(t, writeObject(t, ctx, chunked, "backup/other", "0123").Close())
+
+		// recent uploads are kept to be resumed
+		pruned, err := PruneParts(ctx, backend, "backup/", time.Now().Add(-time.Hour))
+		require.NoError(t, err)
+		require.Empty(t, pruned)
+
+		pruned, err = PruneParts(ctx, backend, "backup/", time.Now().Add(time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, []string{"backup/dump"}, pruned)
+		require.Equal(t, []string{"backup/other"}, listFiles(t, root))
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		_, err := NewChunked(brokenBackend{}, config)
+		require.Error(t, err)
+	})
+}
+
+func TestCommittedPath(t *testing.T) {
+	for _, path := range []string{"backup/dump", "backup/dump.0123456789abcdef.pending"} {
+		require.Equal(t, "backup/dump", committedPath(path), path)
+	}
+	require.True(t, strings.HasPrefix(partsPrefix("backup/dump.0123456789abcdef.pending"), "backup/dump.parts/"))
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FSStorage stores objects as files below a root directory, e.g. a mounted volume;
+// writer attributes are not persisted
+type FSStorage struct {
+	root string
+}
+
+func NewFSStorage(_ context.Context, root string) (*FSStorage, error) {
+	if root == "" {
+		return nil, errors.New("filesystem storage requires a root directory")
+	}
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create root directory: %w", err)
+	}
+	return &FSStorage{root: root}, nil
+}
+
+func (s *FSStorage) NewWriter(_ context.Context, path string, _ ...WriterOption) (writer io.WriteCloser, err error) {
+	name := s.filename(path)
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return nil, err
+	}
+	return os.Create(name)
+}
+
+func (s *FSStorage) NewReader(_ context.Context, path string) (reader io.ReadCloser, err error) {
+	f, err := os.Open(s.filename(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%s: %w", path, ErrNotExist)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *FSStorage) filename(path string) string {
+	return filepath.Join(s.root, filepath.FromSlash(filepath.Clean("/"+path)))
+}
+
+// UpdateMetadata is a no-op, files have no metadata
+func (s *FSStorage) UpdateMetadata(_ context.Context, path string, _ map[string]string) error {
+	if _, err := os.Stat(s.filename(path)); errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s: %w", path, ErrNotExist)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *FSStorage) Delete(_ context.Context, path string) error {
+	err := os.Remove(s.filename(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s: %w", path, ErrNotExist)
+	}
+	return err
+}
+
+func (s *FSStorage) Rename(_ context.Context, src, dst string) error {
+	name := s.filename(dst)
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+	err := os.Rename(s.filename(src), name)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s: %w", src, ErrNotExist)
+	}
+	return err
+}
+
+// List returns all files whose path starts with the prefix, sorted by path
+func (s *FSStorage) List(_ context.Context, prefix string) ([]ObjectInfo, error) {
+	// the prefix may end within a file or directory name
+	dir := s.filename(prefix)
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		dir = filepath.Dir(dir)
+	}
+	var objects []ObjectInfo
+	err := filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(s.root, file)
+		if err != nil {
+			return err
+		}
+		path := filepath.ToSlash(rel)
+		if !strings.HasPrefix(path, strings.TrimPrefix(prefix, "/")) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, ObjectInfo{Path: path, Size: info.Size(), Updated: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %w", err)
+	}
+	return objects, nil
+}
+
+// Compose concatenates the files into dst
+func (s *FSStorage) Compose(ctx context.Context, dst string, srcs []string, opts ...WriterOption) (err error) {
+	writer, err := s.NewWriter(ctx, dst, opts...)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := writer.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	for _, src := range srcs {
+		reader, err := s.NewReader(ctx, src)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(writer, reader)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFSStorage(t *testing.T) {
+	ctx := context.Background()
+	fs, err := NewFSStorage(ctx, t.TempDir())
+	require.NoError(t, err)
+
+	writer, err := fs.NewWriter(ctx, "backup/20240101T000000/data.json", WithContentType("application/json"))
+	require.NoError(t, err)
+	_, err = io.WriteString(writer, "{}")
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	reader, err := fs.NewReader(ctx, "backup/20240101T000000/data.json")
+	require.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	require.Equal(t, "{}", string(data))
+
+	_, err = fs.NewReader(ctx, "backup/missing.json")
+	require.ErrorIs(t, err, ErrNotExist)
+
+	require.NoError(t, fs.UpdateMetadata(ctx, "backup/20240101T000000/data.json", map[string]string{"ExitCode": "0"}))
+	require.NoError(t, fs.Rename(ctx, "backup/20240101T000000/data.json", "backup/20240101T000000/data.json.failed"))
+	_, err = fs.NewReader(ctx, "backup/20240101T000000/data.json")
+	require.ErrorIs(t, err, ErrNotExist)
+	require.NoError(t, fs.Delete(ctx, "backup/20240101T000000/data.json.failed"))
+	require.ErrorIs(t, fs.Delete(ctx, "backup/20240101T000000/data.json.failed"), ErrNotExist)
+
+	for _, path := range []string{"backup/20240101T000000.gz", "backup/20240102T000000.gz", "backup-other/20240101T000000.gz"} {
+		writer, err := fs.NewWriter(ctx, path)
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+	}
+	objects, err := fs.List(ctx, "backup/")
+	require.NoError(t, err)
+	require.Len(t, objects, 2)
+	require.Equal(t, "backup/20240101T000000.gz", objects[0].Path)
+	objects, err = fs.List(ctx, "backup")
+	require.NoError(t, err)
+	require.Len(t, objects, 3)
+	objects, err = fs.List(ctx, "")
+	require.NoError(t, err)
+	require.Len(t, objects, 3)
+	objects, err = fs.List(ctx, "missing/")
+	require.NoError(t, err)
+	require.Empty(t, objects)
+
+	// paths can not escape the root directory
+	require.Equal(t, fs.filename("etc/passwd"), fs.filename("../../etc/passwd"))
+}
@@ -2,11 +2,17 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
 )
 
+// gcsMaxComposeSources is the maximum number of objects composed by one request
+const gcsMaxComposeSources = 32
+
 type GCSBackup struct {
 	client     *storage.Client
 	bucketName string
@@ -48,3 +54,112 @@ func (gcs *GCSBackup) NewWriter(ctx context.Context, path string, opts ...Writer
 
 	return w, nil
 }
+
+// NewReader opens the object as stored, gzip encoded objects are not transparently decompressed
+func (gcs *GCSBackup) NewReader(ctx context.Context, path string) (reader io.ReadCloser, err error) {
+	r, err := gcs.client.Bucket(gcs.bucketName).Object(path).ReadCompressed(true).NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, fmt.Errorf("%s: %w", path, ErrNotExist)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// UpdateMetadata merges the metadata into the metadata of the stored object
+func (gcs *GCSBackup) UpdateMetadata(ctx context.Context, path string, metadata map[string]string) error {
+	_, err := gcs.client.Bucket(gcs.bucketName).Object(path).Update(ctx, storage.ObjectAttrsToUpdate{Metadata: metadata})
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return fmt.Errorf("%s: %w", path, ErrNotExist)
+	}
+	return err
+}
+
+func (gcs *GCSBackup) Delete(ctx context.Context, path string) error {
+	err := gcs.client.Bucket(gcs.bucketName).Object(path).Delete(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return fmt.Errorf("%s: %w", path, ErrNotExist)
+	}
+	return err
+}
+
+// Rename copies the object including its attributes to the new path and deletes the original
+func (gcs *GCSBackup) Rename(ctx context.Context, src, dst string) error {
+	bucket := gcs.client.Bucket(gcs.bucketName)
+	if _, err := bucket.Object(dst).CopierFrom(bucket.Object(src)).Run(ctx); err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return fmt.Errorf("%s: %w", src, ErrNotExist)
+		}
+		return err
+	}
+	return gcs.Delete(ctx, src)
+}
+
+// List returns all objects whose path starts with the prefix
+func (gcs *GCSBackup) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	it := gcs.client.Bucket(gcs.bucketName).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects: %w", err)
+		}
+		objects = append(objects, ObjectInfo{
+			Path:            attrs.Name,
+			Size:            attrs.Size,
+			Updated:         attrs.Updated,
+			ContentType:     attrs.ContentType,
+			ContentEncoding: attrs.ContentEncoding,
+			Metadata:        attrs.Metadata,
+		})
+	}
+}
+
+// Compose concatenates the objects into dst, more than 32 objects are composed in several rounds
+// through intermediate objects
+func (gcs *GCSBackup) Compose(ctx context.Context, dst string, srcs []string, opts ...WriterOption) error {
+	var intermediates []string
+	defer func() {
+		for _, name := range intermediates {
+			_ = gcs.Delete(context.WithoutCancel(ctx), name)
+		}
+	}()
+	for round := 0; len(srcs) > gcsMaxComposeSources; round++ {
+		var composed []string
+		for i := 0; i < len(srcs); i += gcsMaxComposeSources {
+			name := fmt.Sprintf("%s.compose-%d-%d", dst, round, i/gcsMaxComposeSources)
+			intermediates = append(intermediates, name)
+			if err := gcs.compose(ctx, name, srcs[i:min(i+gcsMaxComposeSources, len(srcs))], &WriterAttrs{}); err != nil {
+				return err
+			}
+			composed = append(composed, name)
+		}
+		srcs = composed
+	}
+
+	attrs := &WriterAttrs{}
+	for _, opt := range opts {
+		opt(attrs)
+	}
+	return gcs.compose(ctx, dst, srcs, attrs)
+}
+
+func (gcs *GCSBackup) compose(ctx context.Context, dst string, srcs []string, attrs *WriterAttrs) error {
+	bucket := gcs.client.Bucket(gcs.bucketName)
+	objects := make([]*storage.ObjectHandle, 0, len(srcs))
+	for _, src := range srcs {
+		objects = append(objects, bucket.Object(src))
+	}
+	composer := bucket.Object(dst).ComposerFrom(objects...)
+	composer.ContentType = attrs.ContentType
+	composer.ContentEncoding = attrs.ContentEncoding
+	composer.Metadata = attrs.Metadata
+	if _, err := composer.Run(ctx); err != nil {
+		return fmt.Errorf("failed to compose %s: %w", dst, err)
+	}
+	return nil
+}
@@ -0,0 +1,331 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Target is a named storage, e.g. `gcs:bucket`
+type Target struct {
+	Name    string
+	Backend Backend
+}
+
+// TargetStatus tracks the replication to a target
+type TargetStatus struct {
+	Name    string
+	Objects int // replicated objects
+	Skipped int // objects already present on the target
+	Errors  []error
+}
+
+func (s TargetStatus) Err() error {
+	if len(s.Errors) == 0 {
+		return nil
+	}
+	return fmt.Errorf("replication to %s failed: %w", s.Name, errors.Join(s.Errors...))
+}
+
+// Replicated writes every object to the primary and all replicas at the same time. Errors of
+// the primary are returned, while a replica that fails is skipped for the rest of the run and
+// reported by Status; so a replica never receives a success marker for a run it missed. The
+// objects a failed replica received are still deleted, and discarded instead of renamed.
+type Replicated struct {
+	primary  Backend
+	replicas []Target
+
+	mutex    sync.Mutex
+	statuses map[string]*TargetStatus
+	received map[string]map[string]bool // paths of the objects per replica a writer was opened for
+}
+
+func NewReplicated(primary Backend, replicas ...Target) *Replicated {
+	statuses := map[string]*TargetStatus{}
+	received := map[string]map[string]bool{}
+	for _, replica := range replicas {
+		statuses[replica.Name] = &TargetStatus{Name: replica.Name}
+		received[replica.Name] = map[string]bool{}
+	}
+	return &Replicated{primary: primary, replicas: replicas, statuses: statuses, received: received}
+}
+
+// Status returns the status of all replicas
+func (r *Replicated) Status() []TargetStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	statuses := make([]TargetStatus, 0, len(r.replicas))
+	for _, replica := range r.replicas {
+		statuses = append(statuses, *r.statuses[replica.Name])
+	}
+	return statuses
+}
+
+func (r *Replicated) NewWriter(ctx context.Context, path string, opts ...WriterOption) (io.WriteCloser, error) {
+	writer, err := r.primary.NewWriter(ctx, path, opts...)
+	if err != nil {
+		return nil, err
+	}
+	tee := &teeWriter{primary: writer, replicated: r}
+	for _, replica := range r.active() {
+		replicaWriter, err := replica.Backend.NewWriter(ctx, path, opts...)
+		if err != nil {
+			r.fail(replica, fmt.Errorf("failed to initialize writer for %s: %w", path, err))
+			continue
+		}
+		r.receive(replica, path)
+		tee.replicas = append(tee.replicas, &replicaTee{target: replica, writer: replicaWriter})
+	}
+	return tee, nil
+}
+
+// NewReader reads from the primary
+func (r *Replicated) NewReader(ctx context.Context, path string) (io.ReadCloser, error) {
+	return r.primary.NewReader(ctx, path)
+}
+
+// List lists the primary
+func (r *Replicated) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	return r.primary.List(ctx, prefix)
+}
+
+func (r *Replicated) UpdateMetadata(ctx context.Context, path string, metadata map[string]string) error {
+	if err := r.primary.UpdateMetadata(ctx, path, metadata); err != nil {
+		return err
+	}
+	active, _ := r.targets(path)
+	for _, replica := range active {
+		if err := replica.Backend.UpdateMetadata(ctx, path, metadata); err != nil {
+			r.fail(replica, fmt.Errorf("%s: %w", path, err))
+		}
+	}
+	return nil
+}
+
+// Delete deletes the object on all replicas having it, also if the primary fails, e.g. the
+// pending objects of an aborted run
+func (r *Replicated) Delete(ctx context.Context, path string) error {
+	err := r.primary.Delete(ctx, path)
+	active, failed := r.targets(path)
+	for _, replica := range append(active, failed...) {
+		r.discard(ctx, replica, path)
+	}
+	return err
+}
+
+// Rename renames the object on the primary and all active replicas, failed replicas discard it
+// so they never commit an object they may have received partially
+func (r *Replicated) Rename(ctx context.Context, src, dst string) error {
+	if err := r.primary.Rename(ctx, src, dst); err != nil {
+		return err
+	}
+	active, failed := r.targets(src)
+	for _, replica := range active {
+		if err := replica.Backend.Rename(ctx, src, dst); err != nil {
+			r.fail(replica, fmt.Errorf("%s: %w", src, err))
+			r.discard(ctx, replica, src)
+			continue
+		}
+		r.mutex.Lock()
+		delete(r.received[replica.Name], src)
+		r.received[replica.Name][dst] = true
+		r.mutex.Unlock()
+	}
+	for _, replica := range failed {
+		r.discard(ctx, replica, src)
+	}
+	return nil
+}
+
+// discard deletes the object on the replica, errors are reported by Status
+func (r *Replicated) discard(ctx context.Context, replica Target, path string) {
+	if err := replica.Backend.Delete(ctx, path); err != nil && !errors.Is(err, ErrNotExist) {
+		r.fail(replica, fmt.Errorf("failed to delete %s: %w", path, err))
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.received[replica.Name], path)
+}
+
+// targets returns the active replicas and the failed replicas which received the object
+func (r *Replicated) targets(path string) (active, failed []Target) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, replica := range r.replicas {
+		switch {
+		case len(r.statuses[replica.Name].Errors) == 0:
+			active = append(active, replica)
+		case r.received[replica.Name][path]:
+			failed = append(failed, replica)
+		}
+	}
+	return active, failed
+}
+
+func (r *Replicated) active() []Target {
+	active, _ := r.targets("")
+	return active
+}
+
+func (r *Replicated) receive(replica Target, path string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.received[replica.Name][path] = true
+}
+
+func (r *Replicated) fail(replica Target, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	status := r.statuses[replica.Name]
+	status.Errors = append(status.Errors, err)
+}
+
+func (r *Replicated) written(replica Target) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.statuses[replica.Name].Objects++
+}
+
+type replicaTee struct {
+	target Target
+	writer io.WriteCloser
+	failed bool
+}
+
+type teeWriter struct {
+	primary    io.WriteCloser
+	replicas   []*replicaTee
+	replicated *Replicated
+}
+
+func (w *teeWriter) Write(p []byte) (int, error) {
+	n, err := w.primary.Write(p)
+	if err != nil {
+		return n, err
+	}
+	for _, replica := range w.replicas {
+		if replica.failed {
+			continue
+		}
+		if _, err := replica.writer.Write(p); err != nil {
+			replica.failed = true
+			_ = replica.writer.Close()
+			w.replicated.fail(replica.target, err)
+		}
+	}
+	return n, nil
+}
+
+func (w *teeWriter) Close() error {
+	err := w.primary.Close()
+	for _, replica := range w.replicas {
+		if replica.failed {
+			continue
+		}
+		if closeErr := replica.writer.Close(); closeErr != nil {
+			w.replicated.fail(replica.target, closeErr)
+			continue
+		}
+		w.replicated.written(replica.target)
+	}
+	return err
+}
+
+// Copy copies the object including its attributes from src to dst
+func Copy(ctx context.Context, src, dst Backend, object ObjectInfo) error {
+	reader, err := src.NewReader(ctx, object.Path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	var opts []WriterOption
+	if object.ContentType != "" {
+		opts = append(opts, WithContentType(object.ContentType))
+	}
+	if object.ContentEncoding != "" {
+		opts = append(opts, WithContentEncoding(object.ContentEncoding))
+	}
+	for key, value := range object.Metadata {
+		opts = append(opts, WithMetadata(key, value))
+	}
+	writer, err := dst.NewWriter(ctx, object.Path, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to initialize writer: %w", err)
+	}
+	if _, err := io.Copy(writer, reader); err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+// CopyPaths copies the objects to the target after they have been written to src, e.g. the
+// committed objects of a run
+func CopyPaths(ctx context.Context, src Backend, dst Target, paths ...string) TargetStatus {
+	status := TargetStatus{Name: dst.Name}
+	for _, path := range paths {
+		object, err := stat(ctx, src, path)
+		if err == nil {
+			err = Copy(ctx, src, dst.Backend, object)
+		}
+		if err != nil {
+			status.Errors = append(status.Errors, fmt.Errorf("failed to copy %s: %w", path, err))
+			continue
+		}
+		status.Objects++
+	}
+	return status
+}
+
+// stat returns the attributes of the object by listing its path
+func stat(ctx context.Context, b Backend, path string) (ObjectInfo, error) {
+	objects, err := b.List(ctx, path)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	for _, object := range objects {
+		if object.Path == path {
+			return object, nil
+		}
+	}
+	return ObjectInfo{}, ErrNotExist
+}
+
+// Backfill copies all objects below the prefix which are missing on the target, or differ in
+// size, from src; pending objects and the parts of chunked uploads are skipped
+func Backfill(ctx context.Context, src Backend, dst Target, prefix string) (TargetStatus, error) {
+	status := TargetStatus{Name: dst.Name}
+	objects, err := src.List(ctx, prefix)
+	if err != nil {
+		return status, err
+	}
+	existing, err := dst.Backend.List(ctx, prefix)
+	if err != nil {
+		return status, fmt.Errorf("failed to list %s: %w", dst.Name, err)
+	}
+	sizes := map[string]int64{}
+	for _, object := range existing {
+		sizes[object.Path] = object.Size
+	}
+
+	for _, object := range objects {
+		if strings.HasSuffix(object.Path, PendingSuffix) || strings.Contains(object.Path, PartsSuffix+"/") {
+			continue
+		}
+		if size, ok := sizes[object.Path]; ok && size == object.Size {
+			status.Skipped++
+			continue
+		}
+		if err := Copy(ctx, src, dst.Backend, object); err != nil {
+			status.Errors = append(status.Errors, fmt.Errorf("failed to copy %s: %w", object.Path, err))
+			continue
+		}
+		status.Objects++
+	}
+	return status, nil
+}
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var errBroken = errors.New("broken")
+
+// brokenBackend fails all writes
+type brokenBackend struct {
+	Backend
+}
+
+func (b brokenBackend) NewWriter(ctx context.Context, path string, opts ...WriterOption) (io.WriteCloser, error) {
+	writer, err := b.Backend.NewWriter(ctx, path, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return brokenWriter{writer}, nil
+}
+
+type brokenWriter struct {
+	io.WriteCloser
+}
+
+func (brokenWriter) Write(p []byte) (int, error) {
+	return 0, errBroken
+}
+
+// failingBackend fails all writes after the given number of writers
+type failingBackend struct {
+	Backend
+	after   int
+	writers int
+}
+
+func (b *failingBackend) NewWriter(ctx context.Context, path string, opts ...WriterOption) (io.WriteCloser, error) {
+	writer, err := b.Backend.NewWriter(ctx, path, opts...)
+	if err != nil {
+		return nil, err
+	}
+	b.writers++
+	if b.writers > b.after {
+		return brokenWriter{writer}, nil
+	}
+	return writer, nil
+}
+
+func TestReplicated(t *testing.T) {
+	ctx := context.Background()
+	newFS := func(t *testing.T) (string, *FSStorage) {
+		t.Helper()
+		root := t.TempDir()
+		fs, err := NewFSStorage(ctx, root)
+		require.NoError(t, err)
+		return root, fs
+	}
+
+	t.Run("tee", func(t *testing.T) {
+		primaryRoot, primary := newFS(t)
+		replicaRoot, replica := newFS(t)
+		brokenRoot, broken := newFS(t)
+		replicated := NewReplicated(primary,
+			Target{Name: "fs:replica", Backend: replica},
+			Target{Name: "fs:broken", Backend: brokenBackend{broken}},
+		)
+		atomic, err := NewAtomic(replicated)
+		require.NoError(t, err)
+
+		require.NoError(t, writeObject(t, ctx, atomic, "backup/dump", "data").Close())
+		require.NoError(t, atomic.UpdateMetadata(ctx, "backup/dump", map[string]string{"Status": "success"}))
+		require.NoError(t, atomic.Commit(ctx))
+		require.NoError(t, atomic.WriteMarker(ctx, "backup/dump"))
+
+		expected := []string{"backup/dump", "backup/dump.SUCCESS"}
+		require.ElementsMatch(t, expected, listFiles(t, primaryRoot))
+		require.ElementsMatch(t, expected, listFiles(t, replicaRoot))
+		// the broken replica is skipped after its first failure, discards what it received and
+		// never gets the marker
+		require.Empty(t, listFiles(t, brokenRoot))
+
+		statuses := replicated.Status()
+		require.Len(t, statuses, 2)
+		require.NoError(t, statuses[0].Err())
+		require.Equal(t, 2, statuses[0].Objects)
+		require.ErrorIs(t, statuses[1].Err(), errBroken)
+		require.Zero(t, statuses[1].Objects)
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		primaryRoot, primary := newFS(t)
+		replicaRoot, replica := newFS(t)
+		replicated := NewReplicated(primary, Target{Name: "fs:replica", Backend: &failingBackend{Backend: replica, after: 1}})
+		atomic, err := NewAtomic(replicated)
+		require.NoError(t, err)
+
+		// the replica receives the first object and fails during the second one
+		require.NoError(t, writeObject(t, ctx, atomic, "backup/a", "a").Close())
+		require.NoError(t, writeObject(t, ctx, atomic, "backup/b", "b").Close())
+		require.NotEmpty(t, listFiles(t, replicaRoot))
+		require.NoError(t, atomic.Abort(ctx))
+
+		require.Empty(t, listFiles(t, primaryRoot))
+		require.Empty(t, listFiles(t, replicaRoot))
+		require.ErrorIs(t, replicated.Status()[0].Err(), errBroken)
+	})
+
+	t.Run("copy paths", func(t *testing.T) {
+		_, primary := newFS(t)
+		replicaRoot, replica := newFS(t)
+		require.NoError(t, writeObject(t, ctx, primary, "backup/dump", "data").Close())
+
+		status := CopyPaths(ctx, primary, Target{Name: "fs:replica", Backend: replica}, "backup/dump", "backup/missing")
+		require.Equal(t, 1, status.Objects)
+		require.ErrorIs(t, status.Err(), ErrNotExist)
+		require.Equal(t, []string{"backup/dump"}, listFiles(t, replicaRoot))
+	})
+
+	t.Run("backfill", func(t *testing.T) {
+		_, primary := newFS(t)
+		replicaRoot, replica := newFS(t)
+		require.NoError(t, writeObject(t, ctx, primary, "backup/a", "a").Close())
+		require.NoError(t, writeObject(t, ctx, primary, "backup/b", "b").Close())
+		require.NoError(t, writeObject(t, ctx, primary, "backup/c", "changed").Close())
+		require.NoError(t, writeObject(t, ctx, primary, "backup/d.1234.pending", "partial").Close())
+		require.NoError(t, writeObject(t, ctx, primary, "other/e", "e").Close())
+		require.NoError(t, writeObject(t, ctx, replica, "backup/a", "a").Close())
+		require.NoError(t, writeObject(t, ctx, replica, "backup/c", "c").Close())
+
+		status, err := Backfill(ctx, primary, Target{Name: "fs:replica", Backend: replica}, "backup/")
+		require.NoError(t, err)
+		require.NoError(t, status.Err())
+		require.Equal(t, 2, status.Objects)
+		require.Equal(t, 1, status.Skipped)
+		require.ElementsMatch(t, []string{"backup/a", "backup/b", "backup/c"}, listFiles(t, replicaRoot))
+
+		reader, err := replica.NewReader(ctx, "backup/c")
+		require.NoError(t, err)
+		data, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		require.NoError(t, reader.Close())
+		require.Equal(t, "changed", string(data))
+	})
+}
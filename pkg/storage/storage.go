@@ -0,0 +1,19 @@
+package storage
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNotExist is returned by readers when the requested object does not exist
+var ErrNotExist = errors.New("object does not exist")
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Path            string            `json:"path"`
+	Size            int64             `json:"size"`
+	Updated         time.Time         `json:"updated"`
+	ContentType     string            `json:"contentType,omitempty"`
+	ContentEncoding string            `json:"contentEncoding,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+}